@@ -0,0 +1,636 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	AuthorizerQueueLength = 80    // Q: authorizer hashes assigned to a core at once
+	TransferMemoSize      = 128   // W_T: size of a transfer memo
+	PreimageExpungePeriod = 28800 // D: slots after which a forgotten preimage may be removed
+	ValidatorKeySize      = 336   // Bandersnatch, Ed25519, BLS and metadata
+)
+
+// DeferredTransfer is a balance transfer made during accumulation, delivered
+// to the receiver's on_transfer entry point once accumulation completes.
+type DeferredTransfer struct {
+	Sender   uint32
+	Receiver uint32
+	Amount   uint64
+	Memo     [TransferMemoSize]byte
+	GasLimit uint64
+}
+
+// AccumulationRoot commits to the hashes yielded by services during
+// accumulation: the well-balanced Merkle root of E4(s) ⌢ h for each service s
+// and its yield h, in order of service index.
+func AccumulationRoot(yields map[uint32]Hash) Hash {
+	services := make([]uint32, 0, len(yields))
+	for service := range yields {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i] < services[j] })
+
+	leaves := make([][]byte, len(services))
+	for i, service := range services {
+		yield := yields[service]
+		leaves[i] = append(binary.LittleEndian.AppendUint32(nil, service), yield[:]...)
+	}
+	return WellBalancedMerkleRoot(leaves)
+}
+
+// AccumulationContext is the state an accumulate invocation operates on and
+// mutates (X in the Gray Paper).
+type AccumulationContext struct {
+	ServiceIndex uint32
+	Accounts     map[uint32]ServiceAccount
+	Authorizers  [][]Hash       // φ
+	Validators   []ValidatorKey // ι
+	Privileges   struct {
+		Manager    uint32
+		Authorizer uint32
+		Validator  uint32
+	}
+	NextServiceIndex uint32
+	Transfers        []DeferredTransfer
+	Yield            *Hash
+}
+
+// NewAccumulationContext builds the initial accumulation context for service
+// serviceIndex from state.
+func NewAccumulationContext(state *State, serviceIndex uint32) *AccumulationContext {
+	ctx := &AccumulationContext{
+		ServiceIndex: serviceIndex,
+		Accounts:     make(map[uint32]ServiceAccount, len(state.Delta)),
+		Authorizers:  make([][]Hash, len(state.Phi)),
+		Validators:   append([]ValidatorKey{}, state.Iota...),
+		Privileges:   state.Chi,
+	}
+	for index, account := range state.Delta {
+		ctx.Accounts[index] = account.clone()
+	}
+	for i, queue := range state.Phi {
+		ctx.Authorizers[i] = append([]Hash{}, queue...)
+	}
+
+	var seed []byte
+	seed = binary.LittleEndian.AppendUint32(seed, serviceIndex)
+	seed = append(seed, state.Eta[0][:]...)
+	seed = binary.LittleEndian.AppendUint32(seed, state.Tau)
+	hash := blake2b.Sum256(seed)
+	ctx.NextServiceIndex = ctx.checkServiceIndex(binary.LittleEndian.Uint32(hash[:4])%(1<<32-1<<9) + 1<<8)
+
+	return ctx
+}
+
+// Apply writes the effects of the accumulation back into state.
+func (ctx *AccumulationContext) Apply(state State) State {
+	state.Delta = ctx.Accounts
+	state.Phi = ctx.Authorizers
+	state.Iota = ctx.Validators
+	state.Chi = ctx.Privileges
+	return state
+}
+
+func (ctx *AccumulationContext) clone() *AccumulationContext {
+	c := *ctx
+	c.Accounts = make(map[uint32]ServiceAccount, len(ctx.Accounts))
+	for index, account := range ctx.Accounts {
+		c.Accounts[index] = account.clone()
+	}
+	c.Authorizers = make([][]Hash, len(ctx.Authorizers))
+	for i, queue := range ctx.Authorizers {
+		c.Authorizers[i] = append([]Hash{}, queue...)
+	}
+	c.Validators = append([]ValidatorKey{}, ctx.Validators...)
+	c.Transfers = append([]DeferredTransfer{}, ctx.Transfers...)
+	if ctx.Yield != nil {
+		yield := *ctx.Yield
+		c.Yield = &yield
+	}
+	return &c
+}
+
+// checkServiceIndex returns the first index from i onwards that is not in use.
+func (ctx *AccumulationContext) checkServiceIndex(i uint32) uint32 {
+	for {
+		if _, exists := ctx.Accounts[i]; !exists {
+			return i
+		}
+		i = (i-1<<8+1)%(1<<32-1<<9) + 1<<8
+	}
+}
+
+func (sa ServiceAccount) clone() ServiceAccount {
+	c := sa
+	c.Storage = make(map[Hash][]byte, len(sa.Storage))
+	for k, v := range sa.Storage {
+		c.Storage[k] = v
+	}
+	c.PreimageLookup = make(map[Hash][]byte, len(sa.PreimageLookup))
+	for k, v := range sa.PreimageLookup {
+		c.PreimageLookup[k] = v
+	}
+	c.PreimageMeta = make(map[struct {
+		Hash
+		Length uint32
+	}][]uint32, len(sa.PreimageMeta))
+	for k, v := range sa.PreimageMeta {
+		c.PreimageMeta[k] = append([]uint32{}, v...)
+	}
+	return c
+}
+
+// AccumulateHost implements the accumulate host calls. Regular is the context
+// kept if the invocation halts, and Exceptional the one kept if it panics or
+// runs out of gas, as last set by checkpoint.
+type AccumulateHost struct {
+	Regular     *AccumulationContext
+	Exceptional *AccumulationContext
+	Timeslot    uint32
+}
+
+func NewAccumulateHost(state *State, serviceIndex uint32) *AccumulateHost {
+	ctx := NewAccumulationContext(state, serviceIndex)
+	return &AccumulateHost{
+		Regular:     ctx,
+		Exceptional: ctx.clone(),
+		Timeslot:    state.Tau,
+	}
+}
+
+func (h *AccumulateHost) HostCall(index uint32, pvm *PVM) (ExitReason, error) {
+	if index == HostTransfer {
+		// The gas limit of a transfer is charged as well, so one beyond the
+		// remaining gas is refused before anything is charged
+		if pvm.Gas < 0 || register64(pvm, 10, 11) > uint64(pvm.Gas) {
+			pvm.Registers[7] = ResultHigh
+			return ExitContinue, nil
+		}
+	}
+	if !chargeHostGas(pvm, HostCallGasCost) {
+		return ExitOOG, nil
+	}
+	// Having been checked against the remaining gas, the limit fits an int64
+	if index == HostTransfer && !chargeHostGas(pvm, int64(register64(pvm, 10, 11))) {
+		return ExitOOG, nil
+	}
+
+	switch index {
+	case HostGas:
+		h.gas(pvm)
+	case HostLookup:
+		h.lookup(pvm)
+	case HostRead:
+		h.read(pvm)
+	case HostWrite:
+		h.write(pvm)
+	case HostInfo:
+		h.info(pvm)
+	case HostBless:
+		h.bless(pvm)
+	case HostAssign:
+		h.assign(pvm)
+	case HostDesignate:
+		h.designate(pvm)
+	case HostCheckpoint:
+		h.Exceptional = h.Regular.clone()
+		h.gas(pvm)
+	case HostNew:
+		h.new(pvm)
+	case HostUpgrade:
+		h.upgrade(pvm)
+	case HostTransfer:
+		h.transfer(pvm)
+	case HostQuit:
+		return h.quit(pvm), nil
+	case HostSolicit:
+		h.solicit(pvm)
+	case HostForget:
+		h.forget(pvm)
+	case HostYield:
+		h.yield(pvm)
+	default:
+		pvm.Registers[7] = ResultWhat
+	}
+	return ExitContinue, nil
+}
+
+func (h *AccumulateHost) self() *ServiceAccount {
+	account := h.Regular.Accounts[h.Regular.ServiceIndex]
+	return &account
+}
+
+func (h *AccumulateHost) setSelf(account *ServiceAccount) {
+	h.Regular.Accounts[h.Regular.ServiceIndex] = *account
+}
+
+// service resolves a service index argument, where 2^32-1 means the caller.
+func (h *AccumulateHost) service(index uint32) (uint32, *ServiceAccount) {
+	if index == 1<<32-1 {
+		index = h.Regular.ServiceIndex
+	}
+	account, exists := h.Regular.Accounts[index]
+	if !exists {
+		return index, nil
+	}
+	return index, &account
+}
+
+// storageKey derives the storage key of a guest-provided key for service.
+func storageKey(service uint32, key []byte) Hash {
+	return blake2b.Sum256(append(binary.LittleEndian.AppendUint32(nil, service), key...))
+}
+
+func (h *AccumulateHost) gas(pvm *PVM) {
+	pvm.Registers[7] = uint32(pvm.Gas)
+	pvm.Registers[8] = uint32(pvm.Gas >> 32)
+}
+
+func (h *AccumulateHost) lookup(pvm *PVM) {
+	_, account := h.service(pvm.Registers[7])
+	hash, ok := readGuest(pvm, pvm.Registers[8], HashSize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	if account == nil {
+		pvm.Registers[7] = ResultNone
+		return
+	}
+	value, exists := account.PreimageLookup[Hash(hash)]
+	if !exists {
+		pvm.Registers[7] = ResultNone
+		return
+	}
+	writeGuestAvailable(pvm, pvm.Registers[9], pvm.Registers[10], value)
+}
+
+func (h *AccumulateHost) read(pvm *PVM) {
+	index, account := h.service(pvm.Registers[7])
+	key, ok := readGuest(pvm, pvm.Registers[8], pvm.Registers[9])
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	if account == nil {
+		pvm.Registers[7] = ResultNone
+		return
+	}
+	value, exists := account.Storage[storageKey(index, key)]
+	if !exists {
+		pvm.Registers[7] = ResultNone
+		return
+	}
+	writeGuestAvailable(pvm, pvm.Registers[10], pvm.Registers[11], value)
+}
+
+func (h *AccumulateHost) write(pvm *PVM) {
+	key, ok := readGuest(pvm, pvm.Registers[7], pvm.Registers[8])
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	value, ok := readGuest(pvm, pvm.Registers[9], pvm.Registers[10])
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+
+	account := h.self()
+	k := storageKey(h.Regular.ServiceIndex, key)
+	previous, existed := account.Storage[k]
+
+	updated := account.clone()
+	if len(value) == 0 {
+		delete(updated.Storage, k)
+	} else {
+		updated.Storage[k] = value
+	}
+	if updated.CalculateThresholdBalance() > updated.Balance {
+		pvm.Registers[7] = ResultFull
+		return
+	}
+	h.setSelf(&updated)
+
+	if existed {
+		pvm.Registers[7] = uint32(len(previous))
+	} else {
+		pvm.Registers[7] = ResultNone
+	}
+}
+
+func (h *AccumulateHost) info(pvm *PVM) {
+	_, account := h.service(pvm.Registers[7])
+	if account == nil {
+		pvm.Registers[7] = ResultNone
+		return
+	}
+
+	items, octets := account.CalculateAccountFootprint()
+	var buf []byte
+	buf = append(buf, account.CodeHash[:]...)
+	buf = binary.LittleEndian.AppendUint64(buf, account.Balance)
+	buf = binary.LittleEndian.AppendUint64(buf, account.CalculateThresholdBalance())
+	buf = binary.LittleEndian.AppendUint64(buf, account.AccumulateGasLimit)
+	buf = binary.LittleEndian.AppendUint64(buf, account.OnTransferGasLimit)
+	buf = binary.LittleEndian.AppendUint64(buf, octets)
+	buf = binary.LittleEndian.AppendUint32(buf, items)
+	if !writeGuest(pvm, pvm.Registers[8], buf) {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	pvm.Registers[7] = ResultOK
+}
+
+func (h *AccumulateHost) bless(pvm *PVM) {
+	if h.Regular.ServiceIndex != h.Regular.Privileges.Manager {
+		pvm.Registers[7] = ResultHuh
+		return
+	}
+	h.Regular.Privileges.Manager = pvm.Registers[7]
+	h.Regular.Privileges.Authorizer = pvm.Registers[8]
+	h.Regular.Privileges.Validator = pvm.Registers[9]
+	pvm.Registers[7] = ResultOK
+}
+
+func (h *AccumulateHost) assign(pvm *PVM) {
+	data, ok := readGuest(pvm, pvm.Registers[8], AuthorizerQueueLength*HashSize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	core := pvm.Registers[7]
+	if core >= uint32(len(h.Regular.Authorizers)) {
+		pvm.Registers[7] = ResultCore
+		return
+	}
+	if h.Regular.ServiceIndex != h.Regular.Privileges.Authorizer {
+		pvm.Registers[7] = ResultHuh
+		return
+	}
+
+	queue := make([]Hash, AuthorizerQueueLength)
+	for i := range queue {
+		copy(queue[i][:], data[i*HashSize:])
+	}
+	h.Regular.Authorizers[core] = queue
+	pvm.Registers[7] = ResultOK
+}
+
+func (h *AccumulateHost) designate(pvm *PVM) {
+	count := uint32(len(h.Regular.Validators))
+	data, ok := readGuest(pvm, pvm.Registers[7], count*ValidatorKeySize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	if h.Regular.ServiceIndex != h.Regular.Privileges.Validator {
+		pvm.Registers[7] = ResultHuh
+		return
+	}
+
+	validators := make([]ValidatorKey, count)
+	for i := range validators {
+		key := data[i*ValidatorKeySize:]
+		copy(validators[i].BandersnatchKey[:], key[0:32])
+		copy(validators[i].Ed25519Key[:], key[32:64])
+		copy(validators[i].BLSKey[:], key[64:208])
+		copy(validators[i].Metadata[:], key[208:336])
+	}
+	h.Regular.Validators = validators
+	pvm.Registers[7] = ResultOK
+}
+
+func (h *AccumulateHost) new(pvm *PVM) {
+	codeHash, ok := readGuest(pvm, pvm.Registers[7], HashSize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+
+	account := ServiceAccount{
+		Storage:        make(map[Hash][]byte),
+		PreimageLookup: make(map[Hash][]byte),
+		PreimageMeta: map[struct {
+			Hash
+			Length uint32
+		}][]uint32{
+			{Hash(codeHash), pvm.Registers[8]}: {},
+		},
+		CodeHash:           Hash(codeHash),
+		AccumulateGasLimit: register64(pvm, 9, 10),
+		OnTransferGasLimit: register64(pvm, 11, 12),
+	}
+	account.Balance = account.CalculateThresholdBalance()
+
+	self := h.self()
+	if self.Balance < account.Balance || self.Balance-account.Balance < self.CalculateThresholdBalance() {
+		pvm.Registers[7] = ResultCash
+		return
+	}
+	self.Balance -= account.Balance
+	h.setSelf(self)
+
+	index := h.Regular.NextServiceIndex
+	h.Regular.Accounts[index] = account
+	h.Regular.NextServiceIndex = h.Regular.checkServiceIndex((index-1<<8+42)%(1<<32-1<<9) + 1<<8)
+	pvm.Registers[7] = index
+}
+
+func (h *AccumulateHost) upgrade(pvm *PVM) {
+	codeHash, ok := readGuest(pvm, pvm.Registers[7], HashSize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+
+	self := h.self()
+	self.CodeHash = Hash(codeHash)
+	self.Code = self.PreimageLookup[self.CodeHash]
+	self.AccumulateGasLimit = register64(pvm, 8, 9)
+	self.OnTransferGasLimit = register64(pvm, 10, 11)
+	h.setSelf(self)
+	pvm.Registers[7] = ResultOK
+}
+
+func (h *AccumulateHost) transfer(pvm *PVM) {
+	receiver := pvm.Registers[7]
+	amount := register64(pvm, 8, 9)
+	gasLimit := register64(pvm, 10, 11)
+	memo, ok := readGuest(pvm, pvm.Registers[12], TransferMemoSize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+
+	self := h.self()
+	result := h.deferTransfer(self, receiver, amount, gasLimit, memo)
+	if result != ResultOK {
+		pvm.Registers[7] = result
+		return
+	}
+	if self.Balance-amount < self.CalculateThresholdBalance() {
+		pvm.Registers[7] = ResultCash
+		h.Regular.Transfers = h.Regular.Transfers[:len(h.Regular.Transfers)-1]
+		return
+	}
+	self.Balance -= amount
+	h.setSelf(self)
+	pvm.Registers[7] = ResultOK
+}
+
+// deferTransfer validates a transfer from the caller and queues it.
+func (h *AccumulateHost) deferTransfer(self *ServiceAccount, receiver uint32, amount uint64, gasLimit uint64, memo []byte) uint32 {
+	destination, exists := h.Regular.Accounts[receiver]
+	if !exists {
+		return ResultWho
+	}
+	if gasLimit < destination.OnTransferGasLimit {
+		return ResultLow
+	}
+	if self.Balance < amount {
+		return ResultCash
+	}
+
+	transfer := DeferredTransfer{
+		Sender:   h.Regular.ServiceIndex,
+		Receiver: receiver,
+		Amount:   amount,
+		GasLimit: gasLimit,
+	}
+	copy(transfer.Memo[:], memo)
+	h.Regular.Transfers = append(h.Regular.Transfers, transfer)
+	return ResultOK
+}
+
+// quit removes the calling service, sending its balance to the service in ω7
+// unless that is the caller itself, and halts the invocation.
+func (h *AccumulateHost) quit(pvm *PVM) ExitReason {
+	receiver := pvm.Registers[7]
+	self := h.self()
+
+	if receiver != h.Regular.ServiceIndex && receiver != 1<<32-1 {
+		memo, ok := readGuest(pvm, pvm.Registers[8], TransferMemoSize)
+		if !ok {
+			pvm.Registers[7] = ResultOOB
+			return ExitContinue
+		}
+		if result := h.deferTransfer(self, receiver, self.Balance, uint64(pvm.Gas), memo); result != ResultOK {
+			pvm.Registers[7] = result
+			return ExitContinue
+		}
+	}
+
+	delete(h.Regular.Accounts, h.Regular.ServiceIndex)
+	pvm.Registers[7] = ResultOK
+	return ExitHalt
+}
+
+func (h *AccumulateHost) solicit(pvm *PVM) {
+	hash, ok := readGuest(pvm, pvm.Registers[7], HashSize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	key := struct {
+		Hash
+		Length uint32
+	}{Hash(hash), pvm.Registers[8]}
+
+	self := h.self()
+	updated := self.clone()
+	meta, exists := updated.PreimageMeta[key]
+	switch {
+	case !exists:
+		updated.PreimageMeta[key] = []uint32{}
+	case len(meta) == 2:
+		updated.PreimageMeta[key] = append(meta, h.Timeslot)
+	default:
+		pvm.Registers[7] = ResultHuh
+		return
+	}
+	if updated.CalculateThresholdBalance() > updated.Balance {
+		pvm.Registers[7] = ResultFull
+		return
+	}
+	h.setSelf(&updated)
+	pvm.Registers[7] = ResultOK
+}
+
+func (h *AccumulateHost) forget(pvm *PVM) {
+	hash, ok := readGuest(pvm, pvm.Registers[7], HashSize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	key := struct {
+		Hash
+		Length uint32
+	}{Hash(hash), pvm.Registers[8]}
+
+	self := h.self()
+	updated := self.clone()
+	meta, exists := updated.PreimageMeta[key]
+	expired := func(slot uint32) bool {
+		return h.Timeslot >= PreimageExpungePeriod && slot < h.Timeslot-PreimageExpungePeriod
+	}
+	switch {
+	case exists && (len(meta) == 0 || len(meta) == 2 && expired(meta[1])):
+		delete(updated.PreimageMeta, key)
+		delete(updated.PreimageLookup, key.Hash)
+	case exists && len(meta) == 1:
+		updated.PreimageMeta[key] = []uint32{meta[0], h.Timeslot}
+	case exists && len(meta) == 3 && expired(meta[1]):
+		updated.PreimageMeta[key] = []uint32{meta[2], h.Timeslot}
+	default:
+		pvm.Registers[7] = ResultHuh
+		return
+	}
+	h.setSelf(&updated)
+	pvm.Registers[7] = ResultOK
+}
+
+func (h *AccumulateHost) yield(pvm *PVM) {
+	hash, ok := readGuest(pvm, pvm.Registers[7], HashSize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	yield := Hash(hash)
+	h.Regular.Yield = &yield
+	pvm.Registers[7] = ResultOK
+}
+
+// Serialize encodes a transfer as passed to on_transfer:
+// E4(s) ⌢ E4(d) ⌢ E8(a) ⌢ m ⌢ E8(g)
+func (t DeferredTransfer) Serialize() []byte {
+	var buf []byte
+	buf = binary.LittleEndian.AppendUint32(buf, t.Sender)
+	buf = binary.LittleEndian.AppendUint32(buf, t.Receiver)
+	buf = binary.LittleEndian.AppendUint64(buf, t.Amount)
+	buf = append(buf, t.Memo[:]...)
+	buf = binary.LittleEndian.AppendUint64(buf, t.GasLimit)
+	return buf
+}
+
+// OnTransferHost implements the host calls available to on_transfer, which
+// may inspect services but only modify the receiving service's storage.
+type OnTransferHost struct {
+	AccumulateHost
+}
+
+func (h *OnTransferHost) HostCall(index uint32, pvm *PVM) (ExitReason, error) {
+	switch index {
+	case HostGas, HostLookup, HostRead, HostWrite, HostInfo:
+		return h.AccumulateHost.HostCall(index, pvm)
+	}
+	if !chargeHostGas(pvm, HostCallGasCost) {
+		return ExitOOG, nil
+	}
+	pvm.Registers[7] = ResultWhat
+	return ExitContinue, nil
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newAccumulateTestState(code []byte) State {
+	var state State
+	state.Tau = 100
+	state.Phi = make([][]Hash, 2)
+	state.Delta = map[uint32]ServiceAccount{
+		1: {
+			Storage:            make(map[Hash][]byte),
+			PreimageLookup:     make(map[Hash][]byte),
+			Balance:            2000,
+			AccumulateGasLimit: 1000,
+			Code:               code,
+		},
+		2: {
+			Storage:            make(map[Hash][]byte),
+			PreimageLookup:     make(map[Hash][]byte),
+			Balance:            1000,
+			OnTransferGasLimit: 50,
+		},
+	}
+	return state
+}
+
+func TestAccumulateHostCalls(t *testing.T) {
+	const buffer = 0x10000
+
+	testCases := []struct {
+		name   string
+		index  uint32
+		setup  func(pvm *PVM)
+		exit   ExitReason
+		check  func(t *testing.T, host *AccumulateHost, pvm *PVM)
+		result uint32
+	}{
+		{
+			name:   "Gas",
+			index:  HostGas,
+			exit:   ExitContinue,
+			result: 1000 - HostCallGasCost,
+		},
+		{
+			name:  "Write new storage item",
+			index: HostWrite,
+			setup: func(pvm *PVM) {
+				pvm.Memory.Write(buffer, []byte("keyvalue"))
+				pvm.Registers[7], pvm.Registers[8] = buffer, 3
+				pvm.Registers[9], pvm.Registers[10] = buffer+3, 5
+			},
+			exit:   ExitContinue,
+			result: ResultNone,
+			check: func(t *testing.T, host *AccumulateHost, pvm *PVM) {
+				assert.Equal(t, []byte("value"), host.Regular.Accounts[1].Storage[storageKey(1, []byte("key"))])
+				assert.Empty(t, host.Exceptional.Accounts[1].Storage)
+			},
+		},
+		{
+			name:  "Write beyond threshold balance",
+			index: HostWrite,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7], pvm.Registers[8] = buffer, 3
+				pvm.Registers[9], pvm.Registers[10] = buffer, PageSize
+			},
+			exit:   ExitContinue,
+			result: ResultFull,
+		},
+		{
+			name:  "Write from inaccessible memory",
+			index: HostWrite,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7], pvm.Registers[8] = buffer+PageSize, 3
+			},
+			exit:   ExitContinue,
+			result: ResultOOB,
+		},
+		{
+			name:  "Read missing storage item",
+			index: HostRead,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 1<<32 - 1
+				pvm.Registers[8], pvm.Registers[9] = buffer, 3
+			},
+			exit:   ExitContinue,
+			result: ResultNone,
+		},
+		{
+			name:  "Bless without privilege",
+			index: HostBless,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 1
+			},
+			exit:   ExitContinue,
+			result: ResultHuh,
+		},
+		{
+			name:  "Transfer",
+			index: HostTransfer,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 2
+				pvm.Registers[8] = 500
+				pvm.Registers[10] = 50
+				pvm.Registers[12] = buffer
+			},
+			exit:   ExitContinue,
+			result: ResultOK,
+			check: func(t *testing.T, host *AccumulateHost, pvm *PVM) {
+				assert.Equal(t, uint64(1500), host.Regular.Accounts[1].Balance)
+				assert.Equal(t, []DeferredTransfer{{Sender: 1, Receiver: 2, Amount: 500, GasLimit: 50}}, host.Regular.Transfers)
+				assert.Equal(t, int64(1000-HostCallGasCost-50), pvm.Gas)
+			},
+		},
+		{
+			name:  "Transfer below receiver gas limit",
+			index: HostTransfer,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 2
+				pvm.Registers[10] = 10
+				pvm.Registers[12] = buffer
+			},
+			exit:   ExitContinue,
+			result: ResultLow,
+		},
+		{
+			name:  "Transfer beyond remaining gas",
+			index: HostTransfer,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 2
+				pvm.Registers[11] = 0xC0000000
+				pvm.Registers[12] = buffer
+			},
+			exit:   ExitContinue,
+			result: ResultHigh,
+			check: func(t *testing.T, host *AccumulateHost, pvm *PVM) {
+				assert.Equal(t, int64(1000), pvm.Gas, "Nothing is charged")
+				assert.Empty(t, host.Regular.Transfers)
+			},
+		},
+		{
+			name:  "Transfer to unknown service",
+			index: HostTransfer,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 3
+				pvm.Registers[12] = buffer
+			},
+			exit:   ExitContinue,
+			result: ResultWho,
+		},
+		{
+			name:  "Checkpoint",
+			index: HostCheckpoint,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 9
+			},
+			exit:   ExitContinue,
+			result: 1000 - HostCallGasCost,
+		},
+		{
+			name:  "Quit",
+			index: HostQuit,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 2
+				pvm.Registers[8] = buffer
+			},
+			exit:   ExitHalt,
+			result: ResultOK,
+			check: func(t *testing.T, host *AccumulateHost, pvm *PVM) {
+				assert.NotContains(t, host.Regular.Accounts, uint32(1))
+				assert.Equal(t, uint64(2000), host.Regular.Transfers[0].Amount)
+			},
+		},
+		{
+			name:  "Out of gas",
+			index: HostGas,
+			setup: func(pvm *PVM) {
+				pvm.Gas = HostCallGasCost - 1
+				pvm.Registers[7] = 9
+			},
+			exit:   ExitOOG,
+			result: 9,
+		},
+		{
+			name:   "Unknown host call",
+			index:  HostExport,
+			exit:   ExitContinue,
+			result: ResultWhat,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newAccumulateTestState(nil)
+			host := NewAccumulateHost(&state, 1)
+			pvm, err := NewPVM([]byte{OpTrap}, []byte{0b1}, nil, 1000)
+			assert.NoError(t, err)
+			pvm.Memory.SetAccess(buffer, PageSize, PageReadWrite)
+			if tc.setup != nil {
+				tc.setup(pvm)
+			}
+
+			exit, err := host.HostCall(tc.index, pvm)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.exit, exit)
+			assert.Equal(t, tc.result, pvm.Registers[7])
+			if tc.check != nil {
+				tc.check(t, host, pvm)
+			}
+		})
+	}
+}
+
+func TestAccumulate(t *testing.T) {
+	// Entry point 1 writes its arguments under a key of their first byte,
+	// then runs the given tail
+	prefix := []byte{
+		OpTrap,          // 0
+		OpMoveReg, 0x79, // 1: r9 = r7
+		OpMoveReg, 0x8A, // 3: r10 = r8
+		OpLoadImm, 0x08, 0x01, // 5: r8 = 1
+		OpEcalli, byte(HostWrite), // 8
+	}
+
+	testCases := []struct {
+		name     string
+		tail     []byte
+		bitmask  []byte
+		expected bool
+	}{
+		{
+			name:     "Halt keeps changes",
+			tail:     []byte{OpJumpInd, 0x00},
+			bitmask:  []byte{0b00101011, 0b101},
+			expected: true,
+		},
+		{
+			name:     "Panic reverts changes",
+			tail:     []byte{OpTrap},
+			bitmask:  []byte{0b00101011, 0b101},
+			expected: false,
+		},
+		{
+			name:     "Panic keeps changes up to checkpoint",
+			tail:     []byte{OpEcalli, byte(HostCheckpoint), OpTrap},
+			bitmask:  []byte{0b00101011, 0b10101},
+			expected: true,
+		},
+	}
+
+	input := []byte{0xAA, 0xBB}
+	args := SerializeVarOctetSequence(input)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			code := append(append([]byte{}, prefix...), tc.tail...)
+			state := newAccumulateTestState(encodeProgramBlob(nil, nil, 0, 0, code, tc.bitmask, nil))
+			service := state.Delta[1]
+
+			newState, _, _, err := service.Accumulate(state, 1, input)
+
+			assert.NoError(t, err)
+			value, exists := newState.Delta[1].Storage[storageKey(1, args[:1])]
+			assert.Equal(t, tc.expected, exists)
+			if tc.expected {
+				assert.Equal(t, args, value)
+			}
+			assert.Empty(t, state.Delta[1].Storage)
+		})
+	}
+}
+
+func TestAccumulateYield(t *testing.T) {
+	// Entry point 1 yields the first 32 bytes of its arguments
+	code := []byte{
+		OpTrap,                    // 0
+		OpEcalli, byte(HostYield), // 1
+		OpJumpInd, 0x00, // 3
+	}
+	state := newAccumulateTestState(encodeProgramBlob(nil, nil, 0, 0, code, []byte{0b00001011}, nil))
+	service := state.Delta[1]
+	input := make([]byte, 40)
+	input[0] = 0xAA
+
+	_, _, yield, err := service.Accumulate(state, 1, input)
+
+	assert.NoError(t, err)
+	var expected Hash
+	copy(expected[:], SerializeVarOctetSequence(input))
+	assert.Equal(t, &expected, yield)
+}
+
+func TestAccumulationRoot(t *testing.T) {
+	leaf := func(service uint32, yield Hash) []byte {
+		return append([]byte{byte(service), byte(service >> 8), byte(service >> 16), byte(service >> 24)}, yield[:]...)
+	}
+
+	testCases := []struct {
+		name     string
+		yields   map[uint32]Hash
+		expected Hash
+	}{
+		{"No yields", nil, Hash{}},
+		{"One yield", map[uint32]Hash{5: {1}}, keccak256(leaf(5, Hash{1}))},
+		{"Little-endian service index", map[uint32]Hash{0x01020304: {1}}, keccak256(append([]byte{4, 3, 2, 1, 1}, make([]byte, 31)...))},
+		{
+			name:     "Ordered by service",
+			yields:   map[uint32]Hash{9: {3}, 2: {1}, 5: {2}},
+			expected: WellBalancedMerkleRoot([][]byte{leaf(2, Hash{1}), leaf(5, Hash{2}), leaf(9, Hash{3})}),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, AccumulationRoot(tc.yields))
+		})
+	}
+}
+
+func TestAccumulateInvalidCode(t *testing.T) {
+	testCases := []struct {
+		name string
+		code []byte
+	}{
+		{"Invalid code", []byte{0xFF}},
+		{"Code too big", make([]byte, MaxServiceCodeSize+1)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newAccumulateTestState(tc.code)
+			service := state.Delta[1]
+
+			newState, transfers, yield, err := service.Accumulate(state, 1, nil)
+
+			assert.NoError(t, err)
+			assert.Empty(t, transfers)
+			assert.Nil(t, yield)
+			assert.Equal(t, state.Delta[1].Balance, newState.Delta[1].Balance)
+			assert.Empty(t, newState.Delta[1].Storage)
+		})
+	}
+}
+
+func TestProcessTransfers(t *testing.T) {
+	// Entry point 2 writes its arguments under a key of their first byte
+	code := []byte{
+		OpTrap,          // 0
+		OpTrap,          // 1
+		OpMoveReg, 0x79, // 2: r9 = r7
+		OpMoveReg, 0x8A, // 4: r10 = r8
+		OpLoadImm, 0x08, 0x01, // 6: r8 = 1
+		OpEcalli, byte(HostWrite), // 9
+		OpJumpInd, 0x00, // 11
+	}
+	state := newAccumulateTestState(nil)
+	state.Delta[2] = ServiceAccount{
+		Storage:        make(map[Hash][]byte),
+		PreimageLookup: make(map[Hash][]byte),
+		Balance:        2000,
+		Code:           encodeProgramBlob(nil, nil, 0, 0, code, []byte{0b01010111, 0b1010}, nil),
+	}
+
+	transfers := []DeferredTransfer{
+		{Sender: 3, Receiver: 2, Amount: 10, GasLimit: 100},
+		{Sender: 2, Receiver: 1, Amount: 7, GasLimit: 100},
+		{Sender: 1, Receiver: 2, Amount: 5, GasLimit: 100},
+		{Sender: 1, Receiver: 9, Amount: 1, GasLimit: 100},
+	}
+
+	newState, err := ProcessTransfers(transfers, state)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2015), newState.Delta[2].Balance)
+	assert.Equal(t, uint64(2007), newState.Delta[1].Balance)
+	assert.NotContains(t, newState.Delta, uint32(9))
+
+	// Receiver 2 sees its transfers ordered by sender
+	args := append(SerializeNatural(2), transfers[2].Serialize()...)
+	args = append(args, transfers[0].Serialize()...)
+	assert.Equal(t, args, newState.Delta[2].Storage[storageKey(2, args[:1])])
+}
+
+func TestProcessTransfersWithoutInvocation(t *testing.T) {
+	// Entry point 2 writes its arguments, as in TestProcessTransfers
+	code := encodeProgramBlob(nil, nil, 0, 0, []byte{
+		OpTrap, OpTrap,
+		OpMoveReg, 0x79,
+		OpMoveReg, 0x8A,
+		OpLoadImm, 0x08, 0x01,
+		OpEcalli, byte(HostWrite),
+		OpJumpInd, 0x00,
+	}, []byte{0b01010111, 0b1010}, nil)
+
+	testCases := []struct {
+		name     string
+		code     []byte
+		gasLimit uint64
+	}{
+		{"No gas", code, 0},
+		{"Invalid code", []byte{0xFF}, 100},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newAccumulateTestState(nil)
+			state.Delta[2] = ServiceAccount{
+				Storage:        make(map[Hash][]byte),
+				PreimageLookup: make(map[Hash][]byte),
+				Balance:        2000,
+				Code:           tc.code,
+			}
+
+			transfers := []DeferredTransfer{{Sender: 1, Receiver: 2, Amount: 5, GasLimit: tc.gasLimit}}
+			newState, err := ProcessTransfers(transfers, state)
+
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(2005), newState.Delta[2].Balance)
+			assert.Empty(t, newState.Delta[2].Storage)
+		})
+	}
+}
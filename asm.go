@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operands accepted by Assembler.Emit, in the order the disassembler shows
+// them for each instruction class.
+type (
+	Reg         int    // A register, r0 to r12
+	Imm         int64  // An immediate, from -2^31 to 2^32-1
+	Target      string // A label, encoded as an offset from the instruction
+	JumpAddress string // The dynamic jump address of a label's jump table entry
+)
+
+// Assembler builds PVM code blobs. Instructions are appended with Emit and
+// may refer to labels defined before or after them; jump targets are always
+// encoded as four-byte offsets so that instruction lengths do not depend on
+// label positions.
+type Assembler struct {
+	code      []byte
+	starts    []bool
+	labels    map[string]uint32
+	jumpTable []string
+	fixups    []fixup
+	err       error
+}
+
+// fixup is a four-byte offset at position in the code, to be filled with the
+// distance from the instruction at pc to label.
+type fixup struct {
+	position uint32
+	pc       uint32
+	label    string
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{labels: make(map[string]uint32)}
+}
+
+// Label defines name at the current position.
+func (a *Assembler) Label(name string) *Assembler {
+	if _, exists := a.labels[name]; exists {
+		a.fail(fmt.Errorf("duplicate label %q", name))
+	}
+	a.labels[name] = uint32(len(a.code))
+	return a
+}
+
+// JumpTable adds entries for labels to the jump table, in order, unless they
+// already have one.
+func (a *Assembler) JumpTable(labels ...string) *Assembler {
+	for _, label := range labels {
+		a.jumpTableIndex(label)
+	}
+	return a
+}
+
+// Emit appends an instruction. The operands must match the class of opcode.
+func (a *Assembler) Emit(opcode byte, operands ...any) *Assembler {
+	if a.err != nil {
+		return a
+	}
+	if err := a.emit(opcode, operands); err != nil {
+		a.fail(fmt.Errorf("%s: %w", Instruction{Opcode: opcode}.Mnemonic(), err))
+	}
+	return a
+}
+
+// Build resolves labels and returns the assembled code blob.
+func (a *Assembler) Build() (*CodeBlob, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	code := append([]byte{}, a.code...)
+	for _, f := range a.fixups {
+		target, exists := a.labels[f.label]
+		if !exists {
+			return nil, fmt.Errorf("undefined label %q", f.label)
+		}
+		binary.LittleEndian.PutUint32(code[f.position:], target-f.pc)
+	}
+
+	blob := &CodeBlob{
+		Code:      code,
+		Bitmask:   make([]byte, (len(code)+7)/8),
+		JumpTable: make([]uint32, len(a.jumpTable)),
+	}
+	for i, start := range a.starts {
+		if start {
+			blob.Bitmask[i/8] |= 1 << (i % 8)
+		}
+	}
+	for i, label := range a.jumpTable {
+		target, exists := a.labels[label]
+		if !exists {
+			return nil, fmt.Errorf("undefined label %q", label)
+		}
+		blob.JumpTable[i] = target
+	}
+	return blob, nil
+}
+
+func (a *Assembler) fail(err error) {
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+func (a *Assembler) jumpTableIndex(label string) int {
+	for i, l := range a.jumpTable {
+		if l == label {
+			return i
+		}
+	}
+	a.jumpTable = append(a.jumpTable, label)
+	return len(a.jumpTable) - 1
+}
+
+func (a *Assembler) emit(opcode byte, operands []any) error {
+	class := instructionClasses[opcode]
+	kinds, ok := operandKinds[class]
+	if !ok {
+		return errors.New("invalid opcode")
+	}
+	if len(operands) != len(kinds) {
+		return fmt.Errorf("expected %d operands, got %d", len(kinds), len(operands))
+	}
+
+	pc := uint32(len(a.code))
+	var regs []byte
+	var imms [][]byte
+	var target string
+	for i, operand := range operands {
+		switch kinds[i] {
+		case 'r':
+			r, ok := operand.(Reg)
+			if !ok || r < 0 || r >= RegisterCount {
+				return fmt.Errorf("operand %d: expected a register", i+1)
+			}
+			regs = append(regs, byte(r))
+		case 'i':
+			value, err := a.immediate(operand)
+			if err != nil {
+				return fmt.Errorf("operand %d: %w", i+1, err)
+			}
+			imms = append(imms, value)
+		case 't':
+			label, ok := operand.(Target)
+			if !ok {
+				return fmt.Errorf("operand %d: expected a target label", i+1)
+			}
+			target = string(label)
+		}
+	}
+
+	buf := []byte{opcode}
+	switch class {
+	case ClassTwoImm:
+		buf = append(buf, byte(len(imms[0])))
+	case ClassOneRegOneImm:
+		buf = append(buf, regs[0])
+	case ClassOneRegTwoImm, ClassOneRegOneImmOneOffset:
+		buf = append(buf, regs[0]|byte(len(imms[0]))<<4)
+	case ClassTwoReg:
+		// Operands are given as rD, rA
+		buf = append(buf, regs[0]|regs[1]<<4)
+	case ClassTwoRegOneImm, ClassTwoRegOneOffset:
+		buf = append(buf, regs[0]|regs[1]<<4)
+	case ClassTwoRegTwoImm:
+		buf = append(buf, regs[0]|regs[1]<<4, byte(len(imms[0])))
+	case ClassThreeReg:
+		// Operands are given as rD, rA, rB
+		buf = append(buf, regs[1]|regs[2]<<4, regs[0])
+	}
+	for _, imm := range imms {
+		buf = append(buf, imm...)
+	}
+	if class == ClassOneOffset || class == ClassOneRegOneImmOneOffset || class == ClassTwoRegOneOffset {
+		a.fixups = append(a.fixups, fixup{position: pc + uint32(len(buf)), pc: pc, label: target})
+		buf = append(buf, 0, 0, 0, 0)
+	}
+
+	a.code = append(a.code, buf...)
+	a.starts = append(a.starts, true)
+	for range buf[1:] {
+		a.starts = append(a.starts, false)
+	}
+	return nil
+}
+
+// immediate encodes an Imm or JumpAddress operand in as few bytes as decode
+// to the same value after sign extension.
+func (a *Assembler) immediate(operand any) ([]byte, error) {
+	var value int64
+	switch v := operand.(type) {
+	case Imm:
+		value = int64(v)
+	case JumpAddress:
+		value = int64(a.jumpTableIndex(string(v))+1) * JumpAlignmentFactor
+	default:
+		return nil, errors.New("expected an immediate")
+	}
+	if value < -1<<31 || value >= 1<<32 {
+		return nil, fmt.Errorf("immediate %d out of range", value)
+	}
+
+	u := uint32(value)
+	buf := binary.LittleEndian.AppendUint32(nil, u)
+	length := uint32(0)
+	for length < 4 && signExtend(u&(1<<(8*length)-1), uint(8*length)) != u {
+		length++
+	}
+	return buf[:length], nil
+}
+
+// operandKinds lists the operands of each instruction class: r for a
+// register, i for an immediate and t for a jump target.
+var operandKinds = map[InstructionClass]string{
+	ClassNoArgs:                "",
+	ClassOneImm:                "i",
+	ClassTwoImm:                "ii",
+	ClassOneOffset:             "t",
+	ClassOneRegOneImm:          "ri",
+	ClassOneRegTwoImm:          "rii",
+	ClassOneRegOneImmOneOffset: "rit",
+	ClassTwoReg:                "rr",
+	ClassTwoRegOneImm:          "rri",
+	ClassTwoRegOneOffset:       "rrt",
+	ClassTwoRegTwoImm:          "rrii",
+	ClassThreeReg:              "rrr",
+}
+
+// Assemble assembles PVM source text in the syntax the disassembler uses for
+// instructions:
+//
+//	; comment
+//	loop:                          label definition
+//	    add_imm r7, r7, 1          registers, decimal, hex or negative immediates
+//	    branch_ne_imm r7, 10, @loop
+//	    load_imm r8, &loop         dynamic jump address of loop
+//	    jump_ind r8, 0
+//	.jump_table loop               jump table entries, in order
+func Assemble(source string) (*CodeBlob, error) {
+	opcodes := make(map[string]byte)
+	for opcode, name := range mnemonics {
+		if name != "" {
+			opcodes[name] = byte(opcode)
+		}
+	}
+
+	a := NewAssembler()
+	for i, line := range strings.Split(source, "\n") {
+		if err := a.assembleLine(line, opcodes); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	return a.Build()
+}
+
+func (a *Assembler) assembleLine(line string, opcodes map[string]byte) error {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+
+	if label, ok := strings.CutSuffix(line, ":"); ok {
+		a.Label(strings.TrimPrefix(label, "@"))
+		return a.err
+	}
+	if line == "" {
+		return nil
+	}
+
+	name, rest, _ := strings.Cut(line, " ")
+	var fields []string
+	if rest = strings.TrimSpace(rest); rest != "" {
+		fields = strings.Split(rest, ",")
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	if name == ".jump_table" {
+		a.JumpTable(fields...)
+		return nil
+	}
+	opcode, ok := opcodes[name]
+	if !ok {
+		return fmt.Errorf("unknown instruction %q", name)
+	}
+
+	operands := make([]any, len(fields))
+	for i, field := range fields {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			operands[i] = Target(field[1:])
+		case strings.HasPrefix(field, "&"):
+			operands[i] = JumpAddress(field[1:])
+		case strings.HasPrefix(field, "r") && len(field) > 1 && field[1] >= '0' && field[1] <= '9':
+			r, err := strconv.Atoi(field[1:])
+			if err != nil {
+				return fmt.Errorf("invalid register %q", field)
+			}
+			operands[i] = Reg(r)
+		default:
+			value, err := strconv.ParseInt(field, 0, 64)
+			if err != nil {
+				return fmt.Errorf("invalid operand %q", field)
+			}
+			operands[i] = Imm(value)
+		}
+	}
+
+	a.Emit(opcode, operands...)
+	return a.err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const sumSource = `
+; Sums 1 to 10 into r8
+	load_imm r7, 10
+	fallthrough
+loop:
+	add r8, r8, r7
+	add_imm r7, r7, -1
+	branch_ne_imm r7, 0, @loop
+	jump_ind r0, 0
+`
+
+func runAssembled(t *testing.T, blob *CodeBlob) *PVM {
+	pvm, err := NewPVM(blob.Code, blob.Bitmask, blob.JumpTable, 1000)
+	assert.NoError(t, err)
+	pvm.Registers[0] = HaltAddress
+	exitReason, _, _ := pvm.Execute()
+	assert.Equal(t, ExitHalt, exitReason)
+	return pvm
+}
+
+func TestAssemble(t *testing.T) {
+	blob, err := Assemble(sumSource)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		OpLoadImm, 0x07, 0x0A,
+		OpFallthrough,
+		OpAdd, 0x78, 0x08,
+		OpAddImm, 0x77, 0xFF,
+		OpBranchNeImm, 0x07, 0xFA, 0xFF, 0xFF, 0xFF,
+		OpJumpInd, 0x00,
+	}, blob.Code)
+	assert.Equal(t, []byte{0b10011001, 0b00000100, 0b00000001}, blob.Bitmask)
+	assert.Equal(t, uint32(55), runAssembled(t, blob).Registers[8])
+}
+
+func TestAssemblerBuilder(t *testing.T) {
+	blob, err := NewAssembler().
+		Emit(OpLoadImm, Reg(7), Imm(10)).
+		Emit(OpFallthrough).
+		Label("loop").
+		Emit(OpAdd, Reg(8), Reg(8), Reg(7)).
+		Emit(OpAddImm, Reg(7), Reg(7), Imm(-1)).
+		Emit(OpBranchNeImm, Reg(7), Imm(0), Target("loop")).
+		Emit(OpJumpInd, Reg(0), Imm(0)).
+		Build()
+	assert.NoError(t, err)
+
+	expected, err := Assemble(sumSource)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, blob)
+}
+
+func TestAssembleJumpTable(t *testing.T) {
+	blob, err := Assemble(`
+	load_imm r8, &done
+	jump_ind r8, 0
+	trap
+first:
+	trap
+done:
+	load_imm r7, 0xFFFFFFFF
+	jump_ind r0, 0
+.jump_table first, done
+`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{7, 6}, blob.JumpTable, "Entries referenced by address come first")
+	assert.Equal(t, uint32(0xFFFFFFFF), runAssembled(t, blob).Registers[7])
+
+	parsed, err := ParseCodeBlob(blob.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, blob, parsed)
+}
+
+func TestAssembleDisassembled(t *testing.T) {
+	blob, err := Assemble(sumSource)
+	assert.NoError(t, err)
+
+	// The instructions of a listing assemble back into the same code
+	var listing strings.Builder
+	assert.NoError(t, Disassemble(&listing, blob))
+	var source []string
+	for _, line := range strings.Split(listing.String(), "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 && !strings.HasSuffix(line, ":") {
+			line = line[strings.LastIndex(line, "  ")+2:]
+		}
+		source = append(source, line)
+	}
+
+	reassembled, err := Assemble(strings.Join(source, "\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, blob, reassembled)
+}
+
+func TestAssembleErrors(t *testing.T) {
+	testCases := []struct {
+		source string
+		err    string
+	}{
+		{"nop", `line 1: unknown instruction "nop"`},
+		{"trap\nadd r1, r2", "line 2: add: expected 3 operands, got 2"},
+		{"load_imm r13, 1", "line 1: load_imm: operand 1: expected a register"},
+		{"load_imm r1, r2", "line 1: load_imm: operand 2: expected an immediate"},
+		{"load_imm r1, 0x100000000", "line 1: load_imm: operand 2: immediate 4294967296 out of range"},
+		{"load_imm r1, x", `line 1: invalid operand "x"`},
+		{"jump @end", `undefined label "end"`},
+		{"a:\ntrap\na:", `line 3: duplicate label "a"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source, func(t *testing.T) {
+			_, err := Assemble(tc.source)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	IsAuthorizedEntryPoint = 0
+	IsAuthorizedGasLimit   = 50_000_000 // G_I: gas allotted to the is-authorized invocation
+)
+
+// isAuthorizedHost services the is-authorized invocation, which may only
+// query its remaining gas.
+var isAuthorizedHost = HostCallFunc(func(index uint32, pvm *PVM) (ExitReason, error) {
+	if !chargeHostGas(pvm, HostCallGasCost) {
+		return ExitOOG, nil
+	}
+	if index == HostGas {
+		pvm.Registers[7] = uint32(pvm.Gas)
+		pvm.Registers[8] = uint32(pvm.Gas >> 32)
+	} else {
+		pvm.Registers[7] = ResultWhat
+	}
+	return ExitContinue, nil
+})
+
+// IsAuthorized runs the authorizer of a work package for core and returns its
+// output, or an error wrapping a WorkError if the authorizer did not halt.
+// The authorizer code is looked up by AuthCodeHash among the preimages of the
+// authorization service, as available at the lookup anchor.
+func IsAuthorized(workPackage WorkPackage, core uint32, state State) ([]byte, error) {
+	service, exists := state.Delta[workPackage.AuthServiceIndex]
+	if !exists {
+		return nil, fmt.Errorf("authorization service %d not found", workPackage.AuthServiceIndex)
+	}
+	code, exists := service.HistoricalLookup(workPackage.Context.LookupAnchorTimeSlot, workPackage.AuthCodeHash)
+	if !exists {
+		return nil, errors.New("authorizer code not available")
+	}
+
+	args := append(workPackage.Serialize(), SerializeCoreIndex(core)...)
+	pvm, err := NewStandardPVM(code, IsAuthorizedEntryPoint, args, IsAuthorizedGasLimit)
+	if err != nil {
+		return nil, fmt.Errorf("loading authorizer: %w", err)
+	}
+
+	exitReason, _, _, err := pvm.ExecuteWithHost(isAuthorizedHost)
+	if err != nil {
+		return nil, fmt.Errorf("running authorizer: %w", err)
+	}
+	output, err := pvm.output(exitReason)
+	if err != nil {
+		return nil, fmt.Errorf("authorizer failed: %w", err)
+	}
+	return output, nil
+}
+
+// AuthorizerHash identifies the authorizer of a work package, as found in
+// the authorizer pool: H(AuthCodeHash ⌢ AuthParam).
+func (wp *WorkPackage) AuthorizerHash() Hash {
+	return blake2b.Sum256(append(wp.AuthCodeHash[:], wp.AuthParam...))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+// newAuthorizerState returns a state whose service 1 provides code as an
+// authorizer, and a work package using it.
+func newAuthorizerState(code []byte) (State, WorkPackage) {
+	codeHash := blake2b.Sum256(code)
+	var state State
+	state.Delta = map[uint32]ServiceAccount{
+		1: {
+			PreimageLookup: map[Hash][]byte{codeHash: code},
+			PreimageMeta: map[struct {
+				Hash
+				Length uint32
+			}][]uint32{
+				{codeHash, uint32(len(code))}: {0},
+			},
+		},
+	}
+	workPackage := WorkPackage{
+		AuthToken:        []byte{1, 2},
+		AuthServiceIndex: 1,
+		AuthCodeHash:     codeHash,
+		AuthParam:        []byte{3},
+		Context:          RefinementContext{LookupAnchorTimeSlot: 5},
+	}
+	return state, workPackage
+}
+
+func TestIsAuthorized(t *testing.T) {
+	// Returns its arguments as its output
+	approve := encodeProgramBlob(nil, nil, 0, 0, []byte{OpJumpInd, 0x00}, []byte{0b01}, nil)
+	reject := encodeProgramBlob(nil, nil, 0, 0, []byte{OpTrap}, []byte{0b1}, nil)
+
+	testCases := []struct {
+		name   string
+		code   []byte
+		modify func(state *State, workPackage *WorkPackage)
+		err    string
+	}{
+		{
+			name: "Authorized",
+			code: approve,
+		},
+		{
+			name: "Authorizer panics",
+			code: reject,
+			err:  "authorizer failed: panic",
+		},
+		{
+			name: "Unknown authorization service",
+			code: approve,
+			modify: func(state *State, workPackage *WorkPackage) {
+				workPackage.AuthServiceIndex = 2
+			},
+			err: "authorization service 2 not found",
+		},
+		{
+			name: "Code not yet available",
+			code: approve,
+			modify: func(state *State, workPackage *WorkPackage) {
+				workPackage.Context.LookupAnchorTimeSlot = 0
+				meta := state.Delta[1].PreimageMeta
+				for key := range meta {
+					meta[key] = []uint32{1}
+				}
+			},
+			err: "authorizer code not available",
+		},
+		{
+			name: "Invalid authorizer code",
+			code: []byte{1, 2, 3},
+			err:  "loading authorizer: insufficient data for program blob header",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state, workPackage := newAuthorizerState(tc.code)
+			if tc.modify != nil {
+				tc.modify(&state, &workPackage)
+			}
+
+			output, err := IsAuthorized(workPackage, 3, state)
+
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, append(workPackage.Serialize(), 0, 3), output)
+		})
+	}
+}
+
+func TestEvaluateWorkPackage(t *testing.T) {
+	code := encodeProgramBlob(nil, nil, 0, 0, []byte{OpJumpInd, 0x00}, []byte{0b01}, nil)
+	state, workPackage := newAuthorizerState(code)
+	state.Alpha = [][]Hash{{}, {workPackage.AuthorizerHash()}}
+
+	report, err := EvaluateWorkPackage(workPackage, 1, state)
+
+	assert.NoError(t, err)
+	assert.Equal(t, workPackage.AuthorizerHash(), report.AuthorizerHash)
+	assert.Equal(t, append(workPackage.Serialize(), 0, 1), report.Output)
+
+	_, err = EvaluateWorkPackage(workPackage, 0, state)
+	assert.EqualError(t, err, "authorizer not in pool")
+}
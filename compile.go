@@ -0,0 +1,171 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// compiledProgram is code decoded ahead of execution into basic blocks. It
+// depends only on the code and bitmask, so machines running the same code
+// share it.
+type compiledProgram struct {
+	blocks map[uint32]*compiledBlock // By the program counter of the block start
+}
+
+// compiledBlock is a basic block: the instructions from its start up to and
+// including the next terminator, or the end of the code.
+type compiledBlock struct {
+	instructions []compiledInstruction
+	gas          int64  // Cost of the whole block
+	end          uint32 // Program counter following the last instruction
+	terminated   bool   // Whether the last instruction is a terminator
+}
+
+type compiledInstruction struct {
+	in      Instruction
+	pc      uint32
+	gasUsed int64 // Cost of the block up to and including this instruction
+	// run is the register operation of the instruction, if it is one. Others
+	// are executed by the interpreter's implementation.
+	run registerOperation
+}
+
+// CompiledProgramCacheSize is the number of compiled programs kept, so that
+// code supplied by work packages cannot grow the cache without bound.
+const CompiledProgramCacheSize = 64
+
+type compiledProgramEntry struct {
+	key     [32]byte
+	program *compiledProgram
+}
+
+// compiledPrograms caches compiled code by the hash of its code and bitmask,
+// evicting the least recently used program once it is full.
+var compiledPrograms = struct {
+	sync.Mutex
+	programs map[[32]byte]*list.Element
+	recent   *list.List // Most recently used first
+}{programs: make(map[[32]byte]*list.Element), recent: list.New()}
+
+// compiledCode returns the compiled form of the machine's code, compiling it
+// if it is not cached.
+func (pvm *PVM) compiledCode() *compiledProgram {
+	if pvm.compiled != nil {
+		return pvm.compiled
+	}
+
+	key := pvm.codeHash()
+	compiledPrograms.Lock()
+	defer compiledPrograms.Unlock()
+	if element, exists := compiledPrograms.programs[key]; exists {
+		compiledPrograms.recent.MoveToFront(element)
+		pvm.compiled = element.Value.(*compiledProgramEntry).program
+		return pvm.compiled
+	}
+
+	pvm.compiled = pvm.compile()
+	compiledPrograms.programs[key] = compiledPrograms.recent.PushFront(&compiledProgramEntry{key, pvm.compiled})
+	if compiledPrograms.recent.Len() > CompiledProgramCacheSize {
+		oldest := compiledPrograms.recent.Remove(compiledPrograms.recent.Back()).(*compiledProgramEntry)
+		delete(compiledPrograms.programs, oldest.key)
+	}
+	return pvm.compiled
+}
+
+func (pvm *PVM) codeHash() [32]byte {
+	data := append([]byte{}, pvm.Code...)
+	return blake2b.Sum256(append(data, EncodeBitmask(pvm.Bitmask)...))
+}
+
+func (pvm *PVM) compile() *compiledProgram {
+	program := &compiledProgram{blocks: make(map[uint32]*compiledBlock)}
+	for pc := range pvm.Code {
+		if pvm.basicBlocks[pc] {
+			program.blocks[uint32(pc)] = pvm.compileBlock(uint32(pc))
+		}
+	}
+	return program
+}
+
+func (pvm *PVM) compileBlock(start uint32) *compiledBlock {
+	block := &compiledBlock{}
+	pc := start
+	for pc < uint32(len(pvm.Code)) {
+		in := pvm.decodeInstruction(pc)
+		block.gas += pvm.calculateGasCost(in.Opcode)
+		block.instructions = append(block.instructions, compiledInstruction{
+			in:      in,
+			pc:      pc,
+			gasUsed: block.gas,
+			run:     registerOperations[in.Opcode],
+		})
+		pc += in.Length
+		if isTerminator(in.Opcode) {
+			block.terminated = true
+			break
+		}
+	}
+	block.end = pc
+	return block
+}
+
+// executeCompiled runs like Execute, a basic block at a time. Where the
+// program counter is not at the start of a block, or the block cannot be paid
+// for in full, it falls back to the interpreter for a single instruction.
+func (pvm *PVM) executeCompiled() (ExitReason, uint32, int64) {
+	program := pvm.compiledCode()
+	for {
+		block := program.blocks[pvm.PC]
+
+		var exitReason ExitReason
+		var value uint32
+		if block == nil || pvm.Gas < block.gas || (pvm.GasMode == GasPerBasicBlock && pvm.gasCharged) {
+			exitReason, value = pvm.Step()
+		} else {
+			exitReason, value = pvm.executeBlock(block)
+		}
+		if exitReason != ExitContinue {
+			return exitReason, value, pvm.Gas
+		}
+	}
+}
+
+// executeBlock charges for the whole block upfront, then executes it. In
+// GasPerInstruction mode, the cost of instructions not reached because of an
+// earlier exit is refunded.
+func (pvm *PVM) executeBlock(block *compiledBlock) (ExitReason, uint32) {
+	pvm.Gas -= block.gas
+	if pvm.GasMode == GasPerBasicBlock {
+		pvm.gasCharged = true
+	}
+
+	last := len(block.instructions) - 1
+	for i := range block.instructions {
+		ci := &block.instructions[i]
+		if ci.run != nil {
+			ci.run(&ci.in, &pvm.Registers)
+			if i == last {
+				pvm.PC = block.end
+			}
+			continue
+		}
+
+		pvm.PC = ci.pc
+		if exitReason, value := pvm.execute(ci.in); exitReason != ExitContinue {
+			if pvm.GasMode == GasPerInstruction {
+				pvm.Gas += block.gas - ci.gasUsed
+			}
+			if i == last && block.terminated {
+				pvm.gasCharged = false
+			}
+			return exitReason, value
+		}
+	}
+
+	if block.terminated {
+		pvm.gasCharged = false
+	}
+	return ExitContinue, 0
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assertSameExecution runs the machine built by newPVM on the interpreter and
+// on the compiled engine, and checks that both end in exactly the same state.
+func assertSameExecution(t *testing.T, newPVM func() *PVM, host HostFunctions) {
+	interpreted := newPVM()
+	exitReason, value, gas, err := interpreted.ExecuteWithHost(host)
+
+	compiled := newPVM()
+	compiled.Engine = EngineCompiled
+	compiledExit, compiledValue, compiledGas, compiledErr := compiled.ExecuteWithHost(host)
+
+	assert.Equal(t, exitReason, compiledExit)
+	assert.Equal(t, value, compiledValue)
+	assert.Equal(t, gas, compiledGas)
+	assert.Equal(t, err, compiledErr)
+	assert.Equal(t, interpreted.Registers, compiled.Registers)
+	assert.Equal(t, interpreted.PC, compiled.PC)
+	assert.Equal(t, interpreted.gasCharged, compiled.gasCharged)
+	assert.Equal(t, interpreted.Memory, compiled.Memory)
+}
+
+func TestCompiledEngine(t *testing.T) {
+	testCases := []struct {
+		name   string
+		source string
+	}{
+		{"Loop", sumSource},
+		{"Store and load", `
+	load_imm r7, 0x10000
+	load_imm r8, 0x12345678
+	store_ind_u32 r8, r7, 4
+	load_ind_i8 r9, r7, 7
+	jump_ind r0, 0
+`},
+		{"Page fault in the middle of a block", `
+	load_imm r7, 1
+	store_u32 r7, 0x20000
+	load_imm r7, 2
+	jump_ind r0, 0
+`},
+		{"Host call in the middle of a block", `
+	load_imm r7, 1
+	ecalli 5
+	add_imm r7, r7, 1
+	jump_ind r0, 0
+`},
+		{"Invalid jump", `
+	load_imm r7, 3
+	jump_ind r7, 0
+`},
+		{"Trap", `
+	load_imm r7, 3
+	trap
+`},
+		{"Running off the end of the code", `
+	load_imm r7, 1
+	add_imm r7, r7, 1
+`},
+	}
+
+	for _, tc := range testCases {
+		blob, err := Assemble(tc.source)
+		assert.NoError(t, err)
+
+		for _, mode := range []GasMode{GasPerInstruction, GasPerBasicBlock} {
+			// Every gas limit up to enough to finish, to exhaust gas at each point
+			for gasLimit := uint64(1); gasLimit <= 40; gasLimit++ {
+				newPVM := func() *PVM {
+					pvm, err := NewPVM(blob.Code, blob.Bitmask, blob.JumpTable, gasLimit)
+					assert.NoError(t, err)
+					pvm.GasMode = mode
+					pvm.Registers[0] = HaltAddress
+					pvm.Memory.SetAccess(0x10000, PageSize, PageReadWrite)
+					return pvm
+				}
+				host := HostCallFunc(func(index uint32, pvm *PVM) (ExitReason, error) {
+					pvm.Gas -= 2
+					pvm.Registers[7] += index
+					return ExitContinue, nil
+				})
+				assertSameExecution(t, newPVM, host)
+			}
+		}
+	}
+}
+
+func TestCompiledEngineRandomPrograms(t *testing.T) {
+	// sbrk is left out, as random sizes would map most of the address space
+	var opcodes []byte
+	for opcode, name := range mnemonics {
+		if name != "" && byte(opcode) != OpSbrk {
+			opcodes = append(opcodes, byte(opcode))
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 2000; i++ {
+		// Random instructions with random operand bytes
+		var code []byte
+		bitmask := make([]byte, 8)
+		for len(code) < 48 {
+			bitmask[len(code)/8] |= 1 << (len(code) % 8)
+			code = append(code, opcodes[rng.Intn(len(opcodes))])
+			for n := rng.Intn(6); n > 0; n-- {
+				code = append(code, byte(rng.Intn(256)))
+			}
+		}
+		jumpTable := []uint32{0, uint32(rng.Intn(len(code)))}
+		var registers [RegisterCount]uint32
+		for r := range registers {
+			registers[r] = []uint32{0, 1, 2, 0x10000, 0xFFFFFFFF, rng.Uint32()}[rng.Intn(6)]
+		}
+		gasLimit := uint64(1 + rng.Intn(100))
+		mode := GasMode(rng.Intn(2))
+
+		newPVM := func() *PVM {
+			pvm, err := NewPVM(code, bitmask, jumpTable, gasLimit)
+			assert.NoError(t, err)
+			pvm.GasMode = mode
+			pvm.Registers = registers
+			pvm.Memory.SetAccess(0x10000, PageSize, PageReadWrite)
+			return pvm
+		}
+		assertSameExecution(t, newPVM, nil)
+	}
+}
+
+func TestCompiledProgramCache(t *testing.T) {
+	blob, err := Assemble(sumSource)
+	assert.NoError(t, err)
+
+	first, err := NewPVM(blob.Code, blob.Bitmask, blob.JumpTable, 1000)
+	assert.NoError(t, err)
+	second, err := NewPVM(blob.Code, blob.Bitmask, blob.JumpTable, 1000)
+	assert.NoError(t, err)
+
+	assert.Same(t, first.compiledCode(), second.compiledCode())
+	assert.Len(t, first.compiledCode().blocks[4].instructions, 3, "The loop body up to its branch")
+}
+
+func TestCompiledProgramCacheEviction(t *testing.T) {
+	newPVM := func(i int) *PVM {
+		pvm, err := NewPVM([]byte{OpLoadImm, 0x00, byte(i), byte(i >> 8), OpTrap}, []byte{0b10001}, nil, 1000)
+		assert.NoError(t, err)
+		return pvm
+	}
+
+	first := newPVM(0).compiledCode()
+	for i := 1; i <= CompiledProgramCacheSize; i++ {
+		newPVM(i).compiledCode()
+	}
+
+	assert.LessOrEqual(t, len(compiledPrograms.programs), CompiledProgramCacheSize)
+	assert.Equal(t, len(compiledPrograms.programs), compiledPrograms.recent.Len())
+	assert.NotSame(t, first, newPVM(0).compiledCode(), "The least recently used program is evicted")
+	last := newPVM(CompiledProgramCacheSize)
+	assert.Same(t, last.compiledCode(), newPVM(CompiledProgramCacheSize).compiledCode())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Watchpoint watches a range of guest memory for changes.
+type Watchpoint struct {
+	Address uint32 `json:"address"`
+	Length  uint32 `json:"length"`
+}
+
+// TraceEntry describes a single executed instruction.
+type TraceEntry struct {
+	PC        uint32            `json:"pc"`
+	Opcode    byte              `json:"opcode"`
+	Mnemonic  string            `json:"mnemonic"`
+	Operands  string            `json:"operands"`
+	Registers map[string]uint32 `json:"registers,omitempty"` // New values of the registers the step changed, by name
+	GasUsed   int64             `json:"gas_used"`
+	Gas       int64             `json:"gas"` // Remaining after the step
+	Exit      string            `json:"exit,omitempty"`
+	Watch     []Watchpoint      `json:"watch,omitempty"` // Watchpoints whose memory the step changed
+}
+
+// Debugger drives a PVM one instruction at a time, stopping at breakpoints
+// and on changes to watched memory, and optionally writing a trace of every
+// instruction as JSON lines.
+type Debugger struct {
+	PVM         *PVM
+	Host        HostFunctions // Services host calls between steps; nil stops on them
+	Breakpoints map[uint32]bool
+	Watchpoints []Watchpoint
+	Trace       io.Writer
+}
+
+func NewDebugger(pvm *PVM, host HostFunctions) *Debugger {
+	return &Debugger{
+		PVM:         pvm,
+		Host:        host,
+		Breakpoints: make(map[uint32]bool),
+	}
+}
+
+func (d *Debugger) AddBreakpoint(pc uint32) {
+	d.Breakpoints[pc] = true
+}
+
+func (d *Debugger) RemoveBreakpoint(pc uint32) {
+	delete(d.Breakpoints, pc)
+}
+
+func (d *Debugger) AddWatchpoint(address uint32, length uint32) {
+	d.Watchpoints = append(d.Watchpoints, Watchpoint{Address: address, Length: length})
+}
+
+// Step executes a single instruction, including the host call it makes if
+// any, and records it in the trace.
+func (d *Debugger) Step() (TraceEntry, ExitReason, uint32, error) {
+	pvm := d.PVM
+	in := pvm.decodeInstruction(pvm.PC)
+	entry := TraceEntry{
+		PC:       pvm.PC,
+		Opcode:   in.Opcode,
+		Mnemonic: in.Mnemonic(),
+		Operands: in.Operands(),
+	}
+	registers := pvm.Registers
+	gas := pvm.Gas
+	watched := d.readWatched()
+
+	var err error
+	exitReason, value := pvm.Step()
+	if exitReason == ExitHost && d.Host != nil {
+		exitReason, err = d.Host.HostCall(value, pvm)
+		value = 0
+		if err != nil {
+			exitReason = ExitPanic
+		} else if pvm.Gas < 0 {
+			exitReason = ExitOOG
+		}
+	}
+
+	for i, r := range pvm.Registers {
+		if r != registers[i] {
+			if entry.Registers == nil {
+				entry.Registers = make(map[string]uint32)
+			}
+			entry.Registers[fmt.Sprintf("r%d", i)] = r
+		}
+	}
+	entry.GasUsed = gas - pvm.Gas
+	entry.Gas = pvm.Gas
+	if exitReason != ExitContinue {
+		entry.Exit = exitReason.String()
+	}
+	for i, w := range d.Watchpoints {
+		data, _ := pvm.Memory.Read(w.Address, w.Length)
+		if !bytes.Equal(data, watched[i]) {
+			entry.Watch = append(entry.Watch, w)
+		}
+	}
+
+	if d.Trace != nil {
+		line, _ := json.Marshal(entry)
+		if _, writeErr := d.Trace.Write(append(line, '\n')); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	return entry, exitReason, value, err
+}
+
+// Run steps until the machine exits, reaches a breakpoint or changes watched
+// memory. It always executes at least one instruction, so that it can resume
+// from a breakpoint, and returns ExitContinue when it stops for a breakpoint
+// or watchpoint.
+func (d *Debugger) Run() (ExitReason, uint32, error) {
+	for first := true; ; first = false {
+		if !first && d.Breakpoints[d.PVM.PC] {
+			return ExitContinue, 0, nil
+		}
+		entry, exitReason, value, err := d.Step()
+		if err != nil || exitReason != ExitContinue || len(entry.Watch) > 0 {
+			return exitReason, value, err
+		}
+	}
+}
+
+func (d *Debugger) readWatched() [][]byte {
+	watched := make([][]byte, len(d.Watchpoints))
+	for i, w := range d.Watchpoints {
+		watched[i], _ = d.PVM.Memory.Read(w.Address, w.Length)
+	}
+	return watched
+}
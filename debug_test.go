@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDebugTestPVM(t *testing.T) *PVM {
+	code := []byte{
+		OpLoadImm, 0x07, 0x05, // 0: r7 = 5
+		OpAddImm, 0x78, 0x01, // 3: r8 = r7 + 1
+		OpStoreU32, 0x08, 0x00, 0x00, 0x01, 0x00, // 6: [0x10000] = r8
+		OpJumpInd, 0x00, // 12
+	}
+	pvm, err := NewPVM(code, []byte{0b01001001, 0b00010000}, nil, 100)
+	assert.NoError(t, err)
+	pvm.Registers[0] = HaltAddress
+	pvm.Memory.SetAccess(0x10000, PageSize, PageReadWrite)
+	return pvm
+}
+
+func TestInstructionString(t *testing.T) {
+	testCases := []struct {
+		code     []byte
+		expected string
+	}{
+		{[]byte{OpTrap}, "trap"},
+		{[]byte{OpEcalli, 0x03}, "ecalli 0x3"},
+		{[]byte{OpStoreImmU8, 0x01, 0x10, 0x05}, "store_imm_u8 0x10, 0x5"},
+		{[]byte{OpJump, 0xFE}, "jump @4294967294"},
+		{[]byte{OpLoadImm, 0x07, 0xFF}, "load_imm r7, 0xffffffff"},
+		{[]byte{OpBranchEqImm, 0x17, 0x02, 0x04}, "branch_eq_imm r7, 0x2, @4"},
+		{[]byte{OpMoveReg, 0x79}, "move_reg r9, r7"},
+		{[]byte{OpAddImm, 0x78, 0x01}, "add_imm r8, r7, 0x1"},
+		{[]byte{OpBranchEq, 0x21, 0x08}, "branch_eq r1, r2, @8"},
+		{[]byte{OpLoadImmJumpInd, 0x10, 0x01, 0x02, 0x03}, "load_imm_jump_ind r0, r1, 0x2, 0x3"},
+		{[]byte{OpAdd, 0x21, 0x03}, "add r3, r1, r2"},
+		{[]byte{0xFF}, "invalid_255"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			pvm := &PVM{Code: tc.code, Bitmask: DecodeBitmask([]byte{0b1}, len(tc.code))}
+			assert.Equal(t, tc.expected, pvm.decodeInstruction(0).String())
+		})
+	}
+}
+
+func TestDebuggerTrace(t *testing.T) {
+	var trace bytes.Buffer
+	debugger := NewDebugger(newDebugTestPVM(t), nil)
+	debugger.Trace = &trace
+
+	exitReason, _, err := debugger.Run()
+
+	assert.NoError(t, err)
+	assert.Equal(t, ExitHalt, exitReason)
+	lines := strings.Split(strings.TrimSpace(trace.String()), "\n")
+	assert.Equal(t, []string{
+		`{"pc":0,"opcode":4,"mnemonic":"load_imm","operands":"r7, 0x5","registers":{"r7":5},"gas_used":1,"gas":99}`,
+		`{"pc":3,"opcode":2,"mnemonic":"add_imm","operands":"r8, r7, 0x1","registers":{"r8":6},"gas_used":1,"gas":98}`,
+		`{"pc":6,"opcode":22,"mnemonic":"store_u32","operands":"r8, 0x10000","gas_used":1,"gas":97}`,
+		`{"pc":12,"opcode":19,"mnemonic":"jump_ind","operands":"r0, 0x0","gas_used":1,"gas":96,"exit":"halt"}`,
+	}, lines)
+}
+
+func TestDebuggerBreakpointsAndWatchpoints(t *testing.T) {
+	debugger := NewDebugger(newDebugTestPVM(t), nil)
+	debugger.AddBreakpoint(3)
+	debugger.AddBreakpoint(6)
+	debugger.AddWatchpoint(0x10000, 4)
+
+	exitReason, _, err := debugger.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, ExitContinue, exitReason)
+	assert.Equal(t, uint32(3), debugger.PVM.PC)
+
+	debugger.RemoveBreakpoint(6)
+	exitReason, _, err = debugger.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, ExitContinue, exitReason)
+	assert.Equal(t, uint32(12), debugger.PVM.PC, "Stops after the store to watched memory")
+
+	exitReason, _, err = debugger.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, ExitHalt, exitReason)
+}
+
+func TestDebuggerHostCall(t *testing.T) {
+	pvm, err := NewPVM([]byte{OpEcalli, 0x02, OpTrap}, []byte{0b101}, nil, 100)
+	assert.NoError(t, err)
+	debugger := NewDebugger(pvm, HostCallFunc(func(index uint32, pvm *PVM) (ExitReason, error) {
+		pvm.Gas -= 10
+		pvm.Registers[7] = index
+		return ExitContinue, nil
+	}))
+
+	entry, exitReason, _, err := debugger.Step()
+
+	assert.NoError(t, err)
+	assert.Equal(t, ExitContinue, exitReason)
+	assert.Equal(t, map[string]uint32{"r7": 2}, entry.Registers)
+	assert.Equal(t, int64(11), entry.GasUsed)
+	assert.Equal(t, uint32(2), pvm.PC)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Disassemble writes a listing of a code blob: its jump table, followed by
+// every instruction with its program counter and encoding. Basic blocks are
+// labelled @pc, matching how jump targets are shown in operands.
+func Disassemble(w io.Writer, blob *CodeBlob) error {
+	var out strings.Builder
+
+	if len(blob.JumpTable) > 0 {
+		out.WriteString("jump_table:\n")
+		for i, target := range blob.JumpTable {
+			fmt.Fprintf(&out, "  0x%x -> @%d\n", (i+1)*JumpAlignmentFactor, target)
+		}
+	}
+
+	if len(blob.Code) > 0 {
+		// Gas is irrelevant, the machine is only used to decode instructions
+		pvm, err := NewPVM(blob.Code, blob.Bitmask, blob.JumpTable, 1)
+		if err != nil {
+			return err
+		}
+
+		out.WriteString("code:\n")
+		for pc := uint32(0); pc < uint32(len(pvm.Code)); {
+			in := pvm.decodeInstruction(pc)
+			if pvm.isBasicBlockStart(pc) {
+				fmt.Fprintf(&out, "@%d:\n", pc)
+			}
+			end := min(pc+in.Length, uint32(len(pvm.Code)))
+			fmt.Fprintf(&out, "  %6d  %-24s  %s\n", pc, fmt.Sprintf("% x", pvm.Code[pc:end]), in)
+			pc += in.Length
+		}
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// DisassembleProgram writes a listing of a standard program blob, or of a
+// bare code blob if data is not a program blob.
+func DisassembleProgram(w io.Writer, data []byte) error {
+	program, err := ParseProgramBlob(data)
+	if err != nil {
+		blob, codeErr := ParseCodeBlob(data)
+		if codeErr != nil {
+			return fmt.Errorf("neither a program nor a code blob: %w", err)
+		}
+		return Disassemble(w, blob)
+	}
+
+	_, err = fmt.Fprintf(w, "ro_data: %d bytes\nrw_data: %d bytes\nheap_pages: %d\nstack_size: %d\n",
+		len(program.ROData), len(program.RWData), program.HeapPages, program.StackSize)
+	if err != nil {
+		return err
+	}
+	return Disassemble(w, &program.Code)
+}
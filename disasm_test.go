@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisassembleProgram(t *testing.T) {
+	code := []byte{
+		OpLoadImm, 0x07, 0x05, // 0
+		OpAddImm, 0x78, 0x01, // 3
+		OpBranchEqImm, 0x17, 0x02, 0xFA, // 6
+		OpJumpInd, 0x00, // 10
+		OpTrap, // 12
+	}
+	blob := encodeProgramBlob([]byte{1}, nil, 1, 4096, code, []byte{0b01001001, 0b00010100}, []uint32{10})
+
+	var out strings.Builder
+	err := DisassembleProgram(&out, blob)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `ro_data: 1 bytes
+rw_data: 0 bytes
+heap_pages: 1
+stack_size: 4096
+jump_table:
+  0x2 -> @10
+code:
+@0:
+       0  04 07 05                  load_imm r7, 0x5
+       3  02 78 01                  add_imm r8, r7, 0x1
+       6  07 17 02 fa               branch_eq_imm r7, 0x2, @0
+@10:
+      10  13 00                     jump_ind r0, 0x0
+@12:
+      12  00                        trap
+`, out.String())
+}
+
+func TestDisassembleCodeBlob(t *testing.T) {
+	var out strings.Builder
+	err := DisassembleProgram(&out, encodeCodeBlob([]byte{OpEcalli, 0x01, OpFallthrough}, []byte{0b101}, nil))
+
+	assert.NoError(t, err)
+	assert.Equal(t, `code:
+@0:
+       0  4e 01                     ecalli 0x1
+       2  11                        fallthrough
+`, out.String())
+}
+
+func TestDisassembleInvalidBlob(t *testing.T) {
+	var out strings.Builder
+	err := DisassembleProgram(&out, []byte{0xFF})
+
+	assert.EqualError(t, err, "neither a program nor a code blob: insufficient data for program blob header")
+	assert.Empty(t, out.String())
+}
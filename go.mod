@@ -2,11 +2,14 @@ module github.com/marcuspang/jam
 
 go 1.22.1
 
+require (
+	github.com/stretchr/testify v1.9.0
+	golang.org/x/crypto v0.24.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.9.0 // indirect
-	golang.org/x/crypto v0.24.0 // indirect
 	golang.org/x/sys v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
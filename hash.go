@@ -128,14 +128,14 @@ func DeserializeAlpha(data []byte, offset int) ([][]Hash, int, error) {
 
 func SerializeBeta(beta []struct {
 	HeaderHash       Hash
-	AccumulationRoot Hash
+	AccumulationMMR  MMR
 	StateRoot        Hash
 	WorkReportHashes []Hash
 }) []byte {
 	var buf []byte
 	for _, item := range beta {
 		buf = append(buf, item.HeaderHash[:]...)
-		buf = append(buf, item.AccumulationRoot[:]...)
+		buf = append(buf, item.AccumulationMMR.Serialize()...)
 		buf = append(buf, item.StateRoot[:]...)
 		buf = append(buf, SerializeHashSequence(item.WorkReportHashes)...)
 	}
@@ -144,7 +144,7 @@ func SerializeBeta(beta []struct {
 
 func DeserializeBeta(data []byte, offset int) ([]struct {
 	HeaderHash       Hash
-	AccumulationRoot Hash
+	AccumulationMMR  MMR
 	StateRoot        Hash
 	WorkReportHashes []Hash
 }, int, error) {
@@ -155,28 +155,35 @@ func DeserializeBeta(data []byte, offset int) ([]struct {
 
 	beta := []struct {
 		HeaderHash       Hash
-		AccumulationRoot Hash
+		AccumulationMMR  MMR
 		StateRoot        Hash
 		WorkReportHashes []Hash
 	}{}
 
 	seqOffset := 0
 	for seqOffset < len(betaSeq) {
-		if seqOffset+32*3 > len(betaSeq) {
+		if seqOffset+32 > len(betaSeq) {
 			return nil, offset, errors.New("insufficient data for Beta item")
 		}
 
 		item := struct {
 			HeaderHash       Hash
-			AccumulationRoot Hash
+			AccumulationMMR  MMR
 			StateRoot        Hash
 			WorkReportHashes []Hash
 		}{}
 
 		copy(item.HeaderHash[:], betaSeq[seqOffset:seqOffset+32])
 		seqOffset += 32
-		copy(item.AccumulationRoot[:], betaSeq[seqOffset:seqOffset+32])
-		seqOffset += 32
+		accumulationMMR, newSeqOffset, err := DeserializeMMR(betaSeq, seqOffset)
+		if err != nil {
+			return nil, offset, err
+		}
+		item.AccumulationMMR = accumulationMMR
+		seqOffset = newSeqOffset
+		if seqOffset+32 > len(betaSeq) {
+			return nil, offset, errors.New("insufficient data for Beta item")
+		}
 		copy(item.StateRoot[:], betaSeq[seqOffset:seqOffset+32])
 		seqOffset += 32
 
@@ -195,29 +202,29 @@ func DeserializeBeta(data []byte, offset int) ([]struct {
 
 func SerializeGamma(gamma struct {
 	ValidatorKeys     []ValidatorKey
-	EpochRoot         Hash
-	SlotSealers       []Ticket
-	TicketAccumulator []Ticket
+	EpochRoot         [384]byte
+	SlotSealers       TicketsOrKeys
+	TicketAccumulator []TicketBody
 }) []byte {
 	var buf []byte
 	buf = append(buf, SerializeValidatorKeys(gamma.ValidatorKeys)...)
 	buf = append(buf, gamma.EpochRoot[:]...)
-	buf = append(buf, SerializeTickets(gamma.SlotSealers)...)
-	buf = append(buf, SerializeTickets(gamma.TicketAccumulator)...)
+	buf = append(buf, gamma.SlotSealers.Serialize()...)
+	buf = append(buf, SerializeTicketBodies(gamma.TicketAccumulator)...)
 	return buf
 }
 
 func DeserializeGamma(data []byte, offset int) (struct {
 	ValidatorKeys     []ValidatorKey
-	EpochRoot         Hash
-	SlotSealers       []Ticket
-	TicketAccumulator []Ticket
+	EpochRoot         [384]byte
+	SlotSealers       TicketsOrKeys
+	TicketAccumulator []TicketBody
 }, int, error) {
 	gamma := struct {
 		ValidatorKeys     []ValidatorKey
-		EpochRoot         Hash
-		SlotSealers       []Ticket
-		TicketAccumulator []Ticket
+		EpochRoot         [384]byte
+		SlotSealers       TicketsOrKeys
+		TicketAccumulator []TicketBody
 	}{}
 
 	var err error
@@ -227,18 +234,18 @@ func DeserializeGamma(data []byte, offset int) (struct {
 		return gamma, offset, err
 	}
 
-	if offset+32 > len(data) {
+	if offset+len(gamma.EpochRoot) > len(data) {
 		return gamma, offset, errors.New("insufficient data for EpochRoot")
 	}
-	copy(gamma.EpochRoot[:], data[offset:offset+32])
-	offset += 32
+	copy(gamma.EpochRoot[:], data[offset:])
+	offset += len(gamma.EpochRoot)
 
-	gamma.SlotSealers, offset, err = DeserializeTickets(data, offset)
+	gamma.SlotSealers, offset, err = DeserializeTicketsOrKeys(data, offset)
 	if err != nil {
 		return gamma, offset, err
 	}
 
-	gamma.TicketAccumulator, offset, err = DeserializeTickets(data, offset)
+	gamma.TicketAccumulator, offset, err = DeserializeTicketBodies(data, offset)
 	if err != nil {
 		return gamma, offset, err
 	}
@@ -417,6 +424,12 @@ func DeserializeTau(data []byte, offset int) (uint32, int, error) {
 	return binary.BigEndian.Uint32(data[offset : offset+4]), offset + 4, nil
 }
 
+// SerializeCoreIndex encodes a core index in two bytes, as passed to the
+// is-authorized invocation.
+func SerializeCoreIndex(core uint32) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(core))
+}
+
 func SerializePhi(phi [][]Hash) []byte {
 	return SerializeHashSequenceSequence(phi)
 }
@@ -675,10 +688,10 @@ func SerializeServiceAccount(sa ServiceAccount) []byte {
 	buf = binary.BigEndian.AppendUint64(buf, sa.Balance)
 
 	// AccumulateGasLimit
-	buf = binary.BigEndian.AppendUint64(buf, uint64(sa.AccumulateGasLimit))
+	buf = binary.BigEndian.AppendUint64(buf, sa.AccumulateGasLimit)
 
 	// OnTransferGasLimit
-	buf = binary.BigEndian.AppendUint64(buf, uint64(sa.OnTransferGasLimit))
+	buf = binary.BigEndian.AppendUint64(buf, sa.OnTransferGasLimit)
 
 	// Storage
 	buf = binary.BigEndian.AppendUint32(buf, uint32(len(sa.Storage)))
@@ -724,10 +737,10 @@ func DeserializeServiceAccount(data []byte, offset int) (ServiceAccount, int, er
 	sa.Balance = binary.BigEndian.Uint64(data[offset : offset+8])
 	offset += 8
 
-	sa.AccumulateGasLimit = int64(binary.BigEndian.Uint64(data[offset : offset+8]))
+	sa.AccumulateGasLimit = binary.BigEndian.Uint64(data[offset : offset+8])
 	offset += 8
 
-	sa.OnTransferGasLimit = int64(binary.BigEndian.Uint64(data[offset : offset+8]))
+	sa.OnTransferGasLimit = binary.BigEndian.Uint64(data[offset : offset+8])
 	offset += 8
 
 	storageLen := binary.BigEndian.Uint32(data[offset : offset+4])
@@ -825,8 +838,19 @@ func (h *Header) Serialize(includeSeal bool) []byte {
 	buf = append(buf, h.ExtrinsicHash[:]...)
 	buf = binary.BigEndian.AppendUint32(buf, h.TimeSlot)
 
-	buf = append(buf, h.EpochMarker.Serialize()...)
-	buf = append(buf, h.WinningTickets.Serialize()...)
+	// Markers are optional, prefixed with whether they are present
+	if h.EpochMarker == nil {
+		buf = append(buf, 0)
+	} else {
+		buf = append(buf, 1)
+		buf = append(buf, h.EpochMarker.Serialize()...)
+	}
+	if h.WinningTickets == nil {
+		buf = append(buf, 0)
+	} else {
+		buf = append(buf, 1)
+		buf = append(buf, h.WinningTickets.Serialize()...)
+	}
 	buf = append(buf, SerializeVarOctetSequence(SerializeHashSequence(h.JudgementsMarker))...)
 	buf = binary.BigEndian.AppendUint32(buf, h.AuthorKey)
 	buf = append(buf, h.VRFSignature.Signature[:]...)
@@ -873,13 +897,10 @@ func DeserializeHeader(data []byte, offset int) (*Header, int, error) {
 	// WinningTickets
 	if data[offset] == 1 {
 		h.WinningTickets = &WinningTickets{}
-		ticketCount := binary.BigEndian.Uint32(data[offset+1 : offset+5])
-		h.WinningTickets.Tickets = make([]Ticket, ticketCount)
-		offset += 5
-		for i := uint32(0); i < ticketCount; i++ {
-			h.WinningTickets.Tickets[i].EntryIndex = binary.BigEndian.Uint32(data[offset : offset+4])
-			copy(h.WinningTickets.Tickets[i].Proof, data[offset+4:offset+100])
-			offset += 100
+		var err error
+		h.WinningTickets.Tickets, offset, err = DeserializeTicketBodies(data, offset+1)
+		if err != nil {
+			return nil, offset, err
 		}
 	} else {
 		offset++
@@ -953,7 +974,7 @@ func DeserializeBlock(data []byte, offset int) (*Block, int, error) {
 }
 
 func (wt *WinningTickets) Serialize() []byte {
-	return SerializeTickets(wt.Tickets)
+	return SerializeTicketBodies(wt.Tickets)
 }
 
 func (t *Ticket) Serialize() []byte {
@@ -1041,6 +1062,36 @@ func DeserializeWorkReport(data []byte, offset int) (WorkReport, int, error) {
 	return report, offset, nil
 }
 
+func (wp *WorkPackage) Serialize() []byte {
+	var buf []byte
+	buf = append(buf, SerializeVarOctetSequence(wp.AuthToken)...)
+	buf = binary.BigEndian.AppendUint32(buf, wp.AuthServiceIndex)
+	buf = append(buf, wp.AuthCodeHash[:]...)
+	buf = append(buf, SerializeVarOctetSequence(wp.AuthParam)...)
+	buf = append(buf, wp.Context.Serialize()...)
+	buf = append(buf, SerializeCompactInteger(uint64(len(wp.Items)))...)
+	for _, item := range wp.Items {
+		buf = append(buf, item.Serialize()...)
+	}
+	return buf
+}
+
+func (wi *WorkItem) Serialize() []byte {
+	var buf []byte
+	buf = binary.BigEndian.AppendUint32(buf, wi.ServiceIndex)
+	buf = append(buf, wi.CodeHash[:]...)
+	buf = append(buf, SerializeVarOctetSequence(wi.Payload)...)
+	buf = binary.BigEndian.AppendUint64(buf, wi.GasLimit)
+	buf = append(buf, SerializeCompactInteger(uint64(len(wi.ImportedSegments)))...)
+	for _, segment := range wi.ImportedSegments {
+		buf = append(buf, segment.Root[:]...)
+		buf = binary.BigEndian.AppendUint32(buf, segment.Index)
+	}
+	buf = append(buf, SerializeHashSequence(wi.ExtrinsicHashes)...)
+	buf = binary.BigEndian.AppendUint32(buf, wi.ExportCount)
+	return buf
+}
+
 func (rc *RefinementContext) Serialize() []byte {
 	var buf []byte
 	buf = append(buf, rc.AnchorHash[:]...)
@@ -1246,6 +1297,45 @@ func DeserializeCompactInteger(data []byte, offset int) (uint64, int, error) {
 	}
 }
 
+// SerializeNatural encodes n using the variable-length natural number
+// encoding of the Gray Paper (appendix C), where the count of leading one bits
+// in the first byte gives the number of bytes that follow.
+func SerializeNatural(n uint64) []byte {
+	for l := 0; l < 8; l++ {
+		if n < 1<<(7*(l+1)) {
+			buf := make([]byte, 1+l)
+			buf[0] = byte(256 - (1 << (8 - l)) + int(n>>(8*l)))
+			for i := 0; i < l; i++ {
+				buf[1+i] = byte(n >> (8 * i))
+			}
+			return buf
+		}
+	}
+	return binary.LittleEndian.AppendUint64([]byte{0xFF}, n)
+}
+
+func DeserializeNatural(data []byte, offset int) (uint64, int, error) {
+	if offset >= len(data) {
+		return 0, offset, errors.New("insufficient data for natural")
+	}
+
+	first := data[offset]
+	l := bits.LeadingZeros8(^first)
+	if offset+1+l > len(data) {
+		return 0, offset, errors.New("insufficient data for natural")
+	}
+	if l == 8 {
+		return binary.LittleEndian.Uint64(data[offset+1:]), offset + 9, nil
+	}
+
+	var n uint64
+	for i := 0; i < l; i++ {
+		n |= uint64(data[offset+1+i]) << (8 * i)
+	}
+	n |= uint64(first&(0xFF>>(l+1))) << (8 * l)
+	return n, offset + 1 + l, nil
+}
+
 func SerializeMaybe(data interface{}, serializeFunc func(interface{}) []byte) []byte {
 	if data == nil || reflect.ValueOf(data).IsNil() {
 		return []byte{0}
@@ -1369,6 +1459,77 @@ func DeserializeTickets(data []byte, offset int) ([]Ticket, int, error) {
 	return tickets, offset, nil
 }
 
+func SerializeTicketBodies(tickets []TicketBody) []byte {
+	var buf []byte
+	buf = append(buf, SerializeCompactInteger(uint64(len(tickets)))...)
+	for _, ticket := range tickets {
+		buf = append(buf, ticket.Identifier[:]...)
+		buf = binary.BigEndian.AppendUint32(buf, ticket.EntryIndex)
+	}
+	return buf
+}
+
+func DeserializeTicketBodies(data []byte, offset int) ([]TicketBody, int, error) {
+	count, offset, err := DeserializeCompactInteger(data, offset)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	if count > uint64(len(data)-offset)/36 {
+		return nil, offset, errors.New("insufficient data for ticket body")
+	}
+	tickets := make([]TicketBody, count)
+	for i := uint64(0); i < count; i++ {
+		copy(tickets[i].Identifier[:], data[offset:offset+32])
+		tickets[i].EntryIndex = binary.BigEndian.Uint32(data[offset+32 : offset+36])
+		offset += 36
+	}
+
+	return tickets, offset, nil
+}
+
+// Serialize encodes the seal keys of an epoch as 0 followed by the tickets,
+// or 1 followed by the fallback keys.
+func (t *TicketsOrKeys) Serialize() []byte {
+	if t.IsTickets() {
+		return append([]byte{0}, SerializeTicketBodies(t.Tickets)...)
+	}
+	buf := append([]byte{1}, SerializeCompactInteger(uint64(len(t.Keys)))...)
+	return append(buf, SerializeBandersnatchKeySequence(t.Keys)...)
+}
+
+func DeserializeTicketsOrKeys(data []byte, offset int) (TicketsOrKeys, int, error) {
+	if offset >= len(data) {
+		return TicketsOrKeys{}, offset, errors.New("insufficient data for tickets or keys")
+	}
+	tag := data[offset]
+	offset++
+
+	switch tag {
+	case 0:
+		tickets, offset, err := DeserializeTicketBodies(data, offset)
+		return TicketsOrKeys{Tickets: tickets}, offset, err
+	case 1:
+		count, offset, err := DeserializeCompactInteger(data, offset)
+		if err != nil {
+			return TicketsOrKeys{}, offset, err
+		}
+		if count > uint64(len(data)-offset)/32 {
+			return TicketsOrKeys{}, offset, errors.New("insufficient data for fallback keys")
+		}
+		var keys []BandersnatchKey
+		for i := uint64(0); i < count; i++ {
+			var key BandersnatchKey
+			copy(key[:], data[offset:offset+32])
+			keys = append(keys, key)
+			offset += 32
+		}
+		return TicketsOrKeys{Keys: keys}, offset, nil
+	default:
+		return TicketsOrKeys{}, offset, errors.New("invalid tickets or keys tag")
+	}
+}
+
 func (j *Judgement) Serialize() []byte {
 	var buf []byte
 	buf = append(buf, j.ReportHash[:]...)
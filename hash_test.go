@@ -62,7 +62,7 @@ func TestSerializeDeserializeBeta(t *testing.T) {
 		name string
 		beta []struct {
 			HeaderHash       Hash
-			AccumulationRoot Hash
+			AccumulationMMR  MMR
 			StateRoot        Hash
 			WorkReportHashes []Hash
 		}
@@ -71,7 +71,7 @@ func TestSerializeDeserializeBeta(t *testing.T) {
 			name: "Empty Beta",
 			beta: []struct {
 				HeaderHash       Hash
-				AccumulationRoot Hash
+				AccumulationMMR  MMR
 				StateRoot        Hash
 				WorkReportHashes []Hash
 			}{},
@@ -80,13 +80,13 @@ func TestSerializeDeserializeBeta(t *testing.T) {
 			name: "Single Beta entry",
 			beta: []struct {
 				HeaderHash       Hash
-				AccumulationRoot Hash
+				AccumulationMMR  MMR
 				StateRoot        Hash
 				WorkReportHashes []Hash
 			}{
 				{
 					HeaderHash:       Hash{1, 2, 3},
-					AccumulationRoot: Hash{4, 5, 6},
+					AccumulationMMR:  MMR{Peaks: []*Hash{{4, 5, 6}}},
 					StateRoot:        Hash{7, 8, 9},
 					WorkReportHashes: []Hash{{10, 11, 12}, {13, 14, 15}},
 				},
@@ -96,19 +96,19 @@ func TestSerializeDeserializeBeta(t *testing.T) {
 			name: "Multiple Beta entries",
 			beta: []struct {
 				HeaderHash       Hash
-				AccumulationRoot Hash
+				AccumulationMMR  MMR
 				StateRoot        Hash
 				WorkReportHashes []Hash
 			}{
 				{
 					HeaderHash:       Hash{1, 2, 3},
-					AccumulationRoot: Hash{4, 5, 6},
+					AccumulationMMR:  MMR{Peaks: []*Hash{{4, 5, 6}}},
 					StateRoot:        Hash{7, 8, 9},
 					WorkReportHashes: []Hash{{10, 11, 12}, {13, 14, 15}},
 				},
 				{
 					HeaderHash:       Hash{16, 17, 18},
-					AccumulationRoot: Hash{19, 20, 21},
+					AccumulationMMR:  MMR{Peaks: []*Hash{nil, {19, 20, 21}}},
 					StateRoot:        Hash{22, 23, 24},
 					WorkReportHashes: []Hash{{25, 26, 27}},
 				},
@@ -133,32 +133,32 @@ func TestSerializeDeserializeGamma(t *testing.T) {
 		name  string
 		gamma struct {
 			ValidatorKeys     []ValidatorKey
-			EpochRoot         Hash
-			SlotSealers       []Ticket
-			TicketAccumulator []Ticket
+			EpochRoot         [384]byte
+			SlotSealers       TicketsOrKeys
+			TicketAccumulator []TicketBody
 		}
 	}{
 		{
 			name: "Empty Gamma",
 			gamma: struct {
 				ValidatorKeys     []ValidatorKey
-				EpochRoot         Hash
-				SlotSealers       []Ticket
-				TicketAccumulator []Ticket
+				EpochRoot         [384]byte
+				SlotSealers       TicketsOrKeys
+				TicketAccumulator []TicketBody
 			}{
 				ValidatorKeys:     []ValidatorKey{},
-				EpochRoot:         Hash{},
-				SlotSealers:       []Ticket{},
-				TicketAccumulator: []Ticket{},
+				EpochRoot:         [384]byte{},
+				SlotSealers:       TicketsOrKeys{Tickets: []TicketBody{}},
+				TicketAccumulator: []TicketBody{},
 			},
 		},
 		{
 			name: "Populated Gamma",
 			gamma: struct {
 				ValidatorKeys     []ValidatorKey
-				EpochRoot         Hash
-				SlotSealers       []Ticket
-				TicketAccumulator []Ticket
+				EpochRoot         [384]byte
+				SlotSealers       TicketsOrKeys
+				TicketAccumulator []TicketBody
 			}{
 				ValidatorKeys: []ValidatorKey{
 					{
@@ -168,15 +168,28 @@ func TestSerializeDeserializeGamma(t *testing.T) {
 						Metadata:        [128]byte{10, 11, 12},
 					},
 				},
-				EpochRoot: Hash{13, 14, 15},
-				SlotSealers: []Ticket{
-					{EntryIndex: 1, Proof: []byte{16, 17, 18}},
-				},
-				TicketAccumulator: []Ticket{
-					{EntryIndex: 2, Proof: []byte{19, 20, 21}},
+				EpochRoot: [384]byte{13, 14, 15},
+				SlotSealers: TicketsOrKeys{Tickets: []TicketBody{
+					{Identifier: Hash{16, 17, 18}, EntryIndex: 1},
+				}},
+				TicketAccumulator: []TicketBody{
+					{Identifier: Hash{19, 20, 21}, EntryIndex: 2},
 				},
 			},
 		},
+		{
+			name: "Fallback keys",
+			gamma: struct {
+				ValidatorKeys     []ValidatorKey
+				EpochRoot         [384]byte
+				SlotSealers       TicketsOrKeys
+				TicketAccumulator []TicketBody
+			}{
+				ValidatorKeys:     []ValidatorKey{},
+				SlotSealers:       TicketsOrKeys{Keys: []BandersnatchKey{{22}, {23}}},
+				TicketAccumulator: []TicketBody{},
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -700,6 +713,43 @@ func TestDeserializeVarOctetSequenceErrors(t *testing.T) {
 	}
 }
 
+func TestDeserializeTicketsOrKeysErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "Empty input",
+			data: []byte{},
+		},
+		{
+			name: "Invalid tag",
+			data: []byte{2, 0},
+		},
+		{
+			name: "Ticket count beyond the data",
+			data: append([]byte{0}, SerializeCompactInteger(1<<29)...),
+		},
+		{
+			name: "Truncated ticket",
+			data: append([]byte{0, 1 << 2}, make([]byte, 35)...),
+		},
+		{
+			name: "Key count beyond the data",
+			data: append([]byte{1}, SerializeCompactInteger(1<<29)...),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := DeserializeTicketsOrKeys(tc.data, 0)
+			if err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
 func TestSerializeDeserializeWorkReport(t *testing.T) {
 	report := WorkReport{
 		AuthorizerHash: Hash{1, 2, 3},
@@ -744,22 +794,22 @@ func createSampleState() *State {
 		},
 		Beta: []struct {
 			HeaderHash       Hash
-			AccumulationRoot Hash
+			AccumulationMMR  MMR
 			StateRoot        Hash
 			WorkReportHashes []Hash
 		}{
 			{
 				HeaderHash:       Hash{1, 1, 1},
-				AccumulationRoot: Hash{2, 2, 2},
+				AccumulationMMR:  MMR{Peaks: []*Hash{{2, 2, 2}}},
 				StateRoot:        Hash{3, 3, 3},
 				WorkReportHashes: []Hash{{4, 4, 4}, {5, 5, 5}},
 			},
 		},
 		Gamma: struct {
 			ValidatorKeys     []ValidatorKey
-			EpochRoot         Hash
-			SlotSealers       []Ticket
-			TicketAccumulator []Ticket
+			EpochRoot         [384]byte
+			SlotSealers       TicketsOrKeys
+			TicketAccumulator []TicketBody
 		}{
 			ValidatorKeys: []ValidatorKey{
 				{
@@ -769,12 +819,12 @@ func createSampleState() *State {
 					Metadata:        [128]byte{4, 4, 4},
 				},
 			},
-			EpochRoot: Hash{6, 6, 6},
-			SlotSealers: []Ticket{
-				{EntryIndex: 1, Proof: []byte{7, 7, 7}},
-			},
-			TicketAccumulator: []Ticket{
-				{EntryIndex: 2, Proof: []byte{8, 8, 8}},
+			EpochRoot: [384]byte{6, 6, 6},
+			SlotSealers: TicketsOrKeys{Tickets: []TicketBody{
+				{Identifier: Hash{7, 7, 7}, EntryIndex: 1},
+			}},
+			TicketAccumulator: []TicketBody{
+				{Identifier: Hash{8, 8, 8}, EntryIndex: 2},
 			},
 		},
 		Delta: map[uint32]ServiceAccount{
@@ -879,3 +929,31 @@ func createSampleState() *State {
 		},
 	}
 }
+
+func TestSerializeDeserializeNatural(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    uint64
+		expected []byte
+	}{
+		{"Zero", 0, []byte{0x00}},
+		{"Single byte", 127, []byte{0x7F}},
+		{"Two bytes", 128, []byte{0x80, 0x80}},
+		{"Two bytes max", 1<<14 - 1, []byte{0xBF, 0xFF}},
+		{"Three bytes", 1 << 14, []byte{0xC0, 0x00, 0x40}},
+		{"Eight bytes", 1<<56 - 1, []byte{0xFE, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"Nine bytes", 1<<64 - 1, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			serialized := SerializeNatural(tc.value)
+			assert.Equal(t, tc.expected, serialized)
+
+			deserialized, offset, err := DeserializeNatural(serialized, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, len(serialized), offset)
+			assert.Equal(t, tc.value, deserialized)
+		})
+	}
+}
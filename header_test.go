@@ -9,33 +9,33 @@ import (
 
 func TestValidateHeader(t *testing.T) {
 	config := &Config{
-		ValidatorCount: 100,
-		SlotsPerEpoch:  600,
+		ValidatorCount:      100,
+		SlotsPerEpoch:       600,
+		TicketSubmissionEnd: 500,
 	}
 
 	currentTime := uint64(time.Now().Unix())
+	epochStart := (uint32(currentTime)/config.SlotsPerEpoch - 1) * config.SlotsPerEpoch
+
+	parentHeader := &Header{
+		TimeSlot: epochStart - 1,
+	}
+
 	validHeader := &Header{
-		ParentHash:    Hash{1, 2, 3},
+		ParentHash:    CalculateHeaderHash(parentHeader),
 		StateRoot:     Hash{4, 5, 6},
 		ExtrinsicHash: Hash{7, 8, 9},
-		TimeSlot:      uint32(currentTime) - 1,
+		TimeSlot:      epochStart,
 		EpochMarker: &EpochMarker{
 			EpochRandomness: Hash{10, 11, 12},
 			ValidatorKeys:   make([]BandersnatchKey, config.ValidatorCount),
 		},
-		WinningTickets: &WinningTickets{
-			Tickets: make([]Ticket, config.SlotsPerEpoch),
-		},
 		JudgementsMarker: []Hash{{13, 14, 15}},
 		AuthorKey:        0,
 		VRFSignature:     BandersnatchSignature{},
 		Seal:             BandersnatchSignature{},
 	}
 
-	parentHeader := &Header{
-		TimeSlot: uint32(currentTime) - 2,
-	}
-
 	tests := []struct {
 		name     string
 		header   *Header
@@ -46,7 +46,7 @@ func TestValidateHeader(t *testing.T) {
 		{"Invalid parent time slot", &Header{TimeSlot: parentHeader.TimeSlot}, false},
 		{"Invalid extrinsic hash", &Header{ExtrinsicHash: Hash{1}}, false},
 		{"Invalid epoch marker", &Header{EpochMarker: &EpochMarker{ValidatorKeys: []BandersnatchKey{}}}, false},
-		{"Invalid winning tickets", &Header{WinningTickets: &WinningTickets{Tickets: []Ticket{}}}, false},
+		{"Invalid winning tickets", &Header{WinningTickets: &WinningTickets{Tickets: []TicketBody{}}}, false},
 		{"Invalid author key", &Header{AuthorKey: config.ValidatorCount}, false},
 	}
 
@@ -58,3 +58,45 @@ func TestValidateHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateHeaderMarkers(t *testing.T) {
+	config := &Config{
+		ValidatorCount:      6,
+		SlotsPerEpoch:       EpochLength,
+		TicketSubmissionEnd: TicketSubmissionEnd,
+	}
+	epochMarker := &EpochMarker{ValidatorKeys: make([]BandersnatchKey, config.ValidatorCount)}
+	winningTickets := &WinningTickets{Tickets: make([]TicketBody, config.SlotsPerEpoch)}
+
+	tests := []struct {
+		name           string
+		parentSlot     uint32
+		slot           uint32
+		epochMarker    *EpochMarker
+		winningTickets *WinningTickets
+		expected       bool
+	}{
+		{"No markers", 10, 11, nil, nil, true},
+		{"Epoch marker in first block of epoch", EpochLength - 1, EpochLength + 2, epochMarker, nil, true},
+		{"Missing epoch marker", EpochLength - 1, EpochLength, nil, nil, false},
+		{"Unexpected epoch marker", 10, 11, epochMarker, nil, false},
+		{"Winning tickets past submission end", TicketSubmissionEnd - 2, TicketSubmissionEnd + 1, nil, winningTickets, true},
+		{"Winning tickets may be missing", TicketSubmissionEnd - 1, TicketSubmissionEnd, nil, nil, true},
+		{"Unexpected winning tickets", TicketSubmissionEnd, TicketSubmissionEnd + 1, nil, winningTickets, false},
+		{"Winning tickets in new epoch", TicketSubmissionEnd - 1, EpochLength + TicketSubmissionEnd, epochMarker, winningTickets, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parentHeader := &Header{TimeSlot: tt.parentSlot}
+			header := &Header{
+				ParentHash:     CalculateHeaderHash(parentHeader),
+				TimeSlot:       tt.slot,
+				EpochMarker:    tt.epochMarker,
+				WinningTickets: tt.winningTickets,
+			}
+
+			assert.Equal(t, tt.expected, ValidateHeader(header, uint64(tt.slot), parentHeader, config))
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+// RecentHistorySize is H, the number of recent blocks kept in β.
+const RecentHistorySize = 8
+
+// UpdateRecentHistory is the recent-history (β) transition. The previous
+// block's entry, which was added before its state root was known, is given
+// the parent state root, and the block is appended with its accumulation
+// root and the work packages reported in it. Only the most recent
+// RecentHistorySize blocks are kept, oldest first.
+func UpdateRecentHistory(beta []struct {
+	HeaderHash       Hash
+	AccumulationMMR  MMR
+	StateRoot        Hash
+	WorkReportHashes []Hash
+}, headerHash, parentStateRoot, accumulationRoot Hash, workPackageHashes []Hash) []struct {
+	HeaderHash       Hash
+	AccumulationMMR  MMR
+	StateRoot        Hash
+	WorkReportHashes []Hash
+} {
+	newBeta := make([]struct {
+		HeaderHash       Hash
+		AccumulationMMR  MMR
+		StateRoot        Hash
+		WorkReportHashes []Hash
+	}, len(beta), len(beta)+1)
+	copy(newBeta, beta)
+
+	var accumulationMMR MMR
+	if len(newBeta) > 0 {
+		newBeta[len(newBeta)-1].StateRoot = parentStateRoot
+		accumulationMMR = newBeta[len(newBeta)-1].AccumulationMMR
+	}
+
+	newBeta = append(newBeta, struct {
+		HeaderHash       Hash
+		AccumulationMMR  MMR
+		StateRoot        Hash
+		WorkReportHashes []Hash
+	}{
+		HeaderHash:       headerHash,
+		AccumulationMMR:  accumulationMMR.Append(accumulationRoot),
+		WorkReportHashes: workPackageHashes,
+	})
+	if len(newBeta) > RecentHistorySize {
+		newBeta = newBeta[len(newBeta)-RecentHistorySize:]
+	}
+	return newBeta
+}
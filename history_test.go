@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type historyTestBlock struct {
+	HeaderHash string `json:"header_hash"`
+	MMR        struct {
+		Peaks []*string `json:"peaks"`
+	} `json:"mmr"`
+	StateRoot string   `json:"state_root"`
+	Reported  []string `json:"reported"`
+}
+
+type historyTestState struct {
+	Beta []historyTestBlock `json:"beta"`
+}
+
+// HistoryTestCase is a recent-history test vector
+type HistoryTestCase struct {
+	Input struct {
+		HeaderHash      string   `json:"header_hash"`
+		ParentStateRoot string   `json:"parent_state_root"`
+		AccumulateRoot  string   `json:"accumulate_root"`
+		WorkPackages    []string `json:"work_packages"`
+	} `json:"input"`
+	PreState  historyTestState `json:"pre_state"`
+	PostState historyTestState `json:"post_state"`
+}
+
+func hexToHashes(s []string) []Hash {
+	hashes := make([]Hash, len(s))
+	for i, h := range s {
+		hashes[i] = hexToBytes32(h)
+	}
+	return hashes
+}
+
+func (s historyTestState) beta() []struct {
+	HeaderHash       Hash
+	AccumulationMMR  MMR
+	StateRoot        Hash
+	WorkReportHashes []Hash
+} {
+	beta := make([]struct {
+		HeaderHash       Hash
+		AccumulationMMR  MMR
+		StateRoot        Hash
+		WorkReportHashes []Hash
+	}, len(s.Beta))
+	for i, block := range s.Beta {
+		beta[i].HeaderHash = hexToBytes32(block.HeaderHash)
+		beta[i].StateRoot = hexToBytes32(block.StateRoot)
+		beta[i].WorkReportHashes = hexToHashes(block.Reported)
+		for _, peak := range block.MMR.Peaks {
+			if peak == nil {
+				beta[i].AccumulationMMR.Peaks = append(beta[i].AccumulationMMR.Peaks, nil)
+			} else {
+				hash := Hash(hexToBytes32(*peak))
+				beta[i].AccumulationMMR.Peaks = append(beta[i].AccumulationMMR.Peaks, &hash)
+			}
+		}
+	}
+	return beta
+}
+
+func TestHistoryTestVectors(t *testing.T) {
+	files, err := filepath.Glob("jamtestvectors/history/data/*.json")
+	assert.NoError(t, err)
+	if len(files) == 0 {
+		missingTestVectors(t, "History")
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			assert.NoError(t, err)
+
+			var tc HistoryTestCase
+			assert.NoError(t, json.Unmarshal(data, &tc))
+
+			beta := UpdateRecentHistory(
+				tc.PreState.beta(),
+				hexToBytes32(tc.Input.HeaderHash),
+				hexToBytes32(tc.Input.ParentStateRoot),
+				hexToBytes32(tc.Input.AccumulateRoot),
+				hexToHashes(tc.Input.WorkPackages),
+			)
+			assert.Equal(t, tc.PostState.beta(), beta)
+		})
+	}
+}
+
+func TestUpdateRecentHistory(t *testing.T) {
+	var beta []struct {
+		HeaderHash       Hash
+		AccumulationMMR  MMR
+		StateRoot        Hash
+		WorkReportHashes []Hash
+	}
+
+	beta = UpdateRecentHistory(beta, Hash{1}, Hash{}, Hash{11}, []Hash{{21}})
+	assert.Len(t, beta, 1)
+	assert.Equal(t, Hash{1}, beta[0].HeaderHash)
+	assert.Equal(t, Hash{}, beta[0].StateRoot, "State root is not known until the next block")
+	assert.Equal(t, []Hash{{21}}, beta[0].WorkReportHashes)
+
+	previous := beta
+	beta = UpdateRecentHistory(beta, Hash{2}, Hash{31}, Hash{12}, nil)
+	assert.Len(t, beta, 2)
+	assert.Equal(t, Hash{31}, beta[0].StateRoot, "Previous entry is given the parent state root")
+	assert.Equal(t, Hash{}, previous[0].StateRoot, "Input is not modified")
+	assert.Equal(t, Hash{2}, beta[1].HeaderHash)
+	assert.Equal(t, MMR{}.Append(Hash{11}).Append(Hash{12}), beta[1].AccumulationMMR)
+
+	for i := byte(3); i <= RecentHistorySize+2; i++ {
+		beta = UpdateRecentHistory(beta, Hash{i}, Hash{30 + i}, Hash{10 + i}, nil)
+	}
+	assert.Len(t, beta, RecentHistorySize)
+	assert.Equal(t, Hash{3}, beta[0].HeaderHash, "Oldest blocks are dropped")
+	assert.Equal(t, Hash{RecentHistorySize + 2}, beta[RecentHistorySize-1].HeaderHash)
+}
+
+func TestUpdateStateFromHeaderRecentHistory(t *testing.T) {
+	header := Header{
+		TimeSlot:       1,
+		EpochMarker:    &EpochMarker{},
+		WinningTickets: &WinningTickets{},
+	}
+	var state State
+
+	state, err := UpdateStateFromHeader(header, state, Hash{1}, []Hash{{3}})
+	assert.NoError(t, err)
+	header.TimeSlot = 2
+	header.StateRoot = Hash{9}
+	state, err = UpdateStateFromHeader(header, state, Hash{2}, nil)
+	assert.NoError(t, err)
+
+	assert.Len(t, state.Beta, 2)
+	assert.Equal(t, Hash{9}, state.Beta[0].StateRoot)
+	assert.Equal(t, []Hash{{3}}, state.Beta[0].WorkReportHashes)
+	expected := MMR{}.Append(Hash{1}).Append(Hash{2})
+	assert.Equal(t, expected, state.Beta[1].AccumulationMMR)
+}
+
+func TestUpdateStateFromHeaderAccumulationMMR(t *testing.T) {
+	header := Header{
+		TimeSlot:       1,
+		StateRoot:      Hash{9},
+		EpochMarker:    &EpochMarker{},
+		WinningTickets: &WinningTickets{},
+	}
+	var state State
+
+	state, err := UpdateStateFromHeader(header, state, Hash{1}, nil)
+	assert.NoError(t, err)
+	first := state.Beta[0].HeaderHash
+	header.TimeSlot = 2
+	state, err = UpdateStateFromHeader(header, state, Hash{2}, nil)
+	assert.NoError(t, err)
+
+	// The latest block is last
+	assert.Len(t, state.Beta, 2)
+	expected := MMR{}.Append(Hash{1}).Append(Hash{2})
+	assert.Equal(t, MMR{}.Append(Hash{1}), state.Beta[0].AccumulationMMR)
+	assert.Equal(t, expected, state.Beta[1].AccumulationMMR)
+
+	assert.True(t, ValidateAnchor(RefinementContext{AnchorHash: first, AnchorStateRoot: Hash{9}, AnchorBeefyRoot: Hash{1}}, state.Beta))
+}
+
+func TestValidateAnchor(t *testing.T) {
+	beta := UpdateRecentHistory(nil, Hash{1}, Hash{}, Hash{2}, nil)
+	beta = UpdateRecentHistory(beta, Hash{3}, Hash{4}, Hash{5}, nil)
+	anchor := RefinementContext{
+		AnchorHash:      Hash{1},
+		AnchorStateRoot: Hash{4},
+		AnchorBeefyRoot: Hash{2},
+	}
+
+	testCases := []struct {
+		name     string
+		modify   func(context *RefinementContext)
+		expected bool
+	}{
+		{"Valid", func(context *RefinementContext) {}, true},
+		{"Unknown anchor", func(context *RefinementContext) { context.AnchorHash = Hash{9} }, false},
+		{"Wrong state root", func(context *RefinementContext) { context.AnchorStateRoot = Hash{9} }, false},
+		{"Wrong BEEFY root", func(context *RefinementContext) { context.AnchorBeefyRoot = Hash{9} }, false},
+		{
+			name: "Latest block",
+			modify: func(context *RefinementContext) {
+				*context = RefinementContext{AnchorHash: Hash{3}, AnchorBeefyRoot: MMR{}.Append(Hash{2}).Append(Hash{5}).SuperPeak()}
+			},
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			context := anchor
+			tc.modify(&context)
+			assert.Equal(t, tc.expected, ValidateAnchor(context, beta))
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+// HostFunctions services the host calls a guest makes through ecalli. The
+// implementation is given the machine itself so that it can read and mutate
+// registers and memory, and is responsible for charging the call's gas.
+type HostFunctions interface {
+	// HostCall handles host call index. It returns ExitContinue to resume the
+	// guest, or any other exit reason to stop it. Errors are reserved for
+	// failures of the host itself.
+	HostCall(index uint32, pvm *PVM) (ExitReason, error)
+}
+
+// ExecuteWithHost runs the machine like Execute, dispatching host calls to
+// host and resuming the guest after each one until it exits for another
+// reason. A nil host leaves host calls to the caller.
+func (pvm *PVM) ExecuteWithHost(host HostFunctions) (ExitReason, uint32, int64, error) {
+	for {
+		exitReason, value, gas := pvm.Execute()
+		if exitReason != ExitHost || host == nil {
+			return exitReason, value, gas, nil
+		}
+
+		exitReason, err := host.HostCall(value, pvm)
+		if err != nil {
+			return ExitPanic, 0, pvm.Gas, err
+		}
+		if pvm.Gas < 0 {
+			return ExitOOG, 0, pvm.Gas, nil
+		}
+		if exitReason != ExitContinue {
+			return exitReason, 0, pvm.Gas, nil
+		}
+	}
+}
+
+// HostCallFunc adapts a function to the HostFunctions interface.
+type HostCallFunc func(index uint32, pvm *PVM) (ExitReason, error)
+
+func (f HostCallFunc) HostCall(index uint32, pvm *PVM) (ExitReason, error) {
+	return f(index, pvm)
+}
+
+// Host call indices, as passed to ecalli. They follow the Gray Paper table
+// from before query and yield were added, except for yield itself, which
+// takes 16 as it does there. Accumulate and refine dispatch separately, so it
+// does not clash with import.
+const (
+	HostGas              uint32 = 0
+	HostLookup           uint32 = 1
+	HostRead             uint32 = 2
+	HostWrite            uint32 = 3
+	HostInfo             uint32 = 4
+	HostBless            uint32 = 5
+	HostAssign           uint32 = 6
+	HostDesignate        uint32 = 7
+	HostCheckpoint       uint32 = 8
+	HostNew              uint32 = 9
+	HostUpgrade          uint32 = 10
+	HostTransfer         uint32 = 11
+	HostQuit             uint32 = 12
+	HostSolicit          uint32 = 13
+	HostForget           uint32 = 14
+	HostHistoricalLookup uint32 = 15
+	HostImport           uint32 = 16
+	HostYield            uint32 = 16
+	HostExport           uint32 = 17
+	HostMachine          uint32 = 18
+	HostPeek             uint32 = 19
+	HostPoke             uint32 = 20
+	HostZero             uint32 = 21
+	HostVoid             uint32 = 22
+	HostInvoke           uint32 = 23
+	HostExpunge          uint32 = 24
+)
+
+// Host call result codes, returned to the guest in ω7.
+const (
+	ResultOK   uint32 = 0
+	ResultNone uint32 = 1<<32 - 1  // The item does not exist
+	ResultWhat uint32 = 1<<32 - 2  // Name unknown
+	ResultOOB  uint32 = 1<<32 - 3  // Memory index not accessible
+	ResultWho  uint32 = 1<<32 - 4  // Index unknown
+	ResultFull uint32 = 1<<32 - 5  // Storage full
+	ResultCore uint32 = 1<<32 - 6  // Core index unknown
+	ResultCash uint32 = 1<<32 - 7  // Insufficient funds
+	ResultLow  uint32 = 1<<32 - 8  // Gas limit too low
+	ResultHigh uint32 = 1<<32 - 9  // Gas limit too high
+	ResultHuh  uint32 = 1<<32 - 10 // The item exists, or the call is not permitted
+)
+
+// HostCallGasCost is the base gas charged for every host call.
+const HostCallGasCost = 10
+
+// chargeHostGas deducts gas for a host call and reports whether the guest can
+// continue.
+func chargeHostGas(pvm *PVM, gas int64) bool {
+	pvm.Gas -= gas
+	return pvm.Gas >= 0
+}
+
+// readGuest reads guest memory on behalf of a host call, reporting whether
+// the whole range was readable.
+func readGuest(pvm *PVM, address uint32, size uint32) ([]byte, bool) {
+	data, err := pvm.Memory.Read(address, size)
+	return data, err == nil
+}
+
+// writeGuest writes guest memory on behalf of a host call, reporting whether
+// the whole range was writable.
+func writeGuest(pvm *PVM, address uint32, data []byte) bool {
+	return pvm.Memory.Write(address, data) == nil
+}
+
+// writeGuestAvailable writes as much of value as fits in a buffer of size at
+// address, as the read-style host calls do, and returns the full length of
+// value in ω7.
+func writeGuestAvailable(pvm *PVM, address uint32, size uint32, value []byte) {
+	n := min(size, uint32(len(value)))
+	if !writeGuest(pvm, address, value[:n]) {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	pvm.Registers[7] = uint32(len(value))
+}
+
+// register64 joins two registers holding the low and high halves of a 64-bit
+// value.
+func register64(pvm *PVM, low int, high int) uint64 {
+	return uint64(pvm.Registers[low]) | uint64(pvm.Registers[high])<<32
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteWithHost(t *testing.T) {
+	code := []byte{
+		OpEcalli, 0x03, // 0
+		OpEcalli, 0x04, // 2
+		OpJumpInd, 0x00, // 4
+	}
+	bitmask := []byte{0b010101}
+
+	testCases := []struct {
+		name     string
+		host     HostFunctions
+		exit     ExitReason
+		value    uint32
+		gas      int64
+		expected uint32
+	}{
+		{
+			name: "Resumes after each host call",
+			host: HostCallFunc(func(index uint32, pvm *PVM) (ExitReason, error) {
+				pvm.Gas -= 10
+				pvm.Registers[7] += index
+				return ExitContinue, nil
+			}),
+			exit:     ExitHalt,
+			gas:      100 - 3 - 20,
+			expected: 7,
+		},
+		{
+			name: "Host stops the guest",
+			host: HostCallFunc(func(index uint32, pvm *PVM) (ExitReason, error) {
+				pvm.Registers[7] = index
+				return ExitPanic, nil
+			}),
+			exit:     ExitPanic,
+			gas:      100 - 1,
+			expected: 3,
+		},
+		{
+			name: "Host exhausts gas",
+			host: HostCallFunc(func(index uint32, pvm *PVM) (ExitReason, error) {
+				pvm.Gas -= 200
+				return ExitContinue, nil
+			}),
+			exit: ExitOOG,
+			gas:  100 - 1 - 200,
+		},
+		{
+			name:  "No host",
+			exit:  ExitHost,
+			value: 3,
+			gas:   100 - 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pvm, err := NewPVM(code, bitmask, nil, 100)
+			assert.NoError(t, err)
+			pvm.Registers[0] = HaltAddress
+
+			exitReason, value, gas, err := pvm.ExecuteWithHost(tc.host)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.exit, exitReason)
+			assert.Equal(t, tc.value, value)
+			assert.Equal(t, tc.gas, gas)
+			assert.Equal(t, tc.expected, pvm.Registers[7])
+		})
+	}
+}
+
+func TestExecuteWithHostError(t *testing.T) {
+	pvm, err := NewPVM([]byte{OpEcalli, 0x00}, []byte{0b01}, nil, 100)
+	assert.NoError(t, err)
+
+	failure := errors.New("host failure")
+	exitReason, _, _, err := pvm.ExecuteWithHost(HostCallFunc(func(uint32, *PVM) (ExitReason, error) {
+		return ExitContinue, failure
+	}))
+
+	assert.Equal(t, ExitPanic, exitReason)
+	assert.ErrorIs(t, err, failure)
+}
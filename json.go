@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// JSON codecs in the format of the JAM test vectors, in which byte strings
+// are hex with a 0x prefix.
+
+func encodeHex(b []byte) string {
+	return "0x" + hex.EncodeToString(b)
+}
+
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimPrefix(s, "0x"))
+}
+
+// decodeHexInto decodes s into b, which it must fill exactly.
+func decodeHexInto(s string, b []byte) error {
+	decoded, err := decodeHex(s)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != len(b) {
+		return fmt.Errorf("expected %d bytes of hex, got %d", len(b), len(decoded))
+	}
+	copy(b, decoded)
+	return nil
+}
+
+type validatorKeyJSON struct {
+	Ed25519      string `json:"ed25519"`
+	Bandersnatch string `json:"bandersnatch"`
+	Bls          string `json:"bls"`
+	Metadata     string `json:"metadata"`
+}
+
+func (vk ValidatorKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(validatorKeyJSON{
+		Ed25519:      encodeHex(vk.Ed25519Key[:]),
+		Bandersnatch: encodeHex(vk.BandersnatchKey[:]),
+		Bls:          encodeHex(vk.BLSKey[:]),
+		Metadata:     encodeHex(vk.Metadata[:]),
+	})
+}
+
+func (vk *ValidatorKey) UnmarshalJSON(data []byte) error {
+	var tmp validatorKeyJSON
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	if err := decodeHexInto(tmp.Ed25519, vk.Ed25519Key[:]); err != nil {
+		return fmt.Errorf("ed25519 key: %w", err)
+	}
+	if err := decodeHexInto(tmp.Bandersnatch, vk.BandersnatchKey[:]); err != nil {
+		return fmt.Errorf("bandersnatch key: %w", err)
+	}
+	if err := decodeHexInto(tmp.Bls, vk.BLSKey[:]); err != nil {
+		return fmt.Errorf("bls key: %w", err)
+	}
+	if err := decodeHexInto(tmp.Metadata, vk.Metadata[:]); err != nil {
+		return fmt.Errorf("metadata: %w", err)
+	}
+	return nil
+}
+
+type ticketJSON struct {
+	Attempt   uint32 `json:"attempt"`
+	Signature string `json:"signature"`
+}
+
+func (t Ticket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ticketJSON{Attempt: t.EntryIndex, Signature: encodeHex(t.Proof)})
+}
+
+func (t *Ticket) UnmarshalJSON(data []byte) error {
+	var tmp ticketJSON
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	proof, err := decodeHex(tmp.Signature)
+	if err != nil {
+		return fmt.Errorf("ticket signature: %w", err)
+	}
+	*t = Ticket{EntryIndex: tmp.Attempt, Proof: proof}
+	return nil
+}
+
+type ticketBodyJSON struct {
+	ID      string `json:"id"`
+	Attempt uint32 `json:"attempt"`
+}
+
+func (t TicketBody) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ticketBodyJSON{ID: encodeHex(t.Identifier[:]), Attempt: t.EntryIndex})
+}
+
+func (t *TicketBody) UnmarshalJSON(data []byte) error {
+	var tmp ticketBodyJSON
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	t.EntryIndex = tmp.Attempt
+	if err := decodeHexInto(tmp.ID, t.Identifier[:]); err != nil {
+		return fmt.Errorf("ticket id: %w", err)
+	}
+	return nil
+}
+
+// bandersnatchKeysJSON is a sequence of Bandersnatch keys.
+type bandersnatchKeysJSON []string
+
+func encodeBandersnatchKeys(keys []BandersnatchKey) bandersnatchKeysJSON {
+	encoded := make(bandersnatchKeysJSON, len(keys))
+	for i, key := range keys {
+		encoded[i] = encodeHex(key[:])
+	}
+	return encoded
+}
+
+func (s bandersnatchKeysJSON) decode() ([]BandersnatchKey, error) {
+	keys := make([]BandersnatchKey, len(s))
+	for i, key := range s {
+		if err := decodeHexInto(key, keys[i][:]); err != nil {
+			return nil, fmt.Errorf("bandersnatch key %d: %w", i, err)
+		}
+	}
+	return keys, nil
+}
+
+// TicketsOrKeys is encoded as an object with just the field that is set, so
+// keys are encoded unless tickets are set. When decoding, no keys are nil keys.
+type ticketsOrKeysJSON struct {
+	Tickets *[]TicketBody         `json:"tickets"`
+	Keys    *bandersnatchKeysJSON `json:"keys"`
+}
+
+func (t TicketsOrKeys) MarshalJSON() ([]byte, error) {
+	if t.IsTickets() {
+		return json.Marshal(struct {
+			Tickets []TicketBody `json:"tickets"`
+		}{t.Tickets})
+	}
+	return json.Marshal(struct {
+		Keys bandersnatchKeysJSON `json:"keys"`
+	}{encodeBandersnatchKeys(t.Keys)})
+}
+
+func (t *TicketsOrKeys) UnmarshalJSON(data []byte) error {
+	var tmp ticketsOrKeysJSON
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	switch {
+	case tmp.Tickets != nil && tmp.Keys == nil:
+		*t = TicketsOrKeys{Tickets: *tmp.Tickets}
+	case tmp.Keys != nil && tmp.Tickets == nil:
+		keys, err := tmp.Keys.decode()
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			keys = nil
+		}
+		*t = TicketsOrKeys{Keys: keys}
+	default:
+		return fmt.Errorf("expected exactly one of tickets or keys")
+	}
+	return nil
+}
+
+type epochMarkerJSON struct {
+	Entropy    string               `json:"entropy"`
+	Validators bandersnatchKeysJSON `json:"validators"`
+}
+
+func (em EpochMarker) MarshalJSON() ([]byte, error) {
+	return json.Marshal(epochMarkerJSON{
+		Entropy:    encodeHex(em.EpochRandomness[:]),
+		Validators: encodeBandersnatchKeys(em.ValidatorKeys),
+	})
+}
+
+func (em *EpochMarker) UnmarshalJSON(data []byte) error {
+	var tmp epochMarkerJSON
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	if err := decodeHexInto(tmp.Entropy, em.EpochRandomness[:]); err != nil {
+		return fmt.Errorf("epoch marker entropy: %w", err)
+	}
+	keys, err := tmp.Validators.decode()
+	if err != nil {
+		return err
+	}
+	em.ValidatorKeys = keys
+	return nil
+}
+
+// WinningTickets is encoded as the bare ticket sequence.
+func (wt WinningTickets) MarshalJSON() ([]byte, error) {
+	return json.Marshal(wt.Tickets)
+}
+
+func (wt *WinningTickets) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &wt.Tickets)
+}
+
+var safroleErrorNames = map[SafroleError]string{
+	SafroleErrorBadSlot:          "bad_slot",
+	SafroleErrorUnexpectedTicket: "unexpected_ticket",
+	SafroleErrorBadTicketOrder:   "bad_ticket_order",
+	SafroleErrorBadTicketProof:   "bad_ticket_proof",
+	SafroleErrorBadTicketAttempt: "bad_ticket_attempt",
+	SafroleErrorDuplicateTicket:  "duplicate_ticket",
+}
+
+func (e SafroleError) MarshalText() ([]byte, error) {
+	name, ok := safroleErrorNames[e]
+	if !ok {
+		return nil, e
+	}
+	return []byte(name), nil
+}
+
+func (e *SafroleError) UnmarshalText(text []byte) error {
+	for code, name := range safroleErrorNames {
+		if name == string(text) {
+			*e = code
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown safrole error %q", text)
+}
+
+type safroleInputJSON struct {
+	Slot          uint32   `json:"slot"`
+	Entropy       string   `json:"entropy"`
+	Extrinsics    []Ticket `json:"extrinsics"`
+	PostOffenders []string `json:"post_offenders,omitempty"`
+}
+
+func (in SafroleInput) MarshalJSON() ([]byte, error) {
+	tmp := safroleInputJSON{
+		Slot:       in.Slot,
+		Entropy:    encodeHex(in.Entropy[:]),
+		Extrinsics: in.Extrinsics,
+	}
+	for offender := range in.PostOffenders {
+		tmp.PostOffenders = append(tmp.PostOffenders, encodeHex(offender[:]))
+	}
+	sort.Strings(tmp.PostOffenders)
+	return json.Marshal(tmp)
+}
+
+func (in *SafroleInput) UnmarshalJSON(data []byte) error {
+	var tmp safroleInputJSON
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	in.Slot = tmp.Slot
+	in.Extrinsics = tmp.Extrinsics
+	if err := decodeHexInto(tmp.Entropy, in.Entropy[:]); err != nil {
+		return fmt.Errorf("entropy: %w", err)
+	}
+	in.PostOffenders = nil
+	for i, offender := range tmp.PostOffenders {
+		var key Hash
+		if err := decodeHexInto(offender, key[:]); err != nil {
+			return fmt.Errorf("offender %d: %w", i, err)
+		}
+		if in.PostOffenders == nil {
+			in.PostOffenders = make(map[Hash]struct{})
+		}
+		in.PostOffenders[key] = struct{}{}
+	}
+	return nil
+}
+
+type safroleStateJSON struct {
+	Timeslot           uint32         `json:"timeslot"`
+	Entropy            []string       `json:"entropy"`
+	PrevValidators     []ValidatorKey `json:"prev_validators"`
+	CurrValidators     []ValidatorKey `json:"curr_validators"`
+	NextValidators     []ValidatorKey `json:"next_validators"`
+	DesignedValidators []ValidatorKey `json:"designed_validators"`
+	TicketsAccumulator []TicketBody   `json:"tickets_accumulator"`
+	TicketsOrKeys      TicketsOrKeys  `json:"tickets_or_keys"`
+	TicketsVerifierKey string         `json:"tickets_verifier_key"`
+}
+
+func (s SafroleState) MarshalJSON() ([]byte, error) {
+	tmp := safroleStateJSON{
+		Timeslot:           s.Timeslot,
+		Entropy:            make([]string, len(s.Entropy)),
+		PrevValidators:     s.PrevValidators,
+		CurrValidators:     s.CurrValidators,
+		NextValidators:     s.NextValidators,
+		DesignedValidators: s.DesignedValidators,
+		TicketsAccumulator: s.TicketsAccumulator,
+		TicketsOrKeys:      s.TicketsOrKeys,
+		TicketsVerifierKey: encodeHex(s.TicketsVerifierKey[:]),
+	}
+	for i, entropy := range s.Entropy {
+		tmp.Entropy[i] = encodeHex(entropy[:])
+	}
+	return json.Marshal(tmp)
+}
+
+func (s *SafroleState) UnmarshalJSON(data []byte) error {
+	var tmp safroleStateJSON
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	if len(tmp.Entropy) != len(s.Entropy) {
+		return fmt.Errorf("expected %d entropy values, got %d", len(s.Entropy), len(tmp.Entropy))
+	}
+	for i, entropy := range tmp.Entropy {
+		if err := decodeHexInto(entropy, s.Entropy[i][:]); err != nil {
+			return fmt.Errorf("entropy %d: %w", i, err)
+		}
+	}
+	if err := decodeHexInto(tmp.TicketsVerifierKey, s.TicketsVerifierKey[:]); err != nil {
+		return fmt.Errorf("tickets verifier key: %w", err)
+	}
+
+	s.Timeslot = tmp.Timeslot
+	s.PrevValidators = tmp.PrevValidators
+	s.CurrValidators = tmp.CurrValidators
+	s.NextValidators = tmp.NextValidators
+	s.DesignedValidators = tmp.DesignedValidators
+	s.TicketsAccumulator = tmp.TicketsAccumulator
+	s.TicketsOrKeys = tmp.TicketsOrKeys
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafroleStateJSON(t *testing.T) {
+	validators := []ValidatorKey{{
+		BandersnatchKey: BandersnatchKey{1},
+		Ed25519Key:      Hash{2},
+		BLSKey:          BLSKey{3},
+		Metadata:        Metadata{4},
+	}}
+	testCases := []struct {
+		name  string
+		state SafroleState
+	}{
+		{
+			name: "Keys",
+			state: SafroleState{
+				Timeslot:           5,
+				Entropy:            [4][32]byte{{6}, {7}, {8}, {9}},
+				PrevValidators:     validators,
+				CurrValidators:     validators,
+				NextValidators:     []ValidatorKey{},
+				DesignedValidators: validators,
+				TicketsAccumulator: []TicketBody{{Identifier: Hash{10}, EntryIndex: 1}},
+				TicketsOrKeys:      TicketsOrKeys{Keys: []BandersnatchKey{{11}}},
+				TicketsVerifierKey: [384]byte{12},
+			},
+		},
+		{
+			name: "Tickets",
+			state: SafroleState{
+				PrevValidators:     []ValidatorKey{},
+				CurrValidators:     []ValidatorKey{},
+				NextValidators:     []ValidatorKey{},
+				DesignedValidators: []ValidatorKey{},
+				TicketsAccumulator: []TicketBody{},
+				TicketsOrKeys:      TicketsOrKeys{Tickets: []TicketBody{{Identifier: Hash{13}}}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(tc.state)
+			assert.NoError(t, err)
+
+			var decoded SafroleState
+			assert.NoError(t, json.Unmarshal(data, &decoded))
+			assert.Equal(t, tc.state, decoded)
+		})
+	}
+}
+
+func TestTicketsOrKeysJSON(t *testing.T) {
+	testCases := []struct {
+		name    string
+		value   TicketsOrKeys
+		encoded string
+	}{
+		{"Zero value", TicketsOrKeys{}, `{"keys":[]}`},
+		{"No keys", TicketsOrKeys{Keys: nil}, `{"keys":[]}`},
+		{"No tickets", TicketsOrKeys{Tickets: []TicketBody{}}, `{"tickets":[]}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(tc.value)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.encoded, string(data))
+
+			var decoded TicketsOrKeys
+			assert.NoError(t, json.Unmarshal(data, &decoded))
+			assert.Equal(t, tc.value, decoded)
+		})
+	}
+
+	t.Run("Zero safrole state", func(t *testing.T) {
+		data, err := json.Marshal(SafroleState{})
+		assert.NoError(t, err)
+
+		var decoded SafroleState
+		assert.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, SafroleState{}, decoded)
+	})
+}
+
+func TestSafroleTestCaseJSON(t *testing.T) {
+	hash := func(b byte) string {
+		return fmt.Sprintf("0x%064x", b)
+	}
+
+	var ok SafroleTestCase
+	data := `{
+		"input": {"slot": 3, "entropy": "` + hash(1) + `", "extrinsics": [{"attempt": 1, "signature": "0x0203"}], "post_offenders": ["` + hash(6) + `"]},
+		"output": {"ok": {"epoch_mark": {"entropy": "` + hash(4) + `", "validators": ["` + hash(5) + `"]}, "tickets_mark": null}}
+	}`
+	assert.NoError(t, json.Unmarshal([]byte(data), &ok))
+	assert.Equal(t, SafroleInput{
+		Slot:          3,
+		Entropy:       Hash{31: 1},
+		Extrinsics:    []Ticket{{EntryIndex: 1, Proof: []byte{2, 3}}},
+		PostOffenders: map[Hash]struct{}{{31: 6}: {}},
+	}, ok.Input)
+	assert.Nil(t, ok.Output.Err)
+	assert.Equal(t, &EpochMarker{EpochRandomness: Hash{31: 4}, ValidatorKeys: []BandersnatchKey{{31: 5}}}, ok.Output.Ok.EpochMark)
+	assert.Nil(t, ok.Output.Ok.TicketsMark)
+
+	var failed SafroleTestCase
+	data = `{"output": {"err": "bad_ticket_order"}}`
+	assert.NoError(t, json.Unmarshal([]byte(data), &failed))
+	assert.Equal(t, SafroleErrorBadTicketOrder, *failed.Output.Err)
+}
+
+func TestJSONErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		data  string
+		value interface{}
+		err   string
+	}{
+		{"Unknown error", `"bad_everything"`, new(SafroleError), `unknown safrole error "bad_everything"`},
+		{"Tickets and keys", `{"tickets": [], "keys": []}`, new(TicketsOrKeys), "expected exactly one of tickets or keys"},
+		{"Neither tickets nor keys", `{}`, new(TicketsOrKeys), "expected exactly one of tickets or keys"},
+		{"Short ticket id", `{"id": "0x01", "attempt": 0}`, new(TicketBody), "ticket id: expected 32 bytes of hex, got 1"},
+		{"Invalid hex", `{"attempt": 0, "signature": "0xzz"}`, new(Ticket), "ticket signature: encoding/hex: invalid byte: U+007A 'z'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.EqualError(t, json.Unmarshal([]byte(tc.data), tc.value), tc.err)
+		})
+	}
+}
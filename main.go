@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"os"
+	"slices"
+	"sort"
 
 	"golang.org/x/crypto/blake2b"
-	"golang.org/x/crypto/sha3"
 )
 
 // Header
@@ -48,6 +51,22 @@ func ValidateHeader(h *Header, currentTime uint64, parentHeader *Header, config
 		return false
 	}
 
+	// Validate markers, as an epoch marker is present in exactly the first
+	// block of an epoch and winning tickets only in the first block past the
+	// ticket submission end slot
+	if parentHeader != nil {
+		newEpoch := h.TimeSlot/config.SlotsPerEpoch > parentHeader.TimeSlot/config.SlotsPerEpoch
+		if newEpoch != (h.EpochMarker != nil) {
+			return false
+		}
+		submissionEnded := !newEpoch &&
+			parentHeader.TimeSlot%config.SlotsPerEpoch < config.TicketSubmissionEnd &&
+			h.TimeSlot%config.SlotsPerEpoch >= config.TicketSubmissionEnd
+		if h.WinningTickets != nil && !submissionEnded {
+			return false
+		}
+	}
+
 	// Validate epoch marker
 	if h.EpochMarker != nil {
 		if len(h.EpochMarker.EpochRandomness) != HashSize {
@@ -90,23 +109,28 @@ func ValidateHeader(h *Header, currentTime uint64, parentHeader *Header, config
 	return true
 }
 
+// CalculateStateRoot merklizes the state into the root committed to by
+// headers.
 func CalculateStateRoot(state *State) Hash {
-	// TODO: calculate a Merkle root of the entire state.
-	serializedState := state.Serialize()
-	return blake2b.Sum256(serializedState)
-
+	return MerkleRoot(state.StateKeyValues())
 }
 
-func CalculateBeefyMMRRoot(beta []struct {
+// ValidateAnchor reports whether a refinement context is anchored at a recent
+// block, with that block's state root and BEEFY root: the super-peak of its
+// accumulation-result MMR.
+func ValidateAnchor(context RefinementContext, beta []struct {
 	HeaderHash       Hash
-	AccumulationRoot Hash
+	AccumulationMMR  MMR
 	StateRoot        Hash
 	WorkReportHashes []Hash
-}) Hash {
-	// TODO: calculate the Merkle Mountain Range root of the beta.
-	serializedBeta := SerializeBeta(beta)
-	return sha3.Sum256(serializedBeta)
-
+}) bool {
+	for _, block := range beta {
+		if block.HeaderHash == context.AnchorHash {
+			return block.StateRoot == context.AnchorStateRoot &&
+				block.AccumulationMMR.SuperPeak() == context.AnchorBeefyRoot
+		}
+	}
+	return false
 }
 
 func ValidateBandersnatchSignature(sig BandersnatchSignature) bool {
@@ -115,10 +139,18 @@ func ValidateBandersnatchSignature(sig BandersnatchSignature) bool {
 }
 
 type Config struct {
-	ValidatorCount uint32
-	SlotsPerEpoch  uint32
+	ValidatorCount      uint32
+	SlotsPerEpoch       uint32
+	TicketSubmissionEnd uint32 // The slot of an epoch from which tickets are no longer accepted
 }
 
+// FullConfig and TinyConfig are the parameters of the full protocol and of
+// the tiny network used by test vectors.
+var (
+	FullConfig = Config{ValidatorCount: 1023, SlotsPerEpoch: EpochLength, TicketSubmissionEnd: TicketSubmissionEnd}
+	TinyConfig = Config{ValidatorCount: 6, SlotsPerEpoch: 12, TicketSubmissionEnd: 10}
+)
+
 // Safrole, Block production, Chain Growth
 
 type SafroleState struct {
@@ -128,84 +160,111 @@ type SafroleState struct {
 	CurrValidators     []ValidatorKey
 	NextValidators     []ValidatorKey
 	DesignedValidators []ValidatorKey
-	TicketsAccumulator []Ticket
+	TicketsAccumulator []TicketBody
 	TicketsOrKeys      TicketsOrKeys
 	TicketsVerifierKey [384]byte
 }
 
+// TicketsOrKeys is the sealing-key series of an epoch (γ_s): the tickets of
+// a full accumulator in outside-in order or, as a fallback, Bandersnatch keys.
+// Exactly one of Tickets and Keys is set.
 type TicketsOrKeys struct {
-	Keys []BandersnatchKey
+	Tickets []TicketBody
+	Keys    []BandersnatchKey
+}
+
+// IsTickets reports whether the epoch is sealed with tickets.
+func (t TicketsOrKeys) IsTickets() bool {
+	return t.Tickets != nil
 }
 
-func ProcessSafroleTransition(input SafroleInput, preState SafroleState) (SafroleOutput, error) {
+func ProcessSafroleTransition(input SafroleInput, preState SafroleState, config *Config) (SafroleOutput, error) {
+	if input.Slot <= preState.Timeslot {
+		return SafroleOutput{}, SafroleErrorBadSlot
+	}
+	newEpoch := input.Slot/config.SlotsPerEpoch > preState.Timeslot/config.SlotsPerEpoch
+	previousSlot := preState.Timeslot
+
 	// Update timeslot
 	preState.Timeslot = input.Slot
 
-	// Update entropy
-	newEntropy := input.Entropy
-	preState.Entropy[3] = preState.Entropy[2]
-	preState.Entropy[2] = preState.Entropy[1]
-	preState.Entropy[1] = preState.Entropy[0]
-	copy(preState.Entropy[0][:], newEntropy[:])
-
-	// Process tickets
-	for _, ticket := range input.Extrinsics {
-		// TODO: In a real implementation, we would verify the ticket here
-		// For now, we'll just add it to the accumulator
-		preState.TicketsAccumulator = append(preState.TicketsAccumulator, ticket)
+	// Update entropy, accumulating the block's entropy into η0 and rotating
+	// the snapshots of it on a new epoch
+	accumulated := blake2b.Sum256(append(preState.Entropy[0][:], input.Entropy[:]...))
+	if newEpoch {
+		preState.Entropy[3] = preState.Entropy[2]
+		preState.Entropy[2] = preState.Entropy[1]
+		preState.Entropy[1] = preState.Entropy[0]
 	}
+	preState.Entropy[0] = accumulated
 
 	// Check if we need to update epoch
-	if input.Slot%600 == 0 {
+	if newEpoch {
 		// Rotate validators
 		preState.PrevValidators = preState.CurrValidators
 		preState.CurrValidators = preState.NextValidators
-		preState.NextValidators = preState.DesignedValidators
+		preState.NextValidators = FilterOffenders(preState.DesignedValidators, input.PostOffenders)
+		preState.TicketsVerifierKey = CalculateBandersnatchRingCommitment(BandersnatchKeys(preState.NextValidators))
+
+		// Generate new seal keys, from the accumulator of the last epoch
+		preState.TicketsOrKeys = generateNewSealKeys(preState, previousSlot, input.Slot, config)
 
 		// Reset tickets accumulator
-		preState.TicketsAccumulator = []Ticket{}
-
-		// Generate new seal keys
-		preState.TicketsOrKeys.Keys = generateNewSealKeys(preState)
-
-		return SafroleOutput{
-			Ok: struct {
-				EpochMark   interface{}
-				TicketsMark interface{}
-			}{
-				EpochMark:   generateEpochMark(preState),
-				TicketsMark: generateTicketsMark(preState),
-			},
-			State: &preState,
-		}, nil
-	}
-
-	// If it's not a new epoch, return null marks
-	return SafroleOutput{
-		Ok: struct {
-			EpochMark   interface{}
-			TicketsMark interface{}
-		}{
-			EpochMark:   nil,
-			TicketsMark: nil,
-		},
-		State: &preState,
-	}, nil
-}
+		preState.TicketsAccumulator = []TicketBody{}
+	}
 
-func generateNewSealKeys(state SafroleState) []BandersnatchKey {
-	// TODO
-	return state.TicketsOrKeys.Keys
+	// Process tickets, which are made for the ring of the next validators
+	ringKeys := BandersnatchKeys(preState.NextValidators)
+	accumulator, err := AccumulateTickets(preState.TicketsAccumulator, input.Extrinsics, ringKeys, preState.Entropy[2], input.Slot, config)
+	if err != nil {
+		return SafroleOutput{}, err
+	}
+	preState.TicketsAccumulator = accumulator
+
+	output := SafroleOutput{State: &preState}
+	if newEpoch {
+		output.Ok.EpochMark = generateEpochMark(preState)
+	} else {
+		output.Ok.TicketsMark = generateTicketsMark(preState, previousSlot, config)
+	}
+	return output, nil
+}
+
+// generateNewSealKeys returns the sealing keys of the epoch starting at slot.
+// Tickets are only used if the accumulator was filled by the end of the
+// submission period of the epoch just before; otherwise the keys fall back
+// to the new active validators.
+func generateNewSealKeys(state SafroleState, previousSlot, slot uint32, config *Config) TicketsOrKeys {
+	if slot/config.SlotsPerEpoch == previousSlot/config.SlotsPerEpoch+1 &&
+		previousSlot%config.SlotsPerEpoch >= config.TicketSubmissionEnd &&
+		len(state.TicketsAccumulator) == int(config.SlotsPerEpoch) {
+		return TicketsOrKeys{Tickets: OutsideInSequence(state.TicketsAccumulator)}
+	}
+	return TicketsOrKeys{Keys: FallbackSealKeys(state.Entropy[2], state.CurrValidators, config)}
 }
 
-func generateEpochMark(state SafroleState) interface{} {
-	// TODO
-	return nil
+// generateEpochMark announces, in the first block of an epoch, the entropy
+// of the epoch before and the Bandersnatch keys of the next validators.
+func generateEpochMark(state SafroleState) *EpochMarker {
+	mark := &EpochMarker{
+		EpochRandomness: state.Entropy[1],
+		ValidatorKeys:   make([]BandersnatchKey, len(state.NextValidators)),
+	}
+	for i, validatorKey := range state.NextValidators {
+		mark.ValidatorKeys[i] = validatorKey.BandersnatchKey
+	}
+	return mark
 }
 
-func generateTicketsMark(state SafroleState) interface{} {
-	// TODO
-	return nil
+// generateTicketsMark announces the ticket sequence sealing the next epoch in
+// the first block past the submission end slot, if the accumulator is full.
+func generateTicketsMark(state SafroleState, previousSlot uint32, config *Config) *WinningTickets {
+	if previousSlot%config.SlotsPerEpoch >= config.TicketSubmissionEnd ||
+		state.Timeslot%config.SlotsPerEpoch < config.TicketSubmissionEnd ||
+		len(state.TicketsAccumulator) != int(config.SlotsPerEpoch) {
+		return nil
+	}
+	return &WinningTickets{Tickets: OutsideInSequence(state.TicketsAccumulator)}
 }
 
 // TODO: May not be included in main protocol
@@ -213,31 +272,36 @@ type SafroleInput struct {
 	Slot       uint32
 	Entropy    [32]byte
 	Extrinsics []Ticket
+
+	// PostOffenders is the Ed25519 keys of the judgements punish set after
+	// the block's judgements, which are removed from an incoming validator set
+	PostOffenders map[Hash]struct{}
 }
 
 type SafroleOutput struct {
 	Ok struct {
-		EpochMark   interface{}
-		TicketsMark interface{}
+		EpochMark   *EpochMarker    `json:"epoch_mark"`
+		TicketsMark *WinningTickets `json:"tickets_mark"`
+	} `json:"ok"`
+	State *SafroleState `json:"-"`
+}
+
+func ValidateBlockSeal(header *Header, state *SafroleState, config *Config) bool {
+	// Verify the seal using the sealing key of the header's slot
+	slot := header.TimeSlot % config.SlotsPerEpoch
+	var sealKey BandersnatchKey
+	if state.TicketsOrKeys.IsTickets() {
+		if int(slot) >= len(state.TicketsOrKeys.Tickets) || int(header.AuthorKey) >= len(state.CurrValidators) {
+			return false
+		}
+		// TODO: Check the seal's VRF output is the identifier of the slot's ticket
+		sealKey = state.CurrValidators[header.AuthorKey].BandersnatchKey
+	} else {
+		if int(slot) >= len(state.TicketsOrKeys.Keys) {
+			return false
+		}
+		sealKey = state.TicketsOrKeys.Keys[slot]
 	}
-	State *SafroleState
-}
-
-// TODO
-func GenerateSealKeySequence(state *SafroleState, epoch uint32) []BandersnatchKey {
-	// Use the epoch and state to deterministically generate seal keys
-	var keys []BandersnatchKey
-	// for i := uint32(0); i < 600; i++ { // 600 slots per epoch
-	// 	hash := sha256.Sum256(append(state.EpochRoot[:], binary.BigEndian.AppendUint32(nil, epoch)...))
-	// 	keys = append(keys, BandersnatchKey(hash))
-	// }
-	return keys
-}
-
-func ValidateBlockSeal(header *Header, state *SafroleState) bool {
-	// Verify the seal using the appropriate sealing key
-	sealKeys := GenerateSealKeySequence(state, header.TimeSlot/600) // Assuming 600 slots per epoch
-	sealKey := sealKeys[header.TimeSlot%600]
 	return VerifyBandersnatchSignature(sealKey, header.Serialize(false), header.Seal)
 }
 
@@ -283,28 +347,39 @@ type ServiceAccount struct {
 	}][]uint32
 	CodeHash           Hash
 	Balance            uint64
-	AccumulateGasLimit int64
-	OnTransferGasLimit int64
+	AccumulateGasLimit uint64
+	OnTransferGasLimit uint64
 	Code               []byte
 }
 
+// HistoricalLookup returns the preimage of preimageHash if it was available
+// at timeSlot, according to the availability windows in its metadata.
 func (sa *ServiceAccount) HistoricalLookup(timeSlot uint32, preimageHash Hash) ([]byte, bool) {
+	data, exists := sa.PreimageLookup[preimageHash]
+	if !exists {
+		return nil, false
+	}
 	meta, exists := sa.PreimageMeta[struct {
 		Hash
 		Length uint32
-	}{preimageHash, 0}] // TODO: Length 0 as a placeholder
+	}{preimageHash, uint32(len(data))}]
 	if !exists {
 		return nil, false
 	}
 
-	for i := len(meta) - 1; i >= 0; i-- {
-		if meta[i] <= timeSlot {
-			data, exists := sa.PreimageLookup[preimageHash]
-			return data, exists
-		}
+	var available bool
+	switch len(meta) {
+	case 1:
+		available = meta[0] <= timeSlot
+	case 2:
+		available = meta[0] <= timeSlot && timeSlot < meta[1]
+	case 3:
+		available = meta[0] <= timeSlot && timeSlot < meta[1] || meta[2] <= timeSlot
 	}
-
-	return nil, false
+	if !available {
+		return nil, false
+	}
+	return data, true
 }
 
 func (sa *ServiceAccount) CalculateAccountFootprint() (items uint32, octets uint64) {
@@ -418,6 +493,42 @@ type WorkResult struct {
 	Output       []byte
 }
 
+// WorkError is produced by a work item in place of output. Its value is the
+// type its work output is serialized with.
+type WorkError uint32
+
+const (
+	WorkErrorOutOfGas   WorkError = 1 // ∞
+	WorkErrorPanic      WorkError = 2 // ☇, including page faults
+	WorkErrorBadCode    WorkError = 3 // BAD: the service code is not available
+	WorkErrorCodeTooBig WorkError = 4 // BIG: the service code exceeds MaxServiceCodeSize
+)
+
+const MaxServiceCodeSize = 4_000_000 // W_C, in octets
+
+func (e WorkError) Error() string {
+	switch e {
+	case WorkErrorOutOfGas:
+		return "out of gas"
+	case WorkErrorPanic:
+		return "panic"
+	case WorkErrorBadCode:
+		return "service code not available"
+	case WorkErrorCodeTooBig:
+		return "service code too big"
+	}
+	return fmt.Sprintf("work error %d", uint32(e))
+}
+
+// workErrorFor returns the work error for a guest that exited without
+// halting.
+func workErrorFor(exitReason ExitReason) WorkError {
+	if exitReason == ExitOOG {
+		return WorkErrorOutOfGas
+	}
+	return WorkErrorPanic
+}
+
 func ProcessAvailabilityAssurances(rho []WorkReportState, assurances []Assurance) ([]WorkReportState, []WorkReport) {
 	var availableReports []WorkReport
 	newRho := make([]WorkReportState, len(rho))
@@ -492,11 +603,26 @@ func ComputeAvailabilitySpecifier(packageHash Hash, auditBundle []byte, exported
 
 // Guaranteeing
 
+// EvaluateWorkPackage checks that a work package may be guaranteed on core
+// and returns its report with the authorizer's output. Its work items are not
+// refined here, so the report has no results.
 func EvaluateWorkPackage(workPackage WorkPackage, core uint32, state State) (WorkReport, error) {
-	// TODO
-	// Evaluate a work package and generate a work report
+	// Only packages whose authorizer is in the core's pool and approves them
+	// may be guaranteed
+	authorizerHash := workPackage.AuthorizerHash()
+	if core >= uint32(len(state.Alpha)) || !slices.Contains(state.Alpha[core], authorizerHash) {
+		return WorkReport{}, errors.New("authorizer not in pool")
+	}
+	output, err := IsAuthorized(workPackage, core, state)
+	if err != nil {
+		return WorkReport{}, fmt.Errorf("work package not authorized: %w", err)
+	}
 
-	return WorkReport{}, nil
+	return WorkReport{
+		AuthorizerHash: authorizerHash,
+		Output:         output,
+		Context:        workPackage.Context,
+	}, nil
 }
 
 // TODO: Implement signature types
@@ -543,7 +669,7 @@ type State struct {
 	// β: Recent history information
 	Beta []struct {
 		HeaderHash       Hash
-		AccumulationRoot Hash
+		AccumulationMMR  MMR
 		StateRoot        Hash
 		WorkReportHashes []Hash
 	}
@@ -551,9 +677,9 @@ type State struct {
 	// γ: Safrole consensus state
 	Gamma struct {
 		ValidatorKeys     []ValidatorKey
-		EpochRoot         Hash
-		SlotSealers       []Ticket
-		TicketAccumulator []Ticket
+		EpochRoot         [384]byte // Ring commitment to the Bandersnatch keys of ValidatorKeys
+		SlotSealers       TicketsOrKeys
+		TicketAccumulator []TicketBody
 	}
 
 	// δ: Service accounts
@@ -652,7 +778,7 @@ type EpochMarker struct {
 }
 
 type WinningTickets struct {
-	Tickets []Ticket
+	Tickets []TicketBody
 }
 
 // ValidatorKey represents the set of keys associated with a validator
@@ -682,38 +808,112 @@ type WorkReportState struct {
 }
 
 // Service Account Entry Points
+const (
+	RefineEntryPoint     = 0
+	AccumulateEntryPoint = 1
+	OnTransferEntryPoint = 2
+)
 
 // 1. Refine Entry Point
-// This is executed in-core and is essentially stateless
-func (sa *ServiceAccount) Refine(input []byte, context RefinementContext) ([]byte, error) {
-	// Execute the refine logic
-	result, err := ExecutePVM(sa.Code, 0, input, context)
+// This is executed in-core and is essentially stateless. It receives the
+// segments imported by the work item and returns the segments it exported.
+// The service accounts of δ are available to historical lookups.
+// If the work item produces no output, the error is the WorkError to report
+// in its place; any other error is a failure of the host.
+func (sa *ServiceAccount) Refine(input []byte, context RefinementContext, gasLimit uint64, accounts map[uint32]ServiceAccount, imports [][]byte, exportOffset uint32) ([]byte, [][]byte, error) {
+	if len(sa.Code) == 0 {
+		return nil, nil, WorkErrorBadCode
+	}
+	if len(sa.Code) > MaxServiceCodeSize {
+		return nil, nil, WorkErrorCodeTooBig
+	}
+
+	args := append(SerializeVarOctetSequence(input), context.Serialize()...)
+	pvm, err := NewStandardPVM(sa.Code, RefineEntryPoint, args, gasLimit)
+	if err != nil {
+		// Code that is not a valid program panics
+		return nil, nil, WorkErrorPanic
+	}
+
+	host := &RefineHost{
+		Service:      sa,
+		Accounts:     accounts,
+		Timeslot:     context.LookupAnchorTimeSlot,
+		Imports:      imports,
+		ExportOffset: exportOffset,
+	}
+	exitReason, _, _, err := pvm.ExecuteWithHost(host)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return result.([]byte), nil
+	output, err := pvm.output(exitReason)
+	if err != nil {
+		return nil, nil, err
+	}
+	return output, host.Exports, nil
 }
 
 // 2. Accumulate Entry Point
-// This is executed on-chain and is stateful
-func (sa *ServiceAccount) Accumulate(state State, input []byte) (State, error) {
-	// Execute the accumulate logic
-	result, err := ExecutePVM(sa.Code, 1, state, input)
+// This is executed on-chain and is stateful. State changes are made through
+// the accumulate host calls; if the invocation does not halt, the context as
+// of the last checkpoint is kept instead. Transfers made by the service are
+// returned to be delivered once all accumulation is done, along with the hash
+// it yielded, if any.
+func (sa *ServiceAccount) Accumulate(state State, serviceIndex uint32, input []byte) (State, []DeferredTransfer, *Hash, error) {
+	host := NewAccumulateHost(&state, serviceIndex)
+	if len(sa.Code) > MaxServiceCodeSize {
+		return host.Exceptional.Apply(state), nil, nil, nil
+	}
+	pvm, err := NewStandardPVM(sa.Code, AccumulateEntryPoint, SerializeVarOctetSequence(input), sa.AccumulateGasLimit)
 	if err != nil {
-		return state, err
+		// Code that is not a valid program panics
+		return host.Exceptional.Apply(state), nil, nil, nil
+	}
+
+	exitReason, _, _, err := pvm.ExecuteWithHost(host)
+	if err != nil {
+		return state, nil, nil, err
+	}
+	ctx := host.Exceptional
+	if exitReason == ExitHalt {
+		ctx = host.Regular
 	}
-	return result.(State), nil
+	return ctx.Apply(state), ctx.Transfers, ctx.Yield, nil
 }
 
 // 3. OnTransfer Entry Point
-// This is executed on-chain and is stateful
-func (sa *ServiceAccount) OnTransfer(state State, from uint32, to uint32, amount uint64, memo []byte) (State, error) {
-	// Execute the on_transfer logic
-	result, err := ExecutePVM(sa.Code, 2, state, from, to, amount, memo)
+// This is executed on-chain and is stateful. The receiver's balance has
+// already been credited; the invocation may only modify its own storage, and
+// its changes are discarded if it does not halt. It is not invoked when the
+// transfers carry no gas.
+func (sa *ServiceAccount) OnTransfer(state State, serviceIndex uint32, transfers []DeferredTransfer) (State, error) {
+	args := SerializeNatural(uint64(len(transfers)))
+	var gasLimit uint64
+	for _, transfer := range transfers {
+		args = append(args, transfer.Serialize()...)
+		gasLimit += transfer.GasLimit
+	}
+
+	if gasLimit == 0 {
+		return state, nil
+	}
+
+	pvm, err := NewStandardPVM(sa.Code, OnTransferEntryPoint, args, gasLimit)
+	if err != nil {
+		// Code that is not a valid program does not halt, so there are no
+		// changes to keep
+		return state, nil
+	}
+
+	host := &OnTransferHost{*NewAccumulateHost(&state, serviceIndex)}
+	exitReason, _, _, err := pvm.ExecuteWithHost(host)
 	if err != nil {
 		return state, err
 	}
-	return result.(State), nil
+	if exitReason == ExitHalt {
+		state.Delta = host.Regular.Accounts
+	}
+	return state, nil
 }
 
 // Main protocol entry point
@@ -721,11 +921,6 @@ func ProcessBlock(block Block, state State) (State, error) {
 	var err error
 
 	// Process extrinsics
-	state, err = ProcessTickets(block.Extrinsics.Tickets, state)
-	if err != nil {
-		return state, fmt.Errorf("processing tickets: %w", err)
-	}
-
 	state, err = ProcessJudgements(block.Extrinsics.Judgements, state)
 	if err != nil {
 		return state, fmt.Errorf("processing judgements: %w", err)
@@ -736,7 +931,7 @@ func ProcessBlock(block Block, state State) (State, error) {
 		return state, fmt.Errorf("processing preimages: %w", err)
 	}
 
-	state, err = ProcessAssurances(block.Extrinsics.Assurances, state)
+	state, transfers, yields, err := ProcessAssurances(block.Extrinsics.Assurances, state)
 	if err != nil {
 		return state, fmt.Errorf("processing assurances: %w", err)
 	}
@@ -746,42 +941,57 @@ func ProcessBlock(block Block, state State) (State, error) {
 
 	// Accumulate work reports
 	for _, report := range availableReports {
-		state, err = AccumulateWorkReport(report, state)
+		var reportTransfers []DeferredTransfer
+		var reportYields map[uint32]Hash
+		state, reportTransfers, reportYields, err = AccumulateWorkReport(report, state)
 		if err != nil {
 			return state, fmt.Errorf("accumulating work report: %w", err)
 		}
+		transfers = append(transfers, reportTransfers...)
+		for service, yield := range reportYields {
+			yields[service] = yield
+		}
+	}
+
+	// Deliver the transfers made during accumulation
+	state, err = ProcessTransfers(transfers, state)
+	if err != nil {
+		return state, fmt.Errorf("processing transfers: %w", err)
 	}
 
 	// Update state based on block header
-	state, err = UpdateStateFromHeader(block.Header, state)
+	accumulationRoot := AccumulationRoot(yields)
+	workPackageHashes := make([]Hash, len(block.Extrinsics.Guarantees))
+	for i, guarantee := range block.Extrinsics.Guarantees {
+		workPackageHashes[i] = guarantee.WorkReport.PackageSpec.PackageHash
+	}
+	state, err = UpdateStateFromHeader(block.Header, state, accumulationRoot, workPackageHashes)
 	if err != nil {
 		return state, fmt.Errorf("updating state from header: %w", err)
 	}
 
+	// Tickets are processed after any epoch rotation, against the new ring and
+	// entropy
+	state, err = ProcessTickets(block.Extrinsics.Tickets, state, block.Header.TimeSlot)
+	if err != nil {
+		return state, fmt.Errorf("processing tickets: %w", err)
+	}
+
 	return state, nil
 }
 
-func ProcessTickets(tickets []Ticket, state State) (State, error) {
-	// Extract BandersnatchKeys from ValidatorKeys
-	bandersnatchKeys := make([]BandersnatchKey, len(state.Kappa))
-	for i, validatorKey := range state.Kappa {
+func ProcessTickets(tickets []Ticket, state State, timeSlot uint32) (State, error) {
+	// Tickets are made for the ring of the next epoch's validators
+	bandersnatchKeys := make([]BandersnatchKey, len(state.Gamma.ValidatorKeys))
+	for i, validatorKey := range state.Gamma.ValidatorKeys {
 		bandersnatchKeys[i] = validatorKey.BandersnatchKey
 	}
 
-	for _, ticket := range tickets {
-		// Verify the ticket
-		valid, vrfOutput := VerifyBandersnatchRingVRFProof(bandersnatchKeys, state.Eta[2][:], ticket.Proof)
-		if !valid {
-			continue
-		}
-		// Add valid ticket to the accumulator
-		state.Gamma.TicketAccumulator = append(state.Gamma.TicketAccumulator, Ticket{
-			EntryIndex: ticket.EntryIndex,
-			Proof:      vrfOutput,
-		})
+	accumulator, err := AccumulateTickets(state.Gamma.TicketAccumulator, tickets, bandersnatchKeys, state.Eta[2], timeSlot, &FullConfig)
+	if err != nil {
+		return state, err
 	}
-
-	// TODO: Implement sorting and trimming logic for the accumulator
+	state.Gamma.TicketAccumulator = accumulator
 
 	return state, nil
 }
@@ -822,24 +1032,34 @@ func ProcessPreimages(preimages []Preimage, state State) (State, error) {
 	return state, nil
 }
 
-func ProcessAssurances(assurances []Assurance, state State) (State, error) {
+func ProcessAssurances(assurances []Assurance, state State) (State, []DeferredTransfer, map[uint32]Hash, error) {
 	newRho, availableReports := ProcessAvailabilityAssurances(state.Rho, assurances)
 	state.Rho = newRho
 	// Process available reports
+	var transfers []DeferredTransfer
+	yields := make(map[uint32]Hash)
 	for _, report := range availableReports {
-		state, err := AccumulateWorkReport(report, state)
+		var reportTransfers []DeferredTransfer
+		var reportYields map[uint32]Hash
+		var err error
+		state, reportTransfers, reportYields, err = AccumulateWorkReport(report, state)
 		if err != nil {
-			return state, fmt.Errorf("accumulating work report: %w", err)
+			return state, transfers, yields, fmt.Errorf("accumulating work report: %w", err)
+		}
+		transfers = append(transfers, reportTransfers...)
+		for service, yield := range reportYields {
+			yields[service] = yield
 		}
 	}
-	return state, nil
+	return state, transfers, yields, nil
 }
 
 func ProcessGuarantees(guarantees []Guarantee, state State) ([]WorkReport, State) {
 	var availableReports []WorkReport
 	for _, guarantee := range guarantees {
-		// Verify guarantee signatures
-		if !VerifyGuarantee(guarantee, state) {
+		// Verify guarantee signatures, and that the report is anchored at a
+		// recent block
+		if !VerifyGuarantee(guarantee, state) || !ValidateAnchor(guarantee.WorkReport.Context, state.Beta) {
 			continue
 		}
 		// Add to Rho if core is free or timed out
@@ -856,67 +1076,107 @@ func ProcessGuarantees(guarantees []Guarantee, state State) ([]WorkReport, State
 	return availableReports, state
 }
 
-func AccumulateWorkReport(report WorkReport, state State) (State, error) {
+func AccumulateWorkReport(report WorkReport, state State) (State, []DeferredTransfer, map[uint32]Hash, error) {
+	var transfers []DeferredTransfer
+	yields := make(map[uint32]Hash)
 	for _, result := range report.Results {
 		service, exists := state.Delta[result.ServiceIndex]
 		if !exists {
-			return state, fmt.Errorf("service %d not found", result.ServiceIndex)
+			return state, transfers, yields, fmt.Errorf("service %d not found", result.ServiceIndex)
 		}
-		newState, err := service.Accumulate(state, result.Output)
+		newState, serviceTransfers, yield, err := service.Accumulate(state, result.ServiceIndex, result.Output)
 		if err != nil {
-			return state, fmt.Errorf("accumulating for service %d: %w", result.ServiceIndex, err)
+			return state, transfers, yields, fmt.Errorf("accumulating for service %d: %w", result.ServiceIndex, err)
+		}
+		state = newState
+		transfers = append(transfers, serviceTransfers...)
+		if yield != nil {
+			yields[result.ServiceIndex] = *yield
+		}
+	}
+	return state, transfers, yields, nil
+}
+
+// ProcessTransfers delivers the transfers made during accumulation. Each
+// receiver, in order of service index, is credited with the total amount and
+// its on_transfer entry point is invoked once with all of its transfers,
+// ordered by sender and then by the order in which they were made.
+func ProcessTransfers(transfers []DeferredTransfer, state State) (State, error) {
+	sorted := append([]DeferredTransfer{}, transfers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Sender < sorted[j].Sender
+	})
+
+	byReceiver := make(map[uint32][]DeferredTransfer)
+	var receivers []uint32
+	for _, transfer := range sorted {
+		if _, exists := byReceiver[transfer.Receiver]; !exists {
+			receivers = append(receivers, transfer.Receiver)
+		}
+		byReceiver[transfer.Receiver] = append(byReceiver[transfer.Receiver], transfer)
+	}
+	sort.Slice(receivers, func(i, j int) bool { return receivers[i] < receivers[j] })
+
+	for _, receiver := range receivers {
+		service, exists := state.Delta[receiver]
+		if !exists {
+			// The receiver quit after the transfers were made
+			continue
+		}
+		for _, transfer := range byReceiver[receiver] {
+			service.Balance += transfer.Amount
+		}
+		state.Delta[receiver] = service
+		if len(service.Code) == 0 {
+			continue
+		}
+
+		newState, err := service.OnTransfer(state, receiver, byReceiver[receiver])
+		if err != nil {
+			return state, fmt.Errorf("on transfer for service %d: %w", receiver, err)
 		}
 		state = newState
 	}
 	return state, nil
 }
 
-func UpdateStateFromHeader(header Header, state State) (State, error) {
+func UpdateStateFromHeader(header Header, state State, accumulationRoot Hash, workPackageHashes []Hash) (State, error) {
 	// Update time (τ)
+	previousSlot := state.Tau
 	state.Tau = header.TimeSlot
 
 	// Update recent history (β)
-	newBeta := struct {
-		HeaderHash       Hash
-		AccumulationRoot Hash
-		StateRoot        Hash
-		WorkReportHashes []Hash
-	}{
-		HeaderHash: sha256.Sum256(header.Serialize(true)),
-		StateRoot:  header.StateRoot,
-		// Accumulation root and work report hashes would be calculated elsewhere
-	}
-	state.Beta = append([]struct {
-		HeaderHash       Hash
-		AccumulationRoot Hash
-		StateRoot        Hash
-		WorkReportHashes []Hash
-	}{newBeta}, state.Beta...)
-	if len(state.Beta) > 24 { // Assuming we keep 24 hours of history
-		state.Beta = state.Beta[:24]
-	}
+	headerHash := sha256.Sum256(header.Serialize(true))
+	state.Beta = UpdateRecentHistory(state.Beta, headerHash, header.StateRoot, accumulationRoot, workPackageHashes)
 
-	// Update entropy (η)
+	// Update entropy (η), accumulating into η0 every block and rotating the
+	// snapshots of it only on a new epoch
+	newEpoch := header.EpochMarker != nil
 	newEntropy := sha256.Sum256(append(state.Eta[0][:], header.VRFSignature.Signature[:]...))
-	state.Eta[3] = state.Eta[2]
-	state.Eta[2] = state.Eta[1]
-	state.Eta[1] = state.Eta[0]
+	if newEpoch {
+		state.Eta[3] = state.Eta[2]
+		state.Eta[2] = state.Eta[1]
+		state.Eta[1] = state.Eta[0]
+	}
 	state.Eta[0] = newEntropy
 
 	// Update validator sets if it's a new epoch
-	if header.EpochMarker != nil {
-		state.Iota = state.Gamma.ValidatorKeys
-		state.Kappa = make([]ValidatorKey, len(header.EpochMarker.ValidatorKeys))
-		for i, key := range header.EpochMarker.ValidatorKeys {
-			state.Kappa[i] = ValidatorKey{BandersnatchKey: key}
-		}
+	if newEpoch {
 		state.Lambda = state.Kappa
-	}
-
-	// Update Safrole state
-	state.Gamma.EpochRoot = header.EpochMarker.EpochRandomness
-	if header.WinningTickets != nil {
-		state.Gamma.SlotSealers = header.WinningTickets.Tickets
+		state.Kappa = state.Gamma.ValidatorKeys
+		state.Gamma.ValidatorKeys = FilterOffenders(state.Iota, state.Psi.PunishSet)
+		state.Gamma.EpochRoot = CalculateBandersnatchRingCommitment(BandersnatchKeys(state.Gamma.ValidatorKeys))
+
+		// Seal the epoch with the tickets accumulated in the last one, or
+		// fall back to keys of the new active validators
+		state.Gamma.SlotSealers = generateNewSealKeys(SafroleState{
+			Entropy:            [4][32]byte{2: state.Eta[2]},
+			CurrValidators:     state.Kappa,
+			TicketsAccumulator: state.Gamma.TicketAccumulator,
+		}, previousSlot, header.TimeSlot, &FullConfig)
+
+		// Reset the ticket accumulator for the new epoch
+		state.Gamma.TicketAccumulator = []TicketBody{}
 	}
 
 	// Update authorizer pool and queue
@@ -971,6 +1231,19 @@ func CreateBandersnatchRingVRFProof(privateKey []byte, publicKeys []Bandersnatch
 	return proof[:]
 }
 
+func CalculateBandersnatchRingCommitment(publicKeys []BandersnatchKey) [384]byte {
+	// TODO: Placeholder implementation
+	// In a real implementation, this would be the KZG commitment to the ring of keys
+	var commitment [384]byte
+	var keys []byte
+	for _, key := range publicKeys {
+		keys = append(keys, key[:]...)
+	}
+	hash := sha256.Sum256(keys)
+	copy(commitment[:], hash[:])
+	return commitment
+}
+
 func VerifyBandersnatchRingVRFProof(publicKeys []BandersnatchKey, message []byte, proof []byte) (bool, []byte) {
 	// TODO: Placeholder implementation
 	// In a real implementation, this would verify the Ring VRF proof and return the VRF output
@@ -1035,5 +1308,18 @@ func CreateNextBlock(previousBlock Block, state State) Block {
 }
 
 func main() {
+	// jam disasm <blob> prints a listing of a program or code blob
+	if len(os.Args) == 3 && os.Args[1] == "disasm" {
+		data, err := os.ReadFile(os.Args[2])
+		if err == nil {
+			err = DisassembleProgram(os.Stdout, data)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	RunJAMProtocol()
 }
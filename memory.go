@@ -0,0 +1,146 @@
+package main
+
+import "fmt"
+
+const PageSize = 1 << 12 // 4KB pages
+
+// PageAccess is the access mode of a single memory page. Modes are ordered so
+// that a mode permits everything the modes below it permit.
+type PageAccess uint8
+
+const (
+	PageInaccessible PageAccess = iota
+	PageReadOnly
+	PageReadWrite
+)
+
+// Page is a single page of PVM memory. Data is allocated on first write;
+// until then the page reads as zeros.
+type Page struct {
+	Access PageAccess
+	Data   []byte
+}
+
+// Memory is the sparse, paged 32-bit address space of a PVM instance. Pages
+// not present in Pages are inaccessible.
+type Memory struct {
+	Pages       map[uint32]*Page // Keyed by page index (address / PageSize)
+	HeapPointer uint32           // Next address handed out by sbrk
+}
+
+// PageFault is returned when memory is accessed without sufficient access
+// rights. Address is the start of the first offending page.
+type PageFault struct {
+	Address uint32
+}
+
+func (f *PageFault) Error() string {
+	return fmt.Sprintf("page fault at 0x%08x", f.Address)
+}
+
+func NewMemory() Memory {
+	return Memory{
+		Pages: make(map[uint32]*Page),
+	}
+}
+
+// SetAccess sets the access mode of every page overlapping
+// [address, address+length). Making a page inaccessible discards its data.
+func (m *Memory) SetAccess(address uint32, length uint32, access PageAccess) {
+	m.forEachPage(address, length, func(index uint32, _, _ uint32) {
+		if access == PageInaccessible {
+			delete(m.Pages, index)
+			return
+		}
+		page, exists := m.Pages[index]
+		if !exists {
+			page = &Page{}
+			m.Pages[index] = page
+		}
+		page.Access = access
+	})
+}
+
+// Access returns the access mode of the page containing address.
+func (m *Memory) Access(address uint32) PageAccess {
+	page, exists := m.Pages[address/PageSize]
+	if !exists {
+		return PageInaccessible
+	}
+	return page.Access
+}
+
+func (m *Memory) Read(address uint32, size uint32) ([]byte, error) {
+	if err := m.checkAccess(address, size, PageReadOnly); err != nil {
+		return nil, err
+	}
+	result := make([]byte, size)
+	m.forEachPage(address, size, func(index uint32, offset uint32, n uint32) {
+		if data := m.Pages[index].Data; data != nil {
+			pageOffset := (address + offset) % PageSize
+			copy(result[offset:offset+n], data[pageOffset:pageOffset+n])
+		}
+	})
+	return result, nil
+}
+
+func (m *Memory) Write(address uint32, value []byte) error {
+	size := uint32(len(value))
+	if err := m.checkAccess(address, size, PageReadWrite); err != nil {
+		return err
+	}
+	m.forEachPage(address, size, func(index uint32, offset uint32, n uint32) {
+		page := m.Pages[index]
+		if page.Data == nil {
+			page.Data = make([]byte, PageSize)
+		}
+		pageOffset := (address + offset) % PageSize
+		copy(page.Data[pageOffset:pageOffset+n], value[offset:offset+n])
+	})
+	return nil
+}
+
+// Sbrk grows the heap by size bytes, making any newly covered pages readable
+// and writable, and returns the address of the start of the new allocation.
+// It returns zero if the allocation does not fit in the address space.
+func (m *Memory) Sbrk(size uint32) uint32 {
+	start := m.HeapPointer
+	if uint64(start)+uint64(size) > MemorySize {
+		return 0
+	}
+	for index := start / PageSize; uint64(index)*PageSize < uint64(start)+uint64(size); index++ {
+		if _, exists := m.Pages[index]; !exists {
+			m.Pages[index] = &Page{Access: PageReadWrite}
+		}
+	}
+	m.HeapPointer += size
+	return start
+}
+
+func (m *Memory) checkAccess(address uint32, size uint32, required PageAccess) error {
+	var fault *PageFault
+	m.forEachPage(address, size, func(index uint32, _, _ uint32) {
+		if fault != nil {
+			return
+		}
+		if page, exists := m.Pages[index]; !exists || page.Access < required {
+			fault = &PageFault{Address: index * PageSize}
+		}
+	})
+	if fault != nil {
+		return fault
+	}
+	return nil
+}
+
+// forEachPage calls fn for each page overlapping [address, address+size),
+// wrapping around the end of the address space. offset is the position
+// within the range at which the page's portion starts, and n its length.
+func (m *Memory) forEachPage(address uint32, size uint32, fn func(index uint32, offset uint32, n uint32)) {
+	for offset := uint32(0); offset < size; {
+		current := address + offset
+		n := min(size-offset, PageSize-current%PageSize)
+		fn(current/PageSize, offset, n)
+		offset += n
+	}
+}
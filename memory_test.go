@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryAccess(t *testing.T) {
+	m := NewMemory()
+	m.SetAccess(0x10000, PageSize, PageReadOnly)
+	m.SetAccess(0x11000, PageSize, PageReadWrite)
+
+	testCases := []struct {
+		name       string
+		address    uint32
+		size       uint32
+		write      bool
+		faultsAt   uint32
+		shouldFail bool
+	}{
+		{"Read read-only page", 0x10000, 4, false, 0, false},
+		{"Write read-only page", 0x10000, 4, true, 0x10000, true},
+		{"Read across pages", 0x10FFE, 4, false, 0, false},
+		{"Write across read-only and read-write pages", 0x10FFE, 4, true, 0x10000, true},
+		{"Write read-write page", 0x11000, 4, true, 0, false},
+		{"Read past mapped pages", 0x11FFE, 4, false, 0x12000, true},
+		{"Read unmapped page", 0x0, 1, false, 0, true},
+		{"Empty read of unmapped page", 0x0, 0, false, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var err error
+			if tc.write {
+				err = m.Write(tc.address, make([]byte, tc.size))
+			} else {
+				_, err = m.Read(tc.address, tc.size)
+			}
+
+			if !tc.shouldFail {
+				assert.NoError(t, err)
+				return
+			}
+			fault, ok := err.(*PageFault)
+			assert.True(t, ok)
+			assert.Equal(t, tc.faultsAt, fault.Address)
+		})
+	}
+}
+
+func TestMemoryReadWrite(t *testing.T) {
+	m := NewMemory()
+	m.SetAccess(0x20000, 2*PageSize, PageReadWrite)
+
+	data, err := m.Read(0x20000, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, 8), data)
+	assert.Nil(t, m.Pages[0x20].Data, "reading should not allocate page data")
+
+	value := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.NoError(t, m.Write(0x20FFC, value))
+
+	data, err = m.Read(0x20FFC, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, value, data)
+
+	m.SetAccess(0x21000, PageSize, PageInaccessible)
+	_, err = m.Read(0x20FFC, 8)
+	assert.Equal(t, &PageFault{Address: 0x21000}, err)
+}
+
+func TestMemorySbrk(t *testing.T) {
+	m := NewMemory()
+	m.HeapPointer = 0x30000
+
+	assert.Equal(t, uint32(0x30000), m.Sbrk(0x10))
+	assert.Equal(t, uint32(0x30010), m.Sbrk(PageSize))
+	assert.Equal(t, uint32(0x31010), m.HeapPointer)
+	assert.Equal(t, PageReadWrite, m.Access(0x30000))
+	assert.Equal(t, PageReadWrite, m.Access(0x31000))
+	assert.Equal(t, PageInaccessible, m.Access(0x32000))
+}
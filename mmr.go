@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// MMR is a Merkle Mountain Range of Keccak hashes. Peaks[i] is the root of a
+// full subtree of 2^i leaves, or nil if there is none.
+type MMR struct {
+	Peaks []*Hash
+}
+
+func keccak256(data ...[]byte) Hash {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	var hash Hash
+	h.Sum(hash[:0])
+	return hash
+}
+
+// Append returns the range with leaf appended, merging peaks of equal height
+// as a binary counter carries.
+func (m MMR) Append(leaf Hash) MMR {
+	peaks := make([]*Hash, len(m.Peaks))
+	copy(peaks, m.Peaks)
+
+	for n := 0; ; n++ {
+		if n >= len(peaks) {
+			return MMR{Peaks: append(peaks, &leaf)}
+		}
+		if peaks[n] == nil {
+			peaks[n] = &leaf
+			return MMR{Peaks: peaks}
+		}
+		leaf = keccak256(peaks[n][:], leaf[:])
+		peaks[n] = nil
+	}
+}
+
+// SuperPeak commits to the whole range: the lowest peak, or for several,
+// Keccak("peak" ⌢ super-peak of the others ⌢ highest peak). An empty range
+// gives the zero hash.
+func (m MMR) SuperPeak() Hash {
+	var peaks []Hash
+	for _, peak := range m.Peaks {
+		if peak != nil {
+			peaks = append(peaks, *peak)
+		}
+	}
+	return superPeak(peaks)
+}
+
+func superPeak(peaks []Hash) Hash {
+	switch len(peaks) {
+	case 0:
+		return Hash{}
+	case 1:
+		return peaks[0]
+	}
+	rest := superPeak(peaks[:len(peaks)-1])
+	return keccak256([]byte("peak"), rest[:], peaks[len(peaks)-1][:])
+}
+
+// WellBalancedMerkleRoot is the Keccak root of the binary Merkle tree over
+// leaves, split at the middle rounding up, with nodes hashed as
+// Keccak("node" ⌢ left ⌢ right). A single leaf is hashed; no leaves give the
+// zero hash.
+func WellBalancedMerkleRoot(leaves [][]byte) Hash {
+	if len(leaves) == 1 {
+		return keccak256(leaves[0])
+	}
+	var root Hash
+	copy(root[:], merkleNode(leaves))
+	return root
+}
+
+func merkleNode(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return make([]byte, HashSize)
+	case 1:
+		return leaves[0]
+	}
+	mid := (len(leaves) + 1) / 2
+	node := keccak256([]byte("node"), merkleNode(leaves[:mid]), merkleNode(leaves[mid:]))
+	return node[:]
+}
+
+func (m MMR) Serialize() []byte {
+	buf := SerializeCompactInteger(uint64(len(m.Peaks)))
+	for _, peak := range m.Peaks {
+		if peak == nil {
+			buf = append(buf, 0)
+		} else {
+			buf = append(buf, 1)
+			buf = append(buf, peak[:]...)
+		}
+	}
+	return buf
+}
+
+func DeserializeMMR(data []byte, offset int) (MMR, int, error) {
+	count, offset, err := DeserializeCompactInteger(data, offset)
+	if err != nil {
+		return MMR{}, offset, err
+	}
+
+	m := MMR{}
+	for i := uint64(0); i < count; i++ {
+		if offset >= len(data) {
+			return MMR{}, offset, errors.New("insufficient data for MMR peak")
+		}
+		present := data[offset]
+		offset++
+		switch present {
+		case 0:
+			m.Peaks = append(m.Peaks, nil)
+		case 1:
+			if offset+32 > len(data) {
+				return MMR{}, offset, errors.New("insufficient data for MMR peak")
+			}
+			var peak Hash
+			copy(peak[:], data[offset:offset+32])
+			offset += 32
+			m.Peaks = append(m.Peaks, &peak)
+		default:
+			return MMR{}, offset, errors.New("invalid MMR peak marker")
+		}
+	}
+	return m, offset, nil
+}
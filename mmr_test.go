@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeccak256(t *testing.T) {
+	hash := keccak256()
+	assert.Equal(t, "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470", hex.EncodeToString(hash[:]))
+}
+
+func TestMMR(t *testing.T) {
+	a, b, c, d := Hash{1}, Hash{2}, Hash{3}, Hash{4}
+	ab := keccak256(a[:], b[:])
+	cd := keccak256(c[:], d[:])
+	abcd := keccak256(ab[:], cd[:])
+
+	testCases := []struct {
+		name      string
+		leaves    []Hash
+		peaks     []*Hash
+		superPeak Hash
+	}{
+		{"Empty", nil, nil, Hash{}},
+		{"One leaf", []Hash{a}, []*Hash{&a}, a},
+		{"Two leaves", []Hash{a, b}, []*Hash{nil, &ab}, ab},
+		{"Three leaves", []Hash{a, b, c}, []*Hash{&c, &ab}, keccak256([]byte("peak"), c[:], ab[:])},
+		{"Four leaves", []Hash{a, b, c, d}, []*Hash{nil, nil, &abcd}, abcd},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mmr MMR
+			for _, leaf := range tc.leaves {
+				mmr = mmr.Append(leaf)
+			}
+
+			assert.Equal(t, tc.peaks, mmr.Peaks)
+			assert.Equal(t, tc.superPeak, mmr.SuperPeak())
+
+			serialized := mmr.Serialize()
+			deserialized, offset, err := DeserializeMMR(serialized, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, len(serialized), offset)
+			assert.Equal(t, mmr, deserialized)
+		})
+	}
+}
+
+func TestMMRAppendDoesNotModify(t *testing.T) {
+	mmr := MMR{}.Append(Hash{1})
+	mmr.Append(Hash{2})
+
+	assert.Equal(t, []*Hash{{1}}, mmr.Peaks)
+}
+
+func TestWellBalancedMerkleRoot(t *testing.T) {
+	a, b, c := []byte{1}, []byte{2}, []byte{3}
+	node := func(left, right []byte) []byte {
+		hash := keccak256([]byte("node"), left, right)
+		return hash[:]
+	}
+
+	testCases := []struct {
+		name     string
+		leaves   [][]byte
+		expected Hash
+	}{
+		{"Empty", nil, Hash{}},
+		{"One leaf", [][]byte{a}, keccak256(a)},
+		{"Two leaves", [][]byte{a, b}, Hash(node(a, b))},
+		{"Three leaves", [][]byte{a, b, c}, Hash(node(node(a, b), c))},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, WellBalancedMerkleRoot(tc.leaves))
+		})
+	}
+}
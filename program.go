@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	ZoneSize     = 1 << 16 // Z_Z: size of the inaccessible zones between memory regions
+	MaxInputSize = 1 << 24 // Z_I: maximum size of the argument data
+)
+
+// ProgramBlob is a standard PVM program: the initial read-only and read-write
+// data, the heap and stack sizes and the code blob.
+type ProgramBlob struct {
+	ROData    []byte
+	RWData    []byte
+	HeapPages uint16 // Additional zeroed read-write pages after RWData
+	StackSize uint32
+	Code      CodeBlob
+}
+
+// CodeBlob holds the instructions, opcode bitmask and jump table of a program.
+type CodeBlob struct {
+	Code      []byte
+	Bitmask   []byte // One bit per code byte, least significant bit first
+	JumpTable []uint32
+}
+
+// ParseProgramBlob parses a standard program blob:
+// E3(|o|) ⌢ E3(|w|) ⌢ E2(z) ⌢ E3(s) ⌢ o ⌢ w ⌢ E4(|c|) ⌢ c
+func ParseProgramBlob(data []byte) (*ProgramBlob, error) {
+	if len(data) < 11 {
+		return nil, errors.New("insufficient data for program blob header")
+	}
+
+	roLength := readUint24(data[0:3])
+	rwLength := readUint24(data[3:6])
+	program := &ProgramBlob{
+		HeapPages: binary.LittleEndian.Uint16(data[6:8]),
+		StackSize: readUint24(data[8:11]),
+	}
+	offset := 11
+
+	if offset+int(roLength)+int(rwLength)+4 > len(data) {
+		return nil, errors.New("insufficient data for program blob data sections")
+	}
+	program.ROData = data[offset : offset+int(roLength)]
+	offset += int(roLength)
+	program.RWData = data[offset : offset+int(rwLength)]
+	offset += int(rwLength)
+
+	codeLength := binary.LittleEndian.Uint32(data[offset : offset+4])
+	offset += 4
+	if uint64(offset)+uint64(codeLength) != uint64(len(data)) {
+		return nil, errors.New("program blob code length does not match remaining data")
+	}
+
+	code, err := ParseCodeBlob(data[offset:])
+	if err != nil {
+		return nil, err
+	}
+	program.Code = *code
+
+	return program, nil
+}
+
+// ParseCodeBlob parses a code blob:
+// E(|j|) ⌢ E1(z) ⌢ E(|c|) ⌢ Ez(j) ⌢ c ⌢ k
+func ParseCodeBlob(data []byte) (*CodeBlob, error) {
+	jumpTableLength, offset, err := DeserializeNatural(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= len(data) {
+		return nil, errors.New("insufficient data for jump table entry size")
+	}
+	entrySize := int(data[offset])
+	offset++
+	if entrySize > 4 {
+		return nil, errors.New("jump table entry size too large")
+	}
+	codeLength, offset, err := DeserializeNatural(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if entrySize == 0 && jumpTableLength > 0 {
+		return nil, errors.New("jump table entry size is zero")
+	}
+
+	// Lengths are checked against the remaining data one at a time, so the
+	// header can neither overflow the check nor allocate beyond the blob
+	remaining := uint64(len(data) - offset)
+	if entrySize > 0 && jumpTableLength > remaining/uint64(entrySize) {
+		return nil, errors.New("code blob length does not match its header")
+	}
+	remaining -= jumpTableLength * uint64(entrySize)
+	if codeLength > remaining || remaining-codeLength != (codeLength+7)/8 {
+		return nil, errors.New("code blob length does not match its header")
+	}
+	bitmaskLength := (codeLength + 7) / 8
+
+	blob := &CodeBlob{
+		JumpTable: make([]uint32, jumpTableLength),
+	}
+	for i := range blob.JumpTable {
+		var entry uint32
+		for b := 0; b < entrySize; b++ {
+			entry |= uint32(data[offset+b]) << (8 * b)
+		}
+		blob.JumpTable[i] = entry
+		offset += entrySize
+	}
+	blob.Code = data[offset : offset+int(codeLength)]
+	offset += int(codeLength)
+	blob.Bitmask = data[offset : offset+int(bitmaskLength)]
+
+	return blob, nil
+}
+
+// Serialize encodes a standard program blob, the inverse of ParseProgramBlob.
+func (p *ProgramBlob) Serialize() []byte {
+	code := p.Code.Serialize()
+	var buf []byte
+	buf = append(buf, byte(len(p.ROData)), byte(len(p.ROData)>>8), byte(len(p.ROData)>>16))
+	buf = append(buf, byte(len(p.RWData)), byte(len(p.RWData)>>8), byte(len(p.RWData)>>16))
+	buf = binary.LittleEndian.AppendUint16(buf, p.HeapPages)
+	buf = append(buf, byte(p.StackSize), byte(p.StackSize>>8), byte(p.StackSize>>16))
+	buf = append(buf, p.ROData...)
+	buf = append(buf, p.RWData...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(code)))
+	return append(buf, code...)
+}
+
+// Serialize encodes a code blob, the inverse of ParseCodeBlob, using the
+// smallest jump table entry size that fits every entry.
+func (b *CodeBlob) Serialize() []byte {
+	entrySize := 0
+	for _, entry := range b.JumpTable {
+		for entry>>(8*entrySize) != 0 {
+			entrySize++
+		}
+	}
+
+	var buf []byte
+	buf = append(buf, SerializeNatural(uint64(len(b.JumpTable)))...)
+	buf = append(buf, byte(entrySize))
+	buf = append(buf, SerializeNatural(uint64(len(b.Code)))...)
+	for _, entry := range b.JumpTable {
+		for i := 0; i < entrySize; i++ {
+			buf = append(buf, byte(entry>>(8*i)))
+		}
+	}
+	buf = append(buf, b.Code...)
+	return append(buf, b.Bitmask...)
+}
+
+// NewStandardPVM parses a standard program blob and builds a PVM with the
+// standard memory layout and initial registers, ready to run from entryPoint:
+//
+//	[Z_Z, ...)                      read-only data
+//	[2Z_Z + Z(|o|), ...)            read-write data followed by the heap
+//	[2^32 - 2Z_Z - Z_I - P(s), ...) stack
+//	[2^32 - Z_Z - Z_I, ...)         read-only arguments
+func NewStandardPVM(program []byte, entryPoint uint32, args []byte, gasLimit uint64) (*PVM, error) {
+	blob, err := ParseProgramBlob(program)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > MaxInputSize {
+		return nil, errors.New("arguments too large")
+	}
+
+	roSize := uint64(len(blob.ROData))
+	rwSize := pageAlign(uint64(len(blob.RWData))) + uint64(blob.HeapPages)*PageSize
+	if 5*ZoneSize+zoneAlign(roSize)+zoneAlign(rwSize)+zoneAlign(uint64(blob.StackSize))+MaxInputSize > MemorySize {
+		return nil, errors.New("program does not fit in memory")
+	}
+
+	pvm, err := NewPVM(blob.Code.Code, blob.Code.Bitmask, blob.Code.JumpTable, gasLimit)
+	if err != nil {
+		return nil, err
+	}
+	pvm.PC = entryPoint
+
+	roStart := uint32(ZoneSize)
+	rwStart := uint32(2*ZoneSize + zoneAlign(roSize))
+	stackEnd := uint32(MemorySize - 2*ZoneSize - MaxInputSize)
+	stackStart := stackEnd - uint32(pageAlign(uint64(blob.StackSize)))
+	argsStart := uint32(MemorySize - ZoneSize - MaxInputSize)
+
+	pvm.Memory.initializeRegion(roStart, blob.ROData, uint32(roSize), PageReadOnly)
+	pvm.Memory.initializeRegion(rwStart, blob.RWData, uint32(rwSize), PageReadWrite)
+	pvm.Memory.initializeRegion(stackStart, nil, stackEnd-stackStart, PageReadWrite)
+	pvm.Memory.initializeRegion(argsStart, args, uint32(len(args)), PageReadOnly)
+	pvm.Memory.HeapPointer = rwStart + uint32(rwSize)
+
+	pvm.Registers[0] = HaltAddress // Return address
+	pvm.Registers[1] = stackEnd    // Stack pointer
+	pvm.Registers[7] = argsStart
+	pvm.Registers[8] = uint32(len(args))
+
+	return pvm, nil
+}
+
+// initializeRegion maps size bytes at address with the given access mode and
+// fills the start of the region with data.
+func (m *Memory) initializeRegion(address uint32, data []byte, size uint32, access PageAccess) {
+	if size == 0 {
+		return
+	}
+	m.SetAccess(address, size, PageReadWrite)
+	m.Write(address, data)
+	m.SetAccess(address, size, access)
+}
+
+func pageAlign(n uint64) uint64 {
+	return (n + PageSize - 1) / PageSize * PageSize
+}
+
+func zoneAlign(n uint64) uint64 {
+	return (n + ZoneSize - 1) / ZoneSize * ZoneSize
+}
+
+func readUint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encodeCodeBlob builds a code blob with one-byte jump table entries.
+func encodeCodeBlob(code, bitmask []byte, jumpTable []uint32) []byte {
+	var buf []byte
+	buf = append(buf, SerializeNatural(uint64(len(jumpTable)))...)
+	buf = append(buf, 1)
+	buf = append(buf, SerializeNatural(uint64(len(code)))...)
+	for _, entry := range jumpTable {
+		buf = append(buf, byte(entry))
+	}
+	buf = append(buf, code...)
+	buf = append(buf, bitmask...)
+	return buf
+}
+
+// encodeProgramBlob builds a standard program blob around a code blob.
+func encodeProgramBlob(ro, rw []byte, heapPages uint16, stackSize uint32, code, bitmask []byte, jumpTable []uint32) []byte {
+	codeBlob := encodeCodeBlob(code, bitmask, jumpTable)
+
+	var buf []byte
+	buf = append(buf, byte(len(ro)), byte(len(ro)>>8), byte(len(ro)>>16))
+	buf = append(buf, byte(len(rw)), byte(len(rw)>>8), byte(len(rw)>>16))
+	buf = binary.LittleEndian.AppendUint16(buf, heapPages)
+	buf = append(buf, byte(stackSize), byte(stackSize>>8), byte(stackSize>>16))
+	buf = append(buf, ro...)
+	buf = append(buf, rw...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(codeBlob)))
+	buf = append(buf, codeBlob...)
+	return buf
+}
+
+func TestParseProgramBlob(t *testing.T) {
+	code := []byte{OpJumpInd, 0x00}
+	blob := encodeProgramBlob([]byte{1, 2, 3}, []byte{4, 5}, 2, 0x1000, code, []byte{0b01}, []uint32{0, 2})
+
+	program, err := ParseProgramBlob(blob)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, program.ROData)
+	assert.Equal(t, []byte{4, 5}, program.RWData)
+	assert.Equal(t, uint16(2), program.HeapPages)
+	assert.Equal(t, uint32(0x1000), program.StackSize)
+	assert.Equal(t, code, program.Code.Code)
+	assert.Equal(t, []byte{0b01}, program.Code.Bitmask)
+	assert.Equal(t, []uint32{0, 2}, program.Code.JumpTable)
+}
+
+func TestParseProgramBlobErrors(t *testing.T) {
+	valid := encodeProgramBlob(nil, nil, 0, 0, []byte{OpTrap}, []byte{0b1}, nil)
+
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", []byte{}},
+		{"Truncated header", valid[:5]},
+		{"Truncated code", valid[:len(valid)-1]},
+		{"Trailing data", append(append([]byte{}, valid...), 0)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseProgramBlob(tc.data)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseCodeBlobErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{
+			name: "Zero entry size",
+			data: append(append(SerializeNatural(1<<40), 0), SerializeNatural(1)...),
+			err:  "jump table entry size is zero",
+		},
+		{
+			name: "Jump table beyond the blob",
+			data: append(append(SerializeNatural(1<<40), 4), SerializeNatural(1)...),
+			err:  "code blob length does not match its header",
+		},
+		{
+			name: "Code beyond the blob",
+			data: append(append(SerializeNatural(0), 1), SerializeNatural(1<<62)...),
+			err:  "code blob length does not match its header",
+		},
+		{
+			name: "Entry size too large",
+			data: append(SerializeNatural(0), 5),
+			err:  "jump table entry size too large",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseCodeBlob(tc.data)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestNewStandardPVM(t *testing.T) {
+	blob := encodeProgramBlob([]byte{1, 2, 3}, []byte{4, 5}, 1, 0x2000, []byte{OpTrap}, []byte{0b1}, nil)
+	args := []byte{9, 8, 7}
+
+	pvm, err := NewStandardPVM(blob, 0, args, 1000)
+	assert.NoError(t, err)
+
+	stackEnd := uint32(MemorySize - 2*ZoneSize - MaxInputSize)
+	argsStart := uint32(MemorySize - ZoneSize - MaxInputSize)
+	assert.Equal(t, uint32(HaltAddress), pvm.Registers[0])
+	assert.Equal(t, stackEnd, pvm.Registers[1])
+	assert.Equal(t, argsStart, pvm.Registers[7])
+	assert.Equal(t, uint32(len(args)), pvm.Registers[8])
+
+	data, err := pvm.Memory.Read(ZoneSize, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 0}, data)
+	assert.Equal(t, PageReadOnly, pvm.Memory.Access(ZoneSize))
+
+	rwStart := uint32(2*ZoneSize + ZoneSize)
+	data, err = pvm.Memory.Read(rwStart, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{4, 5}, data)
+	assert.Equal(t, PageReadWrite, pvm.Memory.Access(rwStart+PageSize), "heap page")
+	assert.Equal(t, PageInaccessible, pvm.Memory.Access(rwStart+2*PageSize))
+	assert.Equal(t, rwStart+2*PageSize, pvm.Memory.HeapPointer)
+
+	assert.Equal(t, PageReadWrite, pvm.Memory.Access(stackEnd-1))
+	assert.Equal(t, PageReadWrite, pvm.Memory.Access(stackEnd-0x2000))
+	assert.Equal(t, PageInaccessible, pvm.Memory.Access(stackEnd-0x2001))
+	assert.Equal(t, PageInaccessible, pvm.Memory.Access(stackEnd))
+
+	data, err = pvm.Memory.Read(argsStart, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, args, data)
+	assert.Equal(t, PageReadOnly, pvm.Memory.Access(argsStart))
+}
+
+func TestExecutePVM(t *testing.T) {
+	// A program that immediately returns, leaving its arguments as its output
+	blob := encodeProgramBlob(nil, nil, 0, 0, []byte{OpJumpInd, 0x00}, []byte{0b01}, nil)
+
+	output, gas, err := ExecutePVM(blob, 0, 1000, []byte{1, 2, 3}, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, output)
+	assert.Equal(t, int64(999), gas)
+}
@@ -1,194 +1,648 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 )
 
 const (
 	RegisterCount        = 13
 	MaxInstructionLength = 16
-	JumpAlignmentFactor  = 4
-	MemorySize           = 1 << 32 // 4GB of memory
+	JumpAlignmentFactor  = 2
+	MemorySize           = 1 << 32 // 4GB of address space
+	HaltAddress          = 0xFFFF0000
 )
 
 type PVM struct {
-	Code      []byte
-	JumpTable []uint32
-	Registers [RegisterCount]uint32
-	Memory    Memory
-	GasLimit  uint64
-	GasUsed   uint64
-	PC        uint32 // Program Counter
+	Code        []byte
+	Bitmask     []bool // Marks the code bytes that start an instruction
+	JumpTable   []uint32
+	Registers   [RegisterCount]uint32
+	Memory      Memory
+	Gas         int64 // Remaining gas, negative once exhausted
+	GasMode     GasMode
+	PC          uint32 // Program Counter
+	Engine      Engine
+	basicBlocks []bool // Marks the code bytes that start a basic block
+	blockGas    map[uint32]int64
+	gasCharged  bool // Whether the current basic block has been paid for in GasPerBasicBlock mode
+	compiled    *compiledProgram
 }
 
-type Memory struct {
-	Data      []byte
-	ReadMask  []bool
-	WriteMask []bool
-}
+// GasMode selects when gas is charged.
+type GasMode int
+
+const (
+	// GasPerInstruction charges each instruction as it executes, as in the
+	// Gray Paper.
+	GasPerInstruction GasMode = iota
+	// GasPerBasicBlock charges the cost of a whole basic block upon entering
+	// it, running out of gas before the block starts if it cannot be paid.
+	GasPerBasicBlock
+)
+
+// Engine selects how Execute runs the code.
+type Engine int
 
+const (
+	// EngineInterpreter, the default, decodes and executes one instruction at
+	// a time.
+	EngineInterpreter Engine = iota
+	// EngineCompiled executes basic blocks decoded once per program and
+	// cached by code hash, with the same results as the interpreter.
+	EngineCompiled
+)
+
+// ExitReason is the outcome of running a guest. Exits caused by the guest
+// are never reported as Go errors, which are reserved for failures of the
+// implementation or of the host.
 type ExitReason uint32
 
 const (
-	ExitHalt ExitReason = iota
-	ExitPanic
+	ExitHalt  ExitReason = iota
+	ExitPanic            // Trap, invalid instruction or invalid jump
 	ExitOOG
-	ExitFault
-	ExitHost
+	ExitFault    // Page fault; comes with the address of the faulting page
+	ExitHost     // Host call; comes with the host call index
+	ExitContinue // Internal: the instruction completed and execution carries on
 )
 
-func NewPVM(code []byte, jumpTable []uint32, gasLimit uint64) (*PVM, error) {
+func (r ExitReason) String() string {
+	switch r {
+	case ExitHalt:
+		return "halt"
+	case ExitPanic:
+		return "panic"
+	case ExitOOG:
+		return "out-of-gas"
+	case ExitFault:
+		return "page-fault"
+	case ExitHost:
+		return "host"
+	case ExitContinue:
+		return "continue"
+	}
+	return fmt.Sprintf("exit(%d)", uint32(r))
+}
+
+// NewPVM creates a PVM for the given code. bitmask is packed with one bit per
+// code byte, least significant bit first, as in a code blob.
+func NewPVM(code []byte, bitmask []byte, jumpTable []uint32, gasLimit uint64) (*PVM, error) {
 	if len(code) == 0 {
 		return nil, errors.New("code cannot be empty")
 	}
+	if len(bitmask)*8 < len(code) {
+		return nil, errors.New("bitmask shorter than code")
+	}
 	if gasLimit == 0 {
 		return nil, errors.New("gas limit must be greater than zero")
 	}
-	return &PVM{
+	if gasLimit > math.MaxInt64 {
+		return nil, errors.New("gas limit too large")
+	}
+	pvm := &PVM{
 		Code:      code,
+		Bitmask:   DecodeBitmask(bitmask, len(code)),
 		JumpTable: jumpTable,
-		GasLimit:  gasLimit,
+		Gas:       int64(gasLimit),
 		Memory:    NewMemory(),
-	}, nil
+		blockGas:  make(map[uint32]int64),
+	}
+	pvm.basicBlocks = pvm.findBasicBlocks()
+	return pvm, nil
 }
 
-func NewMemory() Memory {
-	return Memory{
-		Data:      make([]byte, MemorySize),
-		ReadMask:  make([]bool, MemorySize),
-		WriteMask: make([]bool, MemorySize),
+// DecodeBitmask unpacks the first length bits of a packed bitmask.
+func DecodeBitmask(packed []byte, length int) []bool {
+	bitmask := make([]bool, length)
+	for i := range bitmask {
+		bitmask[i] = packed[i/8]&(1<<(i%8)) != 0
 	}
+	return bitmask
 }
 
-func (pvm *PVM) Execute() (ExitReason, uint32, error) {
-	for pvm.GasUsed < pvm.GasLimit {
-		exitReason, value, err := pvm.executeInstruction()
-		if err != nil {
-			return ExitPanic, 0, err
+// EncodeBitmask packs a bitmask with one bit per code byte, least significant
+// bit first.
+func EncodeBitmask(bitmask []bool) []byte {
+	packed := make([]byte, (len(bitmask)+7)/8)
+	for i, set := range bitmask {
+		if set {
+			packed[i/8] |= 1 << (i % 8)
 		}
-		if exitReason != ExitHalt {
-			return exitReason, value, nil
+	}
+	return packed
+}
+
+// findBasicBlocks marks the start of the code and every instruction following
+// a terminator as the start of a basic block, provided it holds a valid opcode.
+func (pvm *PVM) findBasicBlocks() []bool {
+	starts := make([]bool, len(pvm.Code))
+	starts[0] = true
+	for i := range pvm.Code {
+		if pvm.Bitmask[i] && isTerminator(pvm.Code[i]) {
+			if next := uint32(i) + 1 + pvm.skipLength(uint32(i)); next < uint32(len(pvm.Code)) {
+				starts[next] = true
+			}
 		}
 	}
-	return ExitOOG, 0, nil
+	for i := range starts {
+		starts[i] = starts[i] && pvm.Bitmask[i] && instructionClasses[pvm.Code[i]] != ClassInvalid
+	}
+	return starts
 }
 
-func (pvm *PVM) executeInstruction() (ExitReason, uint32, error) {
+// Execute runs until the machine exits, returning the exit reason, its
+// associated value and the remaining gas.
+func (pvm *PVM) Execute() (ExitReason, uint32, int64) {
+	if pvm.Engine == EngineCompiled {
+		return pvm.executeCompiled()
+	}
+	for {
+		exitReason, value := pvm.Step()
+		if exitReason != ExitContinue {
+			return exitReason, value, pvm.Gas
+		}
+	}
+}
+
+// Step executes a single instruction. It returns ExitContinue if the machine
+// can go on, or the exit reason and its associated value otherwise.
+func (pvm *PVM) Step() (ExitReason, uint32) {
 	if pvm.PC >= uint32(len(pvm.Code)) {
-		return ExitPanic, 0, errors.New("program counter out of bounds")
+		return ExitPanic, 0
+	}
+
+	in := pvm.decodeInstruction(pvm.PC)
+
+	if !pvm.chargeGas(in.Opcode) {
+		return ExitOOG, 0
 	}
+	return pvm.execute(in)
+}
 
-	opcode := pvm.Code[pvm.PC]
-	instructionLength := pvm.skipLength() + 1
+// execute carries out the instruction at the program counter, which has
+// already been paid for.
+func (pvm *PVM) execute(in Instruction) (ExitReason, uint32) {
+	reg := &pvm.Registers
+	next := pvm.PC + in.Length
 
-	gasCost := pvm.calculateGasCost(opcode)
-	if pvm.GasUsed+gasCost > pvm.GasLimit {
-		return ExitOOG, 0, nil
+	if operation := registerOperations[in.Opcode]; operation != nil {
+		operation(&in, reg)
+		pvm.PC = next
+		return ExitContinue, 0
 	}
-	pvm.GasUsed += gasCost
 
-	switch opcode {
-	case 0x00: // trap
-		return ExitHalt, 0, nil
-	case 0x11: // fallthrough
-		// No operation
-	// TODO: Implement other instructions
+	switch in.Opcode {
+	case OpTrap:
+		return ExitPanic, 0
+	case OpEcalli:
+		pvm.PC = next
+		return ExitHost, in.ImmX
+
+	// Stores of immediates
+	case OpStoreImmU8:
+		return pvm.store(in.ImmX, 1, in.ImmY, next)
+	case OpStoreImmU16:
+		return pvm.store(in.ImmX, 2, in.ImmY, next)
+	case OpStoreImmU32:
+		return pvm.store(in.ImmX, 4, in.ImmY, next)
+	case OpStoreImmIndU8:
+		return pvm.store(reg[in.RegA]+in.ImmX, 1, in.ImmY, next)
+	case OpStoreImmIndU16:
+		return pvm.store(reg[in.RegA]+in.ImmX, 2, in.ImmY, next)
+	case OpStoreImmIndU32:
+		return pvm.store(reg[in.RegA]+in.ImmX, 4, in.ImmY, next)
+
+	// Direct loads and stores
+	case OpLoadU8:
+		return pvm.load(in.RegA, in.ImmX, 1, false, next)
+	case OpLoadI8:
+		return pvm.load(in.RegA, in.ImmX, 1, true, next)
+	case OpLoadU16:
+		return pvm.load(in.RegA, in.ImmX, 2, false, next)
+	case OpLoadI16:
+		return pvm.load(in.RegA, in.ImmX, 2, true, next)
+	case OpLoadU32:
+		return pvm.load(in.RegA, in.ImmX, 4, false, next)
+	case OpStoreU8:
+		return pvm.store(in.ImmX, 1, reg[in.RegA], next)
+	case OpStoreU16:
+		return pvm.store(in.ImmX, 2, reg[in.RegA], next)
+	case OpStoreU32:
+		return pvm.store(in.ImmX, 4, reg[in.RegA], next)
+
+	// Indirect loads and stores
+	case OpLoadIndU8:
+		return pvm.load(in.RegA, reg[in.RegB]+in.ImmX, 1, false, next)
+	case OpLoadIndI8:
+		return pvm.load(in.RegA, reg[in.RegB]+in.ImmX, 1, true, next)
+	case OpLoadIndU16:
+		return pvm.load(in.RegA, reg[in.RegB]+in.ImmX, 2, false, next)
+	case OpLoadIndI16:
+		return pvm.load(in.RegA, reg[in.RegB]+in.ImmX, 2, true, next)
+	case OpLoadIndU32:
+		return pvm.load(in.RegA, reg[in.RegB]+in.ImmX, 4, false, next)
+	case OpStoreIndU8:
+		return pvm.store(reg[in.RegB]+in.ImmX, 1, reg[in.RegA], next)
+	case OpStoreIndU16:
+		return pvm.store(reg[in.RegB]+in.ImmX, 2, reg[in.RegA], next)
+	case OpStoreIndU32:
+		return pvm.store(reg[in.RegB]+in.ImmX, 4, reg[in.RegA], next)
+
+	// Jumps and branches
+	case OpJump:
+		return pvm.branch(in.ImmX, true, next)
+	case OpJumpInd:
+		return pvm.dynamicJump(reg[in.RegA] + in.ImmX)
+	case OpLoadImmJump:
+		reg[in.RegA] = in.ImmX
+		return pvm.branch(in.ImmY, true, next)
+	case OpLoadImmJumpInd:
+		target := reg[in.RegB] + in.ImmY
+		reg[in.RegA] = in.ImmX
+		return pvm.dynamicJump(target)
+	case OpBranchEqImm:
+		return pvm.branch(in.ImmY, reg[in.RegA] == in.ImmX, next)
+	case OpBranchNeImm:
+		return pvm.branch(in.ImmY, reg[in.RegA] != in.ImmX, next)
+	case OpBranchLtUImm:
+		return pvm.branch(in.ImmY, reg[in.RegA] < in.ImmX, next)
+	case OpBranchLeUImm:
+		return pvm.branch(in.ImmY, reg[in.RegA] <= in.ImmX, next)
+	case OpBranchGeUImm:
+		return pvm.branch(in.ImmY, reg[in.RegA] >= in.ImmX, next)
+	case OpBranchGtUImm:
+		return pvm.branch(in.ImmY, reg[in.RegA] > in.ImmX, next)
+	case OpBranchLtSImm:
+		return pvm.branch(in.ImmY, int32(reg[in.RegA]) < int32(in.ImmX), next)
+	case OpBranchLeSImm:
+		return pvm.branch(in.ImmY, int32(reg[in.RegA]) <= int32(in.ImmX), next)
+	case OpBranchGeSImm:
+		return pvm.branch(in.ImmY, int32(reg[in.RegA]) >= int32(in.ImmX), next)
+	case OpBranchGtSImm:
+		return pvm.branch(in.ImmY, int32(reg[in.RegA]) > int32(in.ImmX), next)
+	case OpBranchEq:
+		return pvm.branch(in.ImmX, reg[in.RegA] == reg[in.RegB], next)
+	case OpBranchNe:
+		return pvm.branch(in.ImmX, reg[in.RegA] != reg[in.RegB], next)
+	case OpBranchLtU:
+		return pvm.branch(in.ImmX, reg[in.RegA] < reg[in.RegB], next)
+	case OpBranchLtS:
+		return pvm.branch(in.ImmX, int32(reg[in.RegA]) < int32(reg[in.RegB]), next)
+	case OpBranchGeU:
+		return pvm.branch(in.ImmX, reg[in.RegA] >= reg[in.RegB], next)
+	case OpBranchGeS:
+		return pvm.branch(in.ImmX, int32(reg[in.RegA]) >= int32(reg[in.RegB]), next)
+
+	// Heap allocation
+	case OpSbrk:
+		reg[in.RegD] = pvm.Memory.Sbrk(reg[in.RegA])
+
 	default:
-		return ExitPanic, 0, errors.New("unknown opcode")
+		// Invalid opcodes execute as trap
+		return ExitPanic, 0
 	}
 
-	pvm.PC += instructionLength
-	return ExitHalt, 0, nil
+	pvm.PC = next
+	return ExitContinue, 0
 }
 
-func (pvm *PVM) skipLength() uint32 {
-	for i := uint32(1); i <= 24; i++ {
-		if pvm.PC+i >= uint32(len(pvm.Code)) || pvm.Code[pvm.PC+i] == 1 {
-			return i - 1
+// registerOperation carries out an instruction that only reads and writes
+// registers, and can neither exit nor move the program counter.
+type registerOperation func(in *Instruction, reg *[RegisterCount]uint32)
+
+// registerOperations holds the register operations by opcode, and nil for
+// every other instruction. Both engines execute them from here.
+var registerOperations = [256]registerOperation{
+	OpFallthrough: func(in *Instruction, reg *[RegisterCount]uint32) {},
+	OpLoadImm:     func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = in.ImmX },
+	OpMoveReg:     func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = reg[in.RegA] },
+
+	// Arithmetic and logic with an immediate
+	OpAddImm: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = reg[in.RegB] + in.ImmX },
+	OpAndImm: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = reg[in.RegB] & in.ImmX },
+	OpXorImm: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = reg[in.RegB] ^ in.ImmX },
+	OpOrImm:  func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = reg[in.RegB] | in.ImmX },
+	OpMulImm: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = reg[in.RegB] * in.ImmX },
+	OpMulUpperSSImm: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegA] = mulUpperSS(reg[in.RegB], in.ImmX)
+	},
+	OpMulUpperUUImm: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegA] = mulUpperUU(reg[in.RegB], in.ImmX)
+	},
+	OpSetLtUImm: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegA] = boolToUint32(reg[in.RegB] < in.ImmX)
+	},
+	OpSetLtSImm: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegA] = boolToUint32(int32(reg[in.RegB]) < int32(in.ImmX))
+	},
+	OpSetGtUImm: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegA] = boolToUint32(reg[in.RegB] > in.ImmX)
+	},
+	OpSetGtSImm: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegA] = boolToUint32(int32(reg[in.RegB]) > int32(in.ImmX))
+	},
+	OpShloLImm: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = reg[in.RegB] << (in.ImmX % 32) },
+	OpShloRImm: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = reg[in.RegB] >> (in.ImmX % 32) },
+	OpSharRImm: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegA] = uint32(int32(reg[in.RegB]) >> (in.ImmX % 32))
+	},
+	OpShloLImmAlt: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = in.ImmX << (reg[in.RegB] % 32) },
+	OpShloRImmAlt: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = in.ImmX >> (reg[in.RegB] % 32) },
+	OpSharRImmAlt: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegA] = uint32(int32(in.ImmX) >> (reg[in.RegB] % 32))
+	},
+	OpNegAddImm: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegA] = in.ImmX - reg[in.RegB] },
+	OpCmovIzImm: func(in *Instruction, reg *[RegisterCount]uint32) {
+		if reg[in.RegB] == 0 {
+			reg[in.RegA] = in.ImmX
+		}
+	},
+	OpCmovNzImm: func(in *Instruction, reg *[RegisterCount]uint32) {
+		if reg[in.RegB] != 0 {
+			reg[in.RegA] = in.ImmX
+		}
+	},
+
+	// Arithmetic and logic on three registers
+	OpAdd: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = reg[in.RegA] + reg[in.RegB] },
+	OpSub: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = reg[in.RegA] - reg[in.RegB] },
+	OpAnd: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = reg[in.RegA] & reg[in.RegB] },
+	OpXor: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = reg[in.RegA] ^ reg[in.RegB] },
+	OpOr:  func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = reg[in.RegA] | reg[in.RegB] },
+	OpMul: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = reg[in.RegA] * reg[in.RegB] },
+	OpMulUpperSS: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegD] = mulUpperSS(reg[in.RegA], reg[in.RegB])
+	},
+	OpMulUpperUU: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegD] = mulUpperUU(reg[in.RegA], reg[in.RegB])
+	},
+	OpMulUpperSU: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegD] = uint32(uint64(int64(int32(reg[in.RegA]))*int64(reg[in.RegB])) >> 32)
+	},
+	OpDivU: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = divU(reg[in.RegA], reg[in.RegB]) },
+	OpDivS: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = divS(reg[in.RegA], reg[in.RegB]) },
+	OpRemU: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = remU(reg[in.RegA], reg[in.RegB]) },
+	OpRemS: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = remS(reg[in.RegA], reg[in.RegB]) },
+	OpSetLtU: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegD] = boolToUint32(reg[in.RegA] < reg[in.RegB])
+	},
+	OpSetLtS: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegD] = boolToUint32(int32(reg[in.RegA]) < int32(reg[in.RegB]))
+	},
+	OpShloL: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = reg[in.RegA] << (reg[in.RegB] % 32) },
+	OpShloR: func(in *Instruction, reg *[RegisterCount]uint32) { reg[in.RegD] = reg[in.RegA] >> (reg[in.RegB] % 32) },
+	OpSharR: func(in *Instruction, reg *[RegisterCount]uint32) {
+		reg[in.RegD] = uint32(int32(reg[in.RegA]) >> (reg[in.RegB] % 32))
+	},
+	OpCmovIz: func(in *Instruction, reg *[RegisterCount]uint32) {
+		if reg[in.RegB] == 0 {
+			reg[in.RegD] = reg[in.RegA]
+		}
+	},
+	OpCmovNz: func(in *Instruction, reg *[RegisterCount]uint32) {
+		if reg[in.RegB] != 0 {
+			reg[in.RegD] = reg[in.RegA]
+		}
+	},
+}
+
+// skipLength returns the number of bytes between the opcode at pc and the
+// next instruction, as given by the bitmask (which reads as set past the end
+// of the code), capped at 24.
+func (pvm *PVM) skipLength(pc uint32) uint32 {
+	for j := uint32(0); j < 24; j++ {
+		i := uint64(pc) + 1 + uint64(j)
+		if i >= uint64(len(pvm.Bitmask)) || pvm.Bitmask[i] {
+			return j
 		}
 	}
 	return 24
 }
 
-func (pvm *PVM) calculateGasCost(opcode byte) uint64 {
-	// TODO: Implement proper gas cost calculation
-	return 10 // Placeholder
+// instructionGasCost is the gas charged for each opcode. The Gray Paper
+// assigns every instruction a cost of one; invalid opcodes execute as trap.
+var instructionGasCost = func() [256]int64 {
+	var costs [256]int64
+	for i := range costs {
+		costs[i] = 1
+	}
+	return costs
+}()
+
+func (pvm *PVM) calculateGasCost(opcode byte) int64 {
+	return instructionGasCost[opcode]
+}
+
+// chargeGas deducts the gas for executing opcode at the current program
+// counter, and reports whether any gas remains.
+func (pvm *PVM) chargeGas(opcode byte) bool {
+	if pvm.GasMode == GasPerInstruction {
+		pvm.Gas -= pvm.calculateGasCost(opcode)
+		return pvm.Gas >= 0
+	}
+
+	if isTerminator(opcode) {
+		defer func() { pvm.gasCharged = false }()
+	}
+	if pvm.gasCharged {
+		return true
+	}
+	pvm.Gas -= pvm.blockGasCost(pvm.PC)
+	pvm.gasCharged = true
+	return pvm.Gas >= 0
+}
+
+// blockGasCost returns the total cost of the instructions from pc up to and
+// including the next terminator.
+func (pvm *PVM) blockGasCost(pc uint32) int64 {
+	if cost, exists := pvm.blockGas[pc]; exists {
+		return cost
+	}
+	var cost int64
+	for i := pc; i < uint32(len(pvm.Code)); i += 1 + pvm.skipLength(i) {
+		cost += pvm.calculateGasCost(pvm.Code[i])
+		if isTerminator(pvm.Code[i]) {
+			break
+		}
+	}
+	pvm.blockGas[pc] = cost
+	return cost
 }
 
-func (pvm *PVM) readImmediate(length uint32) uint32 {
+// readImmediate reads a little-endian immediate of the given length starting
+// at code index at, and sign-extends it to 32 bits.
+func (pvm *PVM) readImmediate(at uint32, length uint32) uint32 {
 	if length > 4 {
 		length = 4
 	}
 	var value uint32
 	for i := uint32(0); i < length; i++ {
-		value |= uint32(pvm.Code[pvm.PC+1+i]) << (8 * i)
+		value |= uint32(pvm.codeByte(at+i)) << (8 * i)
 	}
 	return signExtend(value, uint(length*8))
 }
 
 func signExtend(value uint32, bits uint) uint32 {
+	if bits == 0 {
+		return 0
+	}
 	mask := uint32(1) << (bits - 1)
 	return uint32((int32(value^mask) - int32(mask)))
 }
 
-func (pvm *PVM) dynamicJump(address uint32) (ExitReason, uint32, error) {
-	if address == 0xFFFF0000 {
-		return ExitHalt, 0, nil
+// branch moves the program counter to target if condition holds, and to next
+// otherwise. Taken branches must land on the start of a basic block.
+func (pvm *PVM) branch(target uint32, condition bool, next uint32) (ExitReason, uint32) {
+	if !condition {
+		pvm.PC = next
+		return ExitContinue, 0
+	}
+	if !pvm.isBasicBlockStart(target) {
+		return ExitPanic, 0
+	}
+	pvm.PC = target
+	return ExitContinue, 0
+}
+
+// dynamicJump jumps to the jump table entry for address, which must be a
+// non-zero multiple of JumpAlignmentFactor, and halts at HaltAddress.
+func (pvm *PVM) dynamicJump(address uint32) (ExitReason, uint32) {
+	if address == HaltAddress {
+		return ExitHalt, 0
 	}
 	if address == 0 || address > uint32(len(pvm.JumpTable))*JumpAlignmentFactor || address%JumpAlignmentFactor != 0 {
-		return ExitPanic, 0, errors.New("invalid jump address")
+		return ExitPanic, 0
 	}
 	jumpIndex := (address / JumpAlignmentFactor) - 1
 	if !pvm.isBasicBlockStart(pvm.JumpTable[jumpIndex]) {
-		return ExitPanic, 0, errors.New("jump destination is not a basic block start")
+		return ExitPanic, 0
 	}
 	pvm.PC = pvm.JumpTable[jumpIndex]
-	return ExitHalt, 0, nil
+	return ExitContinue, 0
 }
 
 func (pvm *PVM) isBasicBlockStart(address uint32) bool {
-	// TODO: Implement logic to check if the address is the start of a basic block
-	return true // Placeholder
+	return address < uint32(len(pvm.basicBlocks)) && pvm.basicBlocks[address]
 }
 
-// Memory operations
+// load reads size bytes at address into register r, sign-extending if signed.
+// Inaccessible memory results in a page fault.
+func (pvm *PVM) load(r int, address uint32, size uint32, signed bool, next uint32) (ExitReason, uint32) {
+	data, err := pvm.Memory.Read(address, size)
+	var fault *PageFault
+	if errors.As(err, &fault) {
+		return ExitFault, fault.Address
+	}
+	var buf [4]byte
+	copy(buf[:], data)
+	value := binary.LittleEndian.Uint32(buf[:])
+	if signed {
+		value = signExtend(value, uint(size*8))
+	}
+	pvm.Registers[r] = value
+	pvm.PC = next
+	return ExitContinue, 0
+}
 
-func (m *Memory) Read(address uint32, size uint32) ([]byte, error) {
-	if address+size > uint32(len(m.Data)) {
-		return nil, errors.New("memory read out of bounds")
+// store writes the low size bytes of value to address. Inaccessible or
+// read-only memory results in a page fault.
+func (pvm *PVM) store(address uint32, size uint32, value uint32, next uint32) (ExitReason, uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], value)
+	err := pvm.Memory.Write(address, buf[:size])
+	var fault *PageFault
+	if errors.As(err, &fault) {
+		return ExitFault, fault.Address
 	}
-	for i := uint32(0); i < size; i++ {
-		if !m.ReadMask[address+i] {
-			return nil, errors.New("memory read access violation")
-		}
+	pvm.PC = next
+	return ExitContinue, 0
+}
+
+// Arithmetic helpers
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
 	}
-	return m.Data[address : address+size], nil
+	return 0
+}
+
+func mulUpperSS(a, b uint32) uint32 {
+	return uint32(uint64(int64(int32(a))*int64(int32(b))) >> 32)
+}
+
+func mulUpperUU(a, b uint32) uint32 {
+	return uint32((uint64(a) * uint64(b)) >> 32)
 }
 
-func (m *Memory) Write(address uint32, value []byte) error {
-	if address+uint32(len(value)) > uint32(len(m.Data)) {
-		return errors.New("memory write out of bounds")
+// divU returns 2^32-1 on division by zero.
+func divU(a, b uint32) uint32 {
+	if b == 0 {
+		return 0xFFFFFFFF
 	}
-	for i := uint32(0); i < uint32(len(value)); i++ {
-		if !m.WriteMask[address+i] {
-			return errors.New("memory write access violation")
-		}
+	return a / b
+}
+
+// divS returns 2^32-1 on division by zero, and the dividend on overflow.
+func divS(a, b uint32) uint32 {
+	if b == 0 {
+		return 0xFFFFFFFF
 	}
-	copy(m.Data[address:], value)
-	return nil
+	if int32(a) == -1<<31 && int32(b) == -1 {
+		return a
+	}
+	return uint32(int32(a) / int32(b))
 }
 
-func ExecutePVM(code []byte, entryPoint uint32, args ...interface{}) (interface{}, error) {
-	pvm, err := NewPVM(code, nil, 1000) // Gas limit of 1000
+// remU returns the dividend on division by zero.
+func remU(a, b uint32) uint32 {
+	if b == 0 {
+		return a
+	}
+	return a % b
+}
+
+// remS returns the dividend on division by zero, and zero on overflow. The
+// result takes the sign of the dividend.
+func remS(a, b uint32) uint32 {
+	if b == 0 {
+		return a
+	}
+	if int32(a) == -1<<31 && int32(b) == -1 {
+		return 0
+	}
+	return uint32(int32(a) % int32(b))
+}
+
+// ExecutePVM runs a standard program blob from entryPoint with the given gas
+// limit and argument data, dispatching host calls to host, and returns the
+// output left in memory at ω7 with length ω8 together with the remaining gas.
+// A guest that does not halt results in a WorkError.
+func ExecutePVM(program []byte, entryPoint uint32, gasLimit uint64, args []byte, host HostFunctions) ([]byte, int64, error) {
+	pvm, err := NewStandardPVM(program, entryPoint, args, gasLimit)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	exitReason, value, err := pvm.Execute()
+	exitReason, _, gas, err := pvm.ExecuteWithHost(host)
 	if err != nil {
-		return nil, err
+		return nil, gas, err
 	}
+	output, err := pvm.output(exitReason)
+	return output, gas, err
+}
+
+// output returns the data a halted program left at ω7 with length ω8, or the
+// WorkError for its exit if it did not halt.
+func (pvm *PVM) output(exitReason ExitReason) ([]byte, error) {
 	if exitReason != ExitHalt {
-		return nil, errors.New("pvm execution failed")
+		return nil, workErrorFor(exitReason)
+	}
+	output, err := pvm.Memory.Read(pvm.Registers[7], pvm.Registers[8])
+	if err != nil {
+		return []byte{}, nil
 	}
-	return value, nil
+	return output, nil
 }
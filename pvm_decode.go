@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PVM opcodes, as listed in the Gray Paper appendix A.5.
+const (
+	// Instructions without arguments
+	OpTrap        byte = 0
+	OpFallthrough byte = 17
+
+	// Instructions with arguments of one immediate
+	OpEcalli byte = 78
+
+	// Instructions with arguments of two immediates
+	OpStoreImmU8  byte = 62
+	OpStoreImmU16 byte = 79
+	OpStoreImmU32 byte = 38
+
+	// Instructions with arguments of one offset
+	OpJump byte = 5
+
+	// Instructions with arguments of one register and one immediate
+	OpJumpInd  byte = 19
+	OpLoadImm  byte = 4
+	OpLoadU8   byte = 60
+	OpLoadI8   byte = 74
+	OpLoadU16  byte = 76
+	OpLoadI16  byte = 66
+	OpLoadU32  byte = 10
+	OpStoreU8  byte = 71
+	OpStoreU16 byte = 69
+	OpStoreU32 byte = 22
+
+	// Instructions with arguments of one register and two immediates
+	OpStoreImmIndU8  byte = 26
+	OpStoreImmIndU16 byte = 54
+	OpStoreImmIndU32 byte = 13
+
+	// Instructions with arguments of one register, one immediate and one offset
+	OpLoadImmJump  byte = 6
+	OpBranchEqImm  byte = 7
+	OpBranchNeImm  byte = 15
+	OpBranchLtUImm byte = 44
+	OpBranchLeUImm byte = 59
+	OpBranchGeUImm byte = 52
+	OpBranchGtUImm byte = 50
+	OpBranchLtSImm byte = 32
+	OpBranchLeSImm byte = 46
+	OpBranchGeSImm byte = 45
+	OpBranchGtSImm byte = 53
+
+	// Instructions with arguments of two registers
+	OpMoveReg byte = 82
+	OpSbrk    byte = 87
+
+	// Instructions with arguments of two registers and one immediate
+	OpStoreIndU8    byte = 16
+	OpStoreIndU16   byte = 29
+	OpStoreIndU32   byte = 3
+	OpLoadIndU8     byte = 11
+	OpLoadIndI8     byte = 21
+	OpLoadIndU16    byte = 37
+	OpLoadIndI16    byte = 33
+	OpLoadIndU32    byte = 1
+	OpAddImm        byte = 2
+	OpAndImm        byte = 18
+	OpXorImm        byte = 31
+	OpOrImm         byte = 49
+	OpMulImm        byte = 35
+	OpMulUpperSSImm byte = 65
+	OpMulUpperUUImm byte = 63
+	OpSetLtUImm     byte = 27
+	OpSetLtSImm     byte = 56
+	OpShloLImm      byte = 9
+	OpShloRImm      byte = 14
+	OpSharRImm      byte = 25
+	OpNegAddImm     byte = 40
+	OpSetGtUImm     byte = 39
+	OpSetGtSImm     byte = 61
+	OpShloLImmAlt   byte = 75
+	OpShloRImmAlt   byte = 72
+	OpSharRImmAlt   byte = 80
+	OpCmovIzImm     byte = 85
+	OpCmovNzImm     byte = 86
+
+	// Instructions with arguments of two registers and one offset
+	OpBranchEq  byte = 24
+	OpBranchNe  byte = 30
+	OpBranchLtU byte = 47
+	OpBranchLtS byte = 48
+	OpBranchGeU byte = 41
+	OpBranchGeS byte = 43
+
+	// Instructions with arguments of two registers and two immediates
+	OpLoadImmJumpInd byte = 42
+
+	// Instructions with arguments of three registers
+	OpAdd        byte = 8
+	OpSub        byte = 20
+	OpAnd        byte = 23
+	OpXor        byte = 28
+	OpOr         byte = 12
+	OpMul        byte = 34
+	OpMulUpperSS byte = 67
+	OpMulUpperUU byte = 57
+	OpMulUpperSU byte = 81
+	OpDivU       byte = 68
+	OpDivS       byte = 64
+	OpRemU       byte = 73
+	OpRemS       byte = 70
+	OpSetLtU     byte = 36
+	OpSetLtS     byte = 58
+	OpShloL      byte = 55
+	OpShloR      byte = 51
+	OpSharR      byte = 77
+	OpCmovIz     byte = 83
+	OpCmovNz     byte = 84
+)
+
+// InstructionClass determines how the operands following an opcode are laid out.
+type InstructionClass int
+
+const (
+	ClassInvalid InstructionClass = iota
+	ClassNoArgs
+	ClassOneImm
+	ClassTwoImm
+	ClassOneOffset
+	ClassOneRegOneImm
+	ClassOneRegTwoImm
+	ClassOneRegOneImmOneOffset
+	ClassTwoReg
+	ClassTwoRegOneImm
+	ClassTwoRegOneOffset
+	ClassTwoRegTwoImm
+	ClassThreeReg
+)
+
+var instructionClasses = func() [256]InstructionClass {
+	var classes [256]InstructionClass
+	set := func(class InstructionClass, opcodes ...byte) {
+		for _, op := range opcodes {
+			classes[op] = class
+		}
+	}
+	set(ClassNoArgs, OpTrap, OpFallthrough)
+	set(ClassOneImm, OpEcalli)
+	set(ClassTwoImm, OpStoreImmU8, OpStoreImmU16, OpStoreImmU32)
+	set(ClassOneOffset, OpJump)
+	set(ClassOneRegOneImm, OpJumpInd, OpLoadImm, OpLoadU8, OpLoadI8, OpLoadU16, OpLoadI16, OpLoadU32,
+		OpStoreU8, OpStoreU16, OpStoreU32)
+	set(ClassOneRegTwoImm, OpStoreImmIndU8, OpStoreImmIndU16, OpStoreImmIndU32)
+	set(ClassOneRegOneImmOneOffset, OpLoadImmJump, OpBranchEqImm, OpBranchNeImm, OpBranchLtUImm, OpBranchLeUImm,
+		OpBranchGeUImm, OpBranchGtUImm, OpBranchLtSImm, OpBranchLeSImm, OpBranchGeSImm, OpBranchGtSImm)
+	set(ClassTwoReg, OpMoveReg, OpSbrk)
+	set(ClassTwoRegOneImm, OpStoreIndU8, OpStoreIndU16, OpStoreIndU32, OpLoadIndU8, OpLoadIndI8, OpLoadIndU16,
+		OpLoadIndI16, OpLoadIndU32, OpAddImm, OpAndImm, OpXorImm, OpOrImm, OpMulImm, OpMulUpperSSImm,
+		OpMulUpperUUImm, OpSetLtUImm, OpSetLtSImm, OpShloLImm, OpShloRImm, OpSharRImm, OpNegAddImm, OpSetGtUImm,
+		OpSetGtSImm, OpShloLImmAlt, OpShloRImmAlt, OpSharRImmAlt, OpCmovIzImm, OpCmovNzImm)
+	set(ClassTwoRegOneOffset, OpBranchEq, OpBranchNe, OpBranchLtU, OpBranchLtS, OpBranchGeU, OpBranchGeS)
+	set(ClassTwoRegTwoImm, OpLoadImmJumpInd)
+	set(ClassThreeReg, OpAdd, OpSub, OpAnd, OpXor, OpOr, OpMul, OpMulUpperSS, OpMulUpperUU, OpMulUpperSU,
+		OpDivU, OpDivS, OpRemU, OpRemS, OpSetLtU, OpSetLtS, OpShloL, OpShloR, OpSharR, OpCmovIz, OpCmovNz)
+	return classes
+}()
+
+// mnemonics holds the Gray Paper name of each opcode.
+var mnemonics = [256]string{
+	OpTrap:           "trap",
+	OpFallthrough:    "fallthrough",
+	OpEcalli:         "ecalli",
+	OpStoreImmU8:     "store_imm_u8",
+	OpStoreImmU16:    "store_imm_u16",
+	OpStoreImmU32:    "store_imm_u32",
+	OpJump:           "jump",
+	OpJumpInd:        "jump_ind",
+	OpLoadImm:        "load_imm",
+	OpLoadU8:         "load_u8",
+	OpLoadI8:         "load_i8",
+	OpLoadU16:        "load_u16",
+	OpLoadI16:        "load_i16",
+	OpLoadU32:        "load_u32",
+	OpStoreU8:        "store_u8",
+	OpStoreU16:       "store_u16",
+	OpStoreU32:       "store_u32",
+	OpStoreImmIndU8:  "store_imm_ind_u8",
+	OpStoreImmIndU16: "store_imm_ind_u16",
+	OpStoreImmIndU32: "store_imm_ind_u32",
+	OpLoadImmJump:    "load_imm_jump",
+	OpBranchEqImm:    "branch_eq_imm",
+	OpBranchNeImm:    "branch_ne_imm",
+	OpBranchLtUImm:   "branch_lt_u_imm",
+	OpBranchLeUImm:   "branch_le_u_imm",
+	OpBranchGeUImm:   "branch_ge_u_imm",
+	OpBranchGtUImm:   "branch_gt_u_imm",
+	OpBranchLtSImm:   "branch_lt_s_imm",
+	OpBranchLeSImm:   "branch_le_s_imm",
+	OpBranchGeSImm:   "branch_ge_s_imm",
+	OpBranchGtSImm:   "branch_gt_s_imm",
+	OpMoveReg:        "move_reg",
+	OpSbrk:           "sbrk",
+	OpStoreIndU8:     "store_ind_u8",
+	OpStoreIndU16:    "store_ind_u16",
+	OpStoreIndU32:    "store_ind_u32",
+	OpLoadIndU8:      "load_ind_u8",
+	OpLoadIndI8:      "load_ind_i8",
+	OpLoadIndU16:     "load_ind_u16",
+	OpLoadIndI16:     "load_ind_i16",
+	OpLoadIndU32:     "load_ind_u32",
+	OpAddImm:         "add_imm",
+	OpAndImm:         "and_imm",
+	OpXorImm:         "xor_imm",
+	OpOrImm:          "or_imm",
+	OpMulImm:         "mul_imm",
+	OpMulUpperSSImm:  "mul_upper_s_s_imm",
+	OpMulUpperUUImm:  "mul_upper_u_u_imm",
+	OpSetLtUImm:      "set_lt_u_imm",
+	OpSetLtSImm:      "set_lt_s_imm",
+	OpShloLImm:       "shlo_l_imm",
+	OpShloRImm:       "shlo_r_imm",
+	OpSharRImm:       "shar_r_imm",
+	OpNegAddImm:      "neg_add_imm",
+	OpSetGtUImm:      "set_gt_u_imm",
+	OpSetGtSImm:      "set_gt_s_imm",
+	OpShloLImmAlt:    "shlo_l_imm_alt",
+	OpShloRImmAlt:    "shlo_r_imm_alt",
+	OpSharRImmAlt:    "shar_r_imm_alt",
+	OpCmovIzImm:      "cmov_iz_imm",
+	OpCmovNzImm:      "cmov_nz_imm",
+	OpBranchEq:       "branch_eq",
+	OpBranchNe:       "branch_ne",
+	OpBranchLtU:      "branch_lt_u",
+	OpBranchLtS:      "branch_lt_s",
+	OpBranchGeU:      "branch_ge_u",
+	OpBranchGeS:      "branch_ge_s",
+	OpLoadImmJumpInd: "load_imm_jump_ind",
+	OpAdd:            "add",
+	OpSub:            "sub",
+	OpAnd:            "and",
+	OpXor:            "xor",
+	OpOr:             "or",
+	OpMul:            "mul",
+	OpMulUpperSS:     "mul_upper_s_s",
+	OpMulUpperUU:     "mul_upper_u_u",
+	OpMulUpperSU:     "mul_upper_s_u",
+	OpDivU:           "div_u",
+	OpDivS:           "div_s",
+	OpRemU:           "rem_u",
+	OpRemS:           "rem_s",
+	OpSetLtU:         "set_lt_u",
+	OpSetLtS:         "set_lt_s",
+	OpShloL:          "shlo_l",
+	OpShloR:          "shlo_r",
+	OpSharR:          "shar_r",
+	OpCmovIz:         "cmov_iz",
+	OpCmovNz:         "cmov_nz",
+}
+
+// isTerminator reports whether opcode ends a basic block.
+func isTerminator(opcode byte) bool {
+	switch opcode {
+	case OpTrap, OpFallthrough, OpJumpInd, OpLoadImmJumpInd:
+		return true
+	}
+	switch instructionClasses[opcode] {
+	case ClassOneOffset, ClassOneRegOneImmOneOffset, ClassTwoRegOneOffset:
+		return true
+	}
+	return false
+}
+
+// Instruction is a single decoded PVM instruction. Offsets are already
+// resolved into absolute program counter values.
+type Instruction struct {
+	Opcode byte
+	Class  InstructionClass
+	Length uint32 // Including the opcode byte
+	RegA   int
+	RegB   int
+	RegD   int
+	ImmX   uint32
+	ImmY   uint32
+}
+
+// decodeInstruction decodes the instruction starting at pc. Code beyond the
+// end of the blob reads as zero, as if the blob were infinitely padded.
+func (pvm *PVM) decodeInstruction(pc uint32) Instruction {
+	opcode := pvm.codeByte(pc)
+	skip := pvm.skipLength(pc)
+	in := Instruction{
+		Opcode: opcode,
+		Class:  instructionClasses[opcode],
+		Length: skip + 1,
+	}
+
+	switch in.Class {
+	case ClassOneImm:
+		lx := min(4, skip)
+		in.ImmX = pvm.readImmediate(pc+1, lx)
+	case ClassTwoImm:
+		lx := min(4, uint32(pvm.codeByte(pc+1))%8)
+		ly := min(4, subClamp(skip, lx+1))
+		in.ImmX = pvm.readImmediate(pc+2, lx)
+		in.ImmY = pvm.readImmediate(pc+2+lx, ly)
+	case ClassOneOffset:
+		lx := min(4, skip)
+		in.ImmX = pc + pvm.readImmediate(pc+1, lx)
+	case ClassOneRegOneImm:
+		in.RegA = registerIndex(pvm.codeByte(pc+1) % 16)
+		lx := min(4, subClamp(skip, 1))
+		in.ImmX = pvm.readImmediate(pc+2, lx)
+	case ClassOneRegTwoImm:
+		b := pvm.codeByte(pc + 1)
+		in.RegA = registerIndex(b % 16)
+		lx := min(4, uint32(b/16)%8)
+		ly := min(4, subClamp(skip, lx+1))
+		in.ImmX = pvm.readImmediate(pc+2, lx)
+		in.ImmY = pvm.readImmediate(pc+2+lx, ly)
+	case ClassOneRegOneImmOneOffset:
+		b := pvm.codeByte(pc + 1)
+		in.RegA = registerIndex(b % 16)
+		lx := min(4, uint32(b/16)%8)
+		ly := min(4, subClamp(skip, lx+1))
+		in.ImmX = pvm.readImmediate(pc+2, lx)
+		in.ImmY = pc + pvm.readImmediate(pc+2+lx, ly)
+	case ClassTwoReg:
+		b := pvm.codeByte(pc + 1)
+		in.RegD = registerIndex(b % 16)
+		in.RegA = registerIndex(b / 16)
+	case ClassTwoRegOneImm:
+		b := pvm.codeByte(pc + 1)
+		in.RegA = registerIndex(b % 16)
+		in.RegB = registerIndex(b / 16)
+		lx := min(4, subClamp(skip, 1))
+		in.ImmX = pvm.readImmediate(pc+2, lx)
+	case ClassTwoRegOneOffset:
+		b := pvm.codeByte(pc + 1)
+		in.RegA = registerIndex(b % 16)
+		in.RegB = registerIndex(b / 16)
+		lx := min(4, subClamp(skip, 1))
+		in.ImmX = pc + pvm.readImmediate(pc+2, lx)
+	case ClassTwoRegTwoImm:
+		b := pvm.codeByte(pc + 1)
+		in.RegA = registerIndex(b % 16)
+		in.RegB = registerIndex(b / 16)
+		lx := min(4, uint32(pvm.codeByte(pc+2))%8)
+		ly := min(4, subClamp(skip, lx+2))
+		in.ImmX = pvm.readImmediate(pc+3, lx)
+		in.ImmY = pvm.readImmediate(pc+3+lx, ly)
+	case ClassThreeReg:
+		b := pvm.codeByte(pc + 1)
+		in.RegA = registerIndex(b % 16)
+		in.RegB = registerIndex(b / 16)
+		in.RegD = registerIndex(pvm.codeByte(pc + 2))
+	}
+
+	return in
+}
+
+// codeByte returns the code byte at index i, or zero past the end of the code.
+func (pvm *PVM) codeByte(i uint32) byte {
+	if i >= uint32(len(pvm.Code)) {
+		return 0
+	}
+	return pvm.Code[i]
+}
+
+func registerIndex(b byte) int {
+	return min(RegisterCount-1, int(b))
+}
+
+func subClamp(a, b uint32) uint32 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
+
+// Mnemonic returns the Gray Paper name of the instruction's opcode.
+func (in Instruction) Mnemonic() string {
+	if name := mnemonics[in.Opcode]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("invalid_%d", in.Opcode)
+}
+
+// Operands formats the instruction's operands in the order they are
+// encoded. Immediates are shown in hexadecimal and jump targets as @pc.
+func (in Instruction) Operands() string {
+	reg := func(r int) string { return fmt.Sprintf("r%d", r) }
+	imm := func(v uint32) string { return fmt.Sprintf("0x%x", v) }
+	target := func(pc uint32) string { return fmt.Sprintf("@%d", pc) }
+
+	var operands []string
+	switch in.Class {
+	case ClassOneImm:
+		operands = []string{imm(in.ImmX)}
+	case ClassTwoImm:
+		operands = []string{imm(in.ImmX), imm(in.ImmY)}
+	case ClassOneOffset:
+		operands = []string{target(in.ImmX)}
+	case ClassOneRegOneImm:
+		operands = []string{reg(in.RegA), imm(in.ImmX)}
+	case ClassOneRegTwoImm:
+		operands = []string{reg(in.RegA), imm(in.ImmX), imm(in.ImmY)}
+	case ClassOneRegOneImmOneOffset:
+		operands = []string{reg(in.RegA), imm(in.ImmX), target(in.ImmY)}
+	case ClassTwoReg:
+		operands = []string{reg(in.RegD), reg(in.RegA)}
+	case ClassTwoRegOneImm:
+		operands = []string{reg(in.RegA), reg(in.RegB), imm(in.ImmX)}
+	case ClassTwoRegOneOffset:
+		operands = []string{reg(in.RegA), reg(in.RegB), target(in.ImmX)}
+	case ClassTwoRegTwoImm:
+		operands = []string{reg(in.RegA), reg(in.RegB), imm(in.ImmX), imm(in.ImmY)}
+	case ClassThreeReg:
+		operands = []string{reg(in.RegD), reg(in.RegA), reg(in.RegB)}
+	}
+	return strings.Join(operands, ", ")
+}
+
+func (in Instruction) String() string {
+	if operands := in.Operands(); operands != "" {
+		return in.Mnemonic() + " " + operands
+	}
+	return in.Mnemonic()
+}
@@ -1,35 +1,533 @@
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestPVM(t *testing.T) { // Example code (a simple program that adds two numbers)
 	code := []byte{
 		0x04, 0x00, 0x0A, 0x00, 0x00, 0x00, // load_imm 10 into register 0
 		0x04, 0x01, 0x14, 0x00, 0x00, 0x00, // load_imm 20 into register 1
-		0x08, 0x00, 0x01, 0x02, // add register 0 and 1, store result in register 2
-		0x00, // trap (halt)
+		0x08, 0x10, 0x02, // add register 0 and 1, store result in register 2
+		0x13, 0x03, // jump_ind to register 3 (halt)
 	}
+	bitmask := []byte{0b01000001, 0b10010000, 0b00}
 
 	// Jump table (in this simple example, we only have one basic block)
 	jumpTable := []uint32{0}
 
 	// Create a new PVM instance
-	pvm, err := NewPVM(code, jumpTable, 1000) // Gas limit of 1000
+	pvm, err := NewPVM(code, bitmask, jumpTable, 1000) // Gas limit of 1000
 	if err != nil {
 		panic(err)
 	}
+	pvm.Registers[3] = HaltAddress
 
 	// Execute the PVM
-	exitReason, _, err := pvm.Execute()
+	exitReason, _, gas := pvm.Execute()
+
+	// Check the result
+	assert.Equal(t, ExitHalt, exitReason)
+	assert.Equal(t, uint32(30), pvm.Registers[2]) // The result should be in register 2
+	assert.Equal(t, int64(996), gas)
+}
+
+func TestPVMInstructions(t *testing.T) {
+	testCases := []struct {
+		name      string
+		code      []byte
+		bitmask   []byte // Defaults to a single instruction at 0
+		registers map[int]uint32
+		expected  map[int]uint32
+		exit      ExitReason
+		pc        uint32
+	}{
+		{
+			name:     "load_imm sign-extends",
+			code:     []byte{OpLoadImm, 0x02, 0xFE},
+			expected: map[int]uint32{2: 0xFFFFFFFE},
+			exit:     ExitContinue,
+			pc:       3,
+		},
+		{
+			name:      "add",
+			code:      []byte{OpAdd, 0x32, 0x04},
+			registers: map[int]uint32{2: 10, 3: 20},
+			expected:  map[int]uint32{4: 30},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "sub wraps around",
+			code:      []byte{OpSub, 0x32, 0x04},
+			registers: map[int]uint32{2: 10, 3: 20},
+			expected:  map[int]uint32{4: 0xFFFFFFF6},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "div_u by zero",
+			code:      []byte{OpDivU, 0x32, 0x04},
+			registers: map[int]uint32{2: 10, 3: 0},
+			expected:  map[int]uint32{4: 0xFFFFFFFF},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "div_s overflow",
+			code:      []byte{OpDivS, 0x32, 0x04},
+			registers: map[int]uint32{2: 0x80000000, 3: 0xFFFFFFFF},
+			expected:  map[int]uint32{4: 0x80000000},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "rem_s takes sign of dividend",
+			code:      []byte{OpRemS, 0x32, 0x04},
+			registers: map[int]uint32{2: uint32(0xFFFFFFF9), 3: 2}, // -7 % 2
+			expected:  map[int]uint32{4: 0xFFFFFFFF},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "rem_u by zero",
+			code:      []byte{OpRemU, 0x32, 0x04},
+			registers: map[int]uint32{2: 7, 3: 0},
+			expected:  map[int]uint32{4: 7},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "mul_upper_s_s",
+			code:      []byte{OpMulUpperSS, 0x32, 0x04},
+			registers: map[int]uint32{2: 0xFFFFFFFF, 3: 2}, // -1 * 2
+			expected:  map[int]uint32{4: 0xFFFFFFFF},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "shar_r",
+			code:      []byte{OpSharR, 0x32, 0x04},
+			registers: map[int]uint32{2: 0x80000000, 3: 36},
+			expected:  map[int]uint32{4: 0xF8000000},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "cmov_iz",
+			code:      []byte{OpCmovIz, 0x32, 0x04},
+			registers: map[int]uint32{2: 5, 3: 0, 4: 9},
+			expected:  map[int]uint32{4: 5},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "cmov_nz not taken",
+			code:      []byte{OpCmovNz, 0x32, 0x04},
+			registers: map[int]uint32{2: 5, 3: 0, 4: 9},
+			expected:  map[int]uint32{4: 9},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "add_imm",
+			code:      []byte{OpAddImm, 0x32, 0xFF},
+			registers: map[int]uint32{3: 10},
+			expected:  map[int]uint32{2: 9},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "neg_add_imm",
+			code:      []byte{OpNegAddImm, 0x32, 0x0A},
+			registers: map[int]uint32{3: 3},
+			expected:  map[int]uint32{2: 7},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "set_lt_s_imm",
+			code:      []byte{OpSetLtSImm, 0x32, 0x00},
+			registers: map[int]uint32{3: 0xFFFFFFFF},
+			expected:  map[int]uint32{2: 1},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "shlo_l_imm_alt",
+			code:      []byte{OpShloLImmAlt, 0x32, 0x03},
+			registers: map[int]uint32{3: 4},
+			expected:  map[int]uint32{2: 48},
+			exit:      ExitContinue,
+			pc:        3,
+		},
+		{
+			name:      "move_reg",
+			code:      []byte{OpMoveReg, 0x32},
+			registers: map[int]uint32{3: 42},
+			expected:  map[int]uint32{2: 42},
+			exit:      ExitContinue,
+			pc:        2,
+		},
+		{
+			name:      "branch_eq_imm taken",
+			code:      []byte{OpBranchEqImm, 0x12, 0x05, 0x05, OpFallthrough, OpTrap},
+			bitmask:   []byte{0b110001},
+			registers: map[int]uint32{2: 5},
+			exit:      ExitContinue,
+			pc:        5,
+		},
+		{
+			name:      "branch_eq_imm not taken",
+			code:      []byte{OpBranchEqImm, 0x12, 0x05, 0x05, OpFallthrough, OpTrap},
+			bitmask:   []byte{0b110001},
+			registers: map[int]uint32{2: 6},
+			exit:      ExitContinue,
+			pc:        4,
+		},
+		{
+			name:      "branch_lt_s",
+			code:      []byte{OpBranchLtS, 0x32, 0x04, OpFallthrough, OpTrap},
+			bitmask:   []byte{0b11001},
+			registers: map[int]uint32{2: 0xFFFFFFFF, 3: 0},
+			exit:      ExitContinue,
+			pc:        4,
+		},
+		{
+			name:    "jump",
+			code:    []byte{OpJump, 0x03, OpFallthrough, OpTrap},
+			bitmask: []byte{0b1101},
+			exit:    ExitContinue,
+			pc:      3,
+		},
+		{
+			name:    "jump into the middle of a basic block",
+			code:    []byte{OpJump, 0x03, OpAddImm, OpTrap},
+			bitmask: []byte{0b1101},
+			exit:    ExitPanic,
+		},
+		{
+			name:      "jump_ind to halt address",
+			code:      []byte{OpJumpInd, 0x02},
+			registers: map[int]uint32{2: HaltAddress},
+			exit:      ExitHalt,
+		},
+		{
+			name: "trap",
+			code: []byte{OpTrap},
+			exit: ExitPanic,
+		},
+		{
+			name:     "load_u8 from inaccessible memory",
+			code:     []byte{OpLoadU8, 0x02, 0x00, 0x20},
+			expected: map[int]uint32{2: 0},
+			exit:     ExitFault,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bitmask := tc.bitmask
+			if bitmask == nil {
+				bitmask = []byte{0b1}
+			}
+			pvm, err := NewPVM(tc.code, bitmask, nil, 1000)
+			assert.NoError(t, err)
+			for r, v := range tc.registers {
+				pvm.Registers[r] = v
+			}
+
+			exitReason, _ := pvm.Step()
+
+			assert.Equal(t, tc.exit, exitReason)
+			assert.Equal(t, tc.pc, pvm.PC)
+			for r, v := range tc.expected {
+				assert.Equal(t, v, pvm.Registers[r], "register %d", r)
+			}
+		})
+	}
+}
+
+func TestPVMLoadStore(t *testing.T) {
+	code := []byte{OpStoreIndU16, 0x32, 0x04, OpLoadIndI16, 0x34, 0x04}
+	pvm, err := NewPVM(code, []byte{0b001001}, nil, 1000)
+	assert.NoError(t, err)
+
+	pvm.Memory.SetAccess(0x20000, PageSize, PageReadWrite)
+	pvm.Registers[2] = 0x1234FFFE
+	pvm.Registers[3] = 0x20000
+
+	exitReason, _ := pvm.Step()
+	assert.Equal(t, ExitContinue, exitReason)
+	data, err := pvm.Memory.Read(0x20004, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xFE, 0xFF}, data)
+
+	exitReason, _ = pvm.Step()
+	assert.Equal(t, ExitContinue, exitReason)
+	assert.Equal(t, uint32(0xFFFFFFFE), pvm.Registers[4])
+
+	pvm.Registers[3] = 0x30000
+	pvm.PC = 3
+	exitReason, address := pvm.Step()
+	assert.Equal(t, ExitFault, exitReason)
+	assert.Equal(t, uint32(0x30000), address)
+}
+
+func TestPVMSkipLength(t *testing.T) {
+	code := make([]byte, 40)
+	bitmask := []byte{0b00001001, 0, 0, 0, 0b00000001}
+	pvm, err := NewPVM(code, bitmask, nil, 1000)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint32(2), pvm.skipLength(0))
+	assert.Equal(t, uint32(24), pvm.skipLength(3), "skip length is capped at 24")
+	assert.Equal(t, uint32(3), pvm.skipLength(36), "bitmask reads as set past the end of the code")
+}
+
+func TestPVMBasicBlocks(t *testing.T) {
+	code := []byte{
+		OpLoadImm, 0x02, 0x05, // 0
+		OpJump, 0x03, // 3: terminator
+		OpAdd, 0x32, 0x04, // 5: starts a basic block
+		OpAddImm, 0x32, 0x01, // 8
+		OpFallthrough, // 11: terminator
+		0xFF,          // 12: invalid opcode, not a basic block
+	}
+	bitmask := []byte{0b00101001, 0b00011001}
+	pvm, err := NewPVM(code, bitmask, nil, 1000)
+	assert.NoError(t, err)
+
+	var starts []uint32
+	for i := range code {
+		if pvm.isBasicBlockStart(uint32(i)) {
+			starts = append(starts, uint32(i))
+		}
+	}
+	assert.Equal(t, []uint32{0, 5}, starts)
+}
+
+func TestPVMDynamicJump(t *testing.T) {
+	code := []byte{OpJumpInd, 0x02, OpFallthrough, OpFallthrough}
+	jumpTable := []uint32{2, 3, 1}
+
+	testCases := []struct {
+		name    string
+		address uint32
+		exit    ExitReason
+		pc      uint32
+	}{
+		{"Halt address", HaltAddress, ExitHalt, 0},
+		{"First entry", 2, ExitContinue, 2},
+		{"Second entry", 4, ExitContinue, 3},
+		{"Zero address", 0, ExitPanic, 0},
+		{"Misaligned address", 3, ExitPanic, 0},
+		{"Past the jump table", 8, ExitPanic, 0},
+		{"Entry not a basic block start", 6, ExitPanic, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pvm, err := NewPVM(code, []byte{0b1101}, jumpTable, 1000)
+			assert.NoError(t, err)
+			pvm.Registers[2] = tc.address
+
+			exitReason, _ := pvm.Step()
+
+			assert.Equal(t, tc.exit, exitReason)
+			assert.Equal(t, tc.pc, pvm.PC)
+		})
+	}
+}
+
+func TestPVMGas(t *testing.T) {
+	code := []byte{
+		OpLoadImm, 0x02, 0x05, // 0
+		OpFallthrough,        // 3
+		OpAddImm, 0x22, 0xFF, // 4
+		OpBranchNeImm, 0x02, 0xFD, // 7: loop back to 4 while r2 != 0
+		OpJumpInd, 0x00, // 10
+	}
+	bitmask := []byte{0b10011001, 0b100}
+	jumpTable := []uint32{}
+
+	testCases := []struct {
+		name     string
+		mode     GasMode
+		gasLimit uint64
+		exit     ExitReason
+		gas      int64
+		r2       uint32
+	}{
+		{"Per instruction", GasPerInstruction, 100, ExitHalt, 100 - 13, 0},
+		{"Per instruction out of gas", GasPerInstruction, 5, ExitOOG, -1, 3},
+		{"Per basic block", GasPerBasicBlock, 100, ExitHalt, 100 - 13, 0},
+		{"Per basic block out of gas", GasPerBasicBlock, 5, ExitOOG, -1, 4},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pvm, err := NewPVM(code, bitmask, jumpTable, tc.gasLimit)
+			assert.NoError(t, err)
+			pvm.GasMode = tc.mode
+			pvm.Registers[0] = HaltAddress
+
+			exitReason, _, gas := pvm.Execute()
+
+			assert.Equal(t, tc.exit, exitReason)
+			assert.Equal(t, tc.gas, gas)
+			assert.Equal(t, tc.r2, pvm.Registers[2])
+		})
+	}
+}
+
+// PVMTestCase is a conformance case from jamtestvectors/pvm.
+type PVMTestCase struct {
+	Name           string          `json:"name"`
+	InitialRegs    []uint32        `json:"initial-regs"`
+	InitialPC      uint32          `json:"initial-pc"`
+	InitialPageMap []PVMTestPage   `json:"initial-page-map"`
+	InitialMemory  []PVMTestMemory `json:"initial-memory"`
+	InitialGas     int64           `json:"initial-gas"`
+	Program        byteArray       `json:"program"`
+	ExpectedStatus string          `json:"expected-status"`
+	ExpectedRegs   []uint32        `json:"expected-regs"`
+	ExpectedPC     uint32          `json:"expected-pc"`
+	ExpectedMemory []PVMTestMemory `json:"expected-memory"`
+	ExpectedGas    int64           `json:"expected-gas"`
+	ExpectedFault  *uint32         `json:"expected-page-fault-address"`
+}
+
+type PVMTestPage struct {
+	Address    uint32 `json:"address"`
+	Length     uint32 `json:"length"`
+	IsWritable bool   `json:"is-writable"`
+}
+
+type PVMTestMemory struct {
+	Address  uint32    `json:"address"`
+	Contents byteArray `json:"contents"`
+}
+
+// byteArray decodes a JSON array of numbers, rather than base64, into bytes.
+type byteArray []byte
+
+func (b *byteArray) UnmarshalJSON(data []byte) error {
+	var values []int
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*b = make([]byte, len(values))
+	for i, v := range values {
+		(*b)[i] = byte(v)
+	}
+	return nil
+}
+
+var pvmTestStatuses = map[string]ExitReason{
+	"halt":       ExitHalt,
+	"trap":       ExitPanic,
+	"panic":      ExitPanic,
+	"page-fault": ExitFault,
+	"out-of-gas": ExitOOG,
+}
+
+// runPVMTestCase loads a conformance case into a PVM, runs it and checks the
+// final state.
+func runPVMTestCase(t *testing.T, tc PVMTestCase) {
+	blob, err := ParseCodeBlob(tc.Program)
+	assert.NoError(t, err)
+	pvm, err := NewPVM(blob.Code, blob.Bitmask, blob.JumpTable, uint64(tc.InitialGas))
+	assert.NoError(t, err)
+
+	copy(pvm.Registers[:], tc.InitialRegs)
+	pvm.PC = tc.InitialPC
+	for _, page := range tc.InitialPageMap {
+		pvm.Memory.SetAccess(page.Address, page.Length, PageReadWrite)
+	}
+	for _, chunk := range tc.InitialMemory {
+		assert.NoError(t, pvm.Memory.Write(chunk.Address, chunk.Contents))
+	}
+	for _, page := range tc.InitialPageMap {
+		if !page.IsWritable {
+			pvm.Memory.SetAccess(page.Address, page.Length, PageReadOnly)
+		}
+	}
+
+	exitReason, value, gas := pvm.Execute()
+
+	expectedStatus, known := pvmTestStatuses[tc.ExpectedStatus]
+	assert.True(t, known, "Unknown expected status %q", tc.ExpectedStatus)
+	assert.Equal(t, expectedStatus, exitReason)
+	if tc.ExpectedFault != nil {
+		assert.Equal(t, *tc.ExpectedFault, value)
+	}
+	assert.Equal(t, tc.ExpectedRegs, pvm.Registers[:len(tc.ExpectedRegs)])
+	assert.Equal(t, tc.ExpectedPC, pvm.PC)
+	assert.Equal(t, tc.ExpectedGas, gas)
+	for _, chunk := range tc.ExpectedMemory {
+		data, err := pvm.Memory.Read(chunk.Address, uint32(len(chunk.Contents)))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(chunk.Contents), data)
+	}
+}
+
+func TestPVMTestVectors(t *testing.T) {
+	files, err := filepath.Glob("jamtestvectors/pvm/programs/*.json")
 	if err != nil {
-		panic(err)
+		t.Fatalf("Failed to read test files: %v", err)
+	}
+	if len(files) == 0 {
+		missingTestVectors(t, "PVM")
 	}
 
-	// Check the result
-	if exitReason == ExitHalt {
-		result := pvm.Registers[2] // The result should be in register 2
-		println("Result:", result) // Should print "Result: 30"
-	} else {
-		println("Execution failed with exit reason:", exitReason)
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Failed to read test file %s: %v", file, err)
+			}
+
+			var tc PVMTestCase
+			if err := json.Unmarshal(data, &tc); err != nil {
+				t.Fatalf("Failed to parse JSON in file %s: %v", file, err)
+			}
+			runPVMTestCase(t, tc)
+		})
 	}
 }
+
+func TestPVMTestCaseFormat(t *testing.T) {
+	// A case in the format of jamtestvectors/pvm: store_u32 of r7 to a
+	// writable page, then to a read-only one, faulting at the start of it
+	data := `{
+		"name": "inst_store_u32_read_only",
+		"initial-regs": [0, 0, 0, 0, 0, 0, 0, 305419896, 0, 0, 0, 0, 0],
+		"initial-pc": 0,
+		"initial-page-map": [
+			{"address": 131072, "length": 4096, "is-writable": false},
+			{"address": 135168, "length": 4096, "is-writable": true}
+		],
+		"initial-memory": [{"address": 131072, "contents": [1, 2]}],
+		"initial-gas": 10000,
+		"program": [0, 0, 10, 22, 7, 0, 16, 2, 22, 7, 0, 0, 2, 33, 0],
+		"expected-status": "page-fault",
+		"expected-regs": [0, 0, 0, 0, 0, 0, 0, 305419896, 0, 0, 0, 0, 0],
+		"expected-pc": 5,
+		"expected-memory": [
+			{"address": 131072, "contents": [1, 2, 0, 0]},
+			{"address": 135168, "contents": [120, 86, 52, 18]}
+		],
+		"expected-gas": 9998,
+		"expected-page-fault-address": 131072
+	}`
+
+	var tc PVMTestCase
+	assert.NoError(t, json.Unmarshal([]byte(data), &tc))
+	runPVMTestCase(t, tc)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const (
+	SegmentSize = 4104 // W_G: size of an imported or exported segment
+	ExportLimit = 2048 // W_X: maximum number of segments a package may export
+)
+
+// Exit codes returned by invoke for the inner machine.
+const (
+	InnerHalt uint32 = iota
+	InnerPanic
+	InnerFault
+	InnerHost
+	InnerOOG
+)
+
+// RefineHost implements the refine host calls. Refinement is stateless apart
+// from historical lookups, the segments it imports and exports and the inner
+// machines it creates.
+type RefineHost struct {
+	Service      *ServiceAccount
+	Accounts     map[uint32]ServiceAccount // Other services available to historical_lookup
+	Timeslot     uint32                    // Lookup anchor time slot
+	Imports      [][]byte
+	Exports      [][]byte
+	ExportOffset uint32 // Number of segments exported by earlier work items
+	Machines     map[uint32]*PVM
+}
+
+func (h *RefineHost) HostCall(index uint32, pvm *PVM) (ExitReason, error) {
+	if !chargeHostGas(pvm, HostCallGasCost) {
+		return ExitOOG, nil
+	}
+
+	switch index {
+	case HostGas:
+		pvm.Registers[7] = uint32(pvm.Gas)
+		pvm.Registers[8] = uint32(pvm.Gas >> 32)
+	case HostHistoricalLookup:
+		h.historicalLookup(pvm)
+	case HostImport:
+		h.importSegment(pvm)
+	case HostExport:
+		h.exportSegment(pvm)
+	case HostMachine:
+		h.machine(pvm)
+	case HostPeek:
+		h.peek(pvm)
+	case HostPoke:
+		h.poke(pvm)
+	case HostZero:
+		h.zero(pvm)
+	case HostVoid:
+		h.void(pvm)
+	case HostInvoke:
+		h.invoke(pvm)
+	case HostExpunge:
+		h.expunge(pvm)
+	default:
+		pvm.Registers[7] = ResultWhat
+	}
+	return ExitContinue, nil
+}
+
+func (h *RefineHost) historicalLookup(pvm *PVM) {
+	account := h.Service
+	if pvm.Registers[7] != 1<<32-1 {
+		other, exists := h.Accounts[pvm.Registers[7]]
+		account = &other
+		if !exists {
+			account = nil
+		}
+	}
+
+	hash, ok := readGuest(pvm, pvm.Registers[8], HashSize)
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	if account == nil {
+		pvm.Registers[7] = ResultNone
+		return
+	}
+	value, exists := account.HistoricalLookup(h.Timeslot, Hash(hash))
+	if !exists {
+		pvm.Registers[7] = ResultNone
+		return
+	}
+	writeGuestAvailable(pvm, pvm.Registers[9], pvm.Registers[10], value)
+}
+
+func (h *RefineHost) importSegment(pvm *PVM) {
+	index := pvm.Registers[7]
+	if index >= uint32(len(h.Imports)) {
+		pvm.Registers[7] = ResultNone
+		return
+	}
+	segment := h.Imports[index]
+	n := min(pvm.Registers[9], SegmentSize, uint32(len(segment)))
+	if !writeGuest(pvm, pvm.Registers[8], segment[:n]) {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	pvm.Registers[7] = ResultOK
+}
+
+func (h *RefineHost) exportSegment(pvm *PVM) {
+	data, ok := readGuest(pvm, pvm.Registers[7], min(pvm.Registers[8], SegmentSize))
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	if h.ExportOffset+uint32(len(h.Exports)) >= ExportLimit {
+		pvm.Registers[7] = ResultFull
+		return
+	}
+
+	segment := make([]byte, SegmentSize)
+	copy(segment, data)
+	h.Exports = append(h.Exports, segment)
+	pvm.Registers[7] = h.ExportOffset + uint32(len(h.Exports)) - 1
+}
+
+// machine creates an inner machine from the code blob in guest memory, with
+// all of its memory inaccessible, and returns its identifier.
+func (h *RefineHost) machine(pvm *PVM) {
+	program, ok := readGuest(pvm, pvm.Registers[7], pvm.Registers[8])
+	if !ok {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	blob, err := ParseCodeBlob(program)
+	if err != nil {
+		pvm.Registers[7] = ResultHuh
+		return
+	}
+	inner, err := NewPVM(blob.Code, blob.Bitmask, blob.JumpTable, math.MaxInt64)
+	if err != nil {
+		pvm.Registers[7] = ResultHuh
+		return
+	}
+	inner.PC = pvm.Registers[9]
+
+	if h.Machines == nil {
+		h.Machines = make(map[uint32]*PVM)
+	}
+	var id uint32
+	for h.Machines[id] != nil {
+		id++
+	}
+	h.Machines[id] = inner
+	pvm.Registers[7] = id
+}
+
+func (h *RefineHost) peek(pvm *PVM) {
+	inner, exists := h.Machines[pvm.Registers[7]]
+	if !exists {
+		pvm.Registers[7] = ResultWho
+		return
+	}
+	data, ok := readGuest(inner, pvm.Registers[9], pvm.Registers[10])
+	if !ok || !writeGuest(pvm, pvm.Registers[8], data) {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	pvm.Registers[7] = ResultOK
+}
+
+func (h *RefineHost) poke(pvm *PVM) {
+	inner, exists := h.Machines[pvm.Registers[7]]
+	if !exists {
+		pvm.Registers[7] = ResultWho
+		return
+	}
+	data, ok := readGuest(pvm, pvm.Registers[8], pvm.Registers[10])
+	if !ok || !writeGuest(inner, pvm.Registers[9], data) {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	pvm.Registers[7] = ResultOK
+}
+
+// zero maps ω9 pages from page ω8 of an inner machine as zeroed read-write
+// memory.
+func (h *RefineHost) zero(pvm *PVM) {
+	inner, exists := h.Machines[pvm.Registers[7]]
+	if !exists {
+		pvm.Registers[7] = ResultWho
+		return
+	}
+	page, count := pvm.Registers[8], pvm.Registers[9]
+	if !validPageRange(page, count) {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	inner.Memory.SetAccess(page*PageSize, count*PageSize, PageInaccessible)
+	inner.Memory.SetAccess(page*PageSize, count*PageSize, PageReadWrite)
+	pvm.Registers[7] = ResultOK
+}
+
+// void makes ω9 pages from page ω8 of an inner machine inaccessible, failing
+// if any of them already is.
+func (h *RefineHost) void(pvm *PVM) {
+	inner, exists := h.Machines[pvm.Registers[7]]
+	if !exists {
+		pvm.Registers[7] = ResultWho
+		return
+	}
+	page, count := pvm.Registers[8], pvm.Registers[9]
+	if !validPageRange(page, count) {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+	for i := page; i < page+count; i++ {
+		if inner.Memory.Access(i*PageSize) == PageInaccessible {
+			pvm.Registers[7] = ResultOOB
+			return
+		}
+	}
+	inner.Memory.SetAccess(page*PageSize, count*PageSize, PageInaccessible)
+	pvm.Registers[7] = ResultOK
+}
+
+// invoke runs an inner machine with the gas and registers held at ω8, as
+// E8(gas) ⌢ E4(registers), and writes them back once it exits. The exit code
+// is returned in ω7, with the host call index or fault address in ω8.
+func (h *RefineHost) invoke(pvm *PVM) {
+	inner, exists := h.Machines[pvm.Registers[7]]
+	if !exists {
+		pvm.Registers[7] = ResultWho
+		return
+	}
+	address := pvm.Registers[8]
+	data, ok := readGuest(pvm, address, 8+4*RegisterCount)
+	// The buffer is written back on exit, so it must be writable as well
+	if !ok || pvm.Memory.Write(address, data) != nil {
+		pvm.Registers[7] = ResultOOB
+		return
+	}
+
+	inner.Gas = int64(min(binary.LittleEndian.Uint64(data), math.MaxInt64))
+	for i := range inner.Registers {
+		inner.Registers[i] = binary.LittleEndian.Uint32(data[8+4*i:])
+	}
+
+	exitReason, value, _ := inner.Execute()
+
+	data = binary.LittleEndian.AppendUint64(data[:0], uint64(max(inner.Gas, 0)))
+	for _, r := range inner.Registers {
+		data = binary.LittleEndian.AppendUint32(data, r)
+	}
+	pvm.Memory.Write(address, data)
+
+	switch exitReason {
+	case ExitHalt:
+		pvm.Registers[7] = InnerHalt
+	case ExitFault:
+		pvm.Registers[7] = InnerFault
+		pvm.Registers[8] = value
+	case ExitHost:
+		pvm.Registers[7] = InnerHost
+		pvm.Registers[8] = value
+	case ExitOOG:
+		pvm.Registers[7] = InnerOOG
+	default:
+		pvm.Registers[7] = InnerPanic
+	}
+}
+
+// expunge removes an inner machine, returning its program counter.
+func (h *RefineHost) expunge(pvm *PVM) {
+	inner, exists := h.Machines[pvm.Registers[7]]
+	if !exists {
+		pvm.Registers[7] = ResultWho
+		return
+	}
+	delete(h.Machines, pvm.Registers[7])
+	pvm.Registers[7] = inner.PC
+}
+
+// validPageRange reports whether count pages from page lie above the first
+// zone and within the address space.
+func validPageRange(page uint32, count uint32) bool {
+	const pages = MemorySize / PageSize
+	return page >= ZoneSize/PageSize && uint64(page)+uint64(count) < pages
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestHistoricalLookup(t *testing.T) {
+	preimage := []byte("preimage")
+	hash := blake2b.Sum256(preimage)
+
+	testCases := []struct {
+		name     string
+		meta     []uint32
+		slot     uint32
+		expected bool
+	}{
+		{"Requested", []uint32{}, 10, false},
+		{"Available", []uint32{5}, 10, true},
+		{"Not yet available", []uint32{15}, 10, false},
+		{"Forgotten", []uint32{5, 10}, 10, false},
+		{"Before forgotten", []uint32{5, 10}, 9, true},
+		{"Available again", []uint32{5, 8, 10}, 10, true},
+		{"Between windows", []uint32{5, 8, 10}, 9, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			account := ServiceAccount{
+				PreimageLookup: map[Hash][]byte{hash: preimage},
+				PreimageMeta: map[struct {
+					Hash
+					Length uint32
+				}][]uint32{
+					{hash, uint32(len(preimage))}: tc.meta,
+				},
+			}
+
+			data, exists := account.HistoricalLookup(tc.slot, hash)
+
+			assert.Equal(t, tc.expected, exists)
+			if tc.expected {
+				assert.Equal(t, preimage, data)
+			}
+		})
+	}
+}
+
+func TestRefineHostCalls(t *testing.T) {
+	const buffer = 0x10000
+	preimage := []byte("preimage")
+	hash := blake2b.Sum256(preimage)
+
+	testCases := []struct {
+		name   string
+		index  uint32
+		setup  func(pvm *PVM)
+		check  func(t *testing.T, host *RefineHost, pvm *PVM)
+		result uint32
+	}{
+		{
+			name:  "Historical lookup",
+			index: HostHistoricalLookup,
+			setup: func(pvm *PVM) {
+				pvm.Memory.Write(buffer, hash[:])
+				pvm.Registers[7] = 1<<32 - 1
+				pvm.Registers[8] = buffer
+				pvm.Registers[9], pvm.Registers[10] = buffer+HashSize, 3
+			},
+			result: uint32(len(preimage)),
+			check: func(t *testing.T, host *RefineHost, pvm *PVM) {
+				data, _ := pvm.Memory.Read(buffer+HashSize, 4)
+				assert.Equal(t, []byte{'p', 'r', 'e', 0}, data)
+			},
+		},
+		{
+			name:  "Historical lookup of unknown service",
+			index: HostHistoricalLookup,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 5
+				pvm.Registers[8] = buffer
+			},
+			result: ResultNone,
+		},
+		{
+			name:  "Import",
+			index: HostImport,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 1
+				pvm.Registers[8], pvm.Registers[9] = buffer, 8
+			},
+			result: ResultOK,
+			check: func(t *testing.T, host *RefineHost, pvm *PVM) {
+				data, _ := pvm.Memory.Read(buffer, 3)
+				assert.Equal(t, []byte{4, 5, 0}, data)
+			},
+		},
+		{
+			name:  "Import missing segment",
+			index: HostImport,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 2
+			},
+			result: ResultNone,
+		},
+		{
+			name:  "Export",
+			index: HostExport,
+			setup: func(pvm *PVM) {
+				pvm.Memory.Write(buffer, []byte{7, 8})
+				pvm.Registers[7], pvm.Registers[8] = buffer, 2
+			},
+			result: 3,
+			check: func(t *testing.T, host *RefineHost, pvm *PVM) {
+				assert.Len(t, host.Exports, 1)
+				assert.Len(t, host.Exports[0], SegmentSize)
+				assert.Equal(t, []byte{7, 8, 0}, host.Exports[0][:3])
+			},
+		},
+		{
+			name:  "Export from inaccessible memory",
+			index: HostExport,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7], pvm.Registers[8] = buffer+PageSize, 2
+			},
+			result: ResultOOB,
+		},
+		{
+			name:  "Peek unknown machine",
+			index: HostPeek,
+			setup: func(pvm *PVM) {
+				pvm.Registers[7] = 0
+			},
+			result: ResultWho,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			host := &RefineHost{
+				Service: &ServiceAccount{
+					PreimageLookup: map[Hash][]byte{hash: preimage},
+					PreimageMeta: map[struct {
+						Hash
+						Length uint32
+					}][]uint32{
+						{hash, uint32(len(preimage))}: {1},
+					},
+				},
+				Timeslot:     10,
+				Imports:      [][]byte{{1, 2, 3}, {4, 5}},
+				ExportOffset: 3,
+			}
+			pvm, err := NewPVM([]byte{OpTrap}, []byte{0b1}, nil, 1000)
+			assert.NoError(t, err)
+			pvm.Memory.SetAccess(buffer, PageSize, PageReadWrite)
+			if tc.setup != nil {
+				tc.setup(pvm)
+			}
+
+			exit, err := host.HostCall(tc.index, pvm)
+
+			assert.NoError(t, err)
+			assert.Equal(t, ExitContinue, exit)
+			assert.Equal(t, tc.result, pvm.Registers[7])
+			assert.Equal(t, int64(1000-HostCallGasCost), pvm.Gas)
+			if tc.check != nil {
+				tc.check(t, host, pvm)
+			}
+		})
+	}
+}
+
+func TestRefineInnerMachine(t *testing.T) {
+	const buffer = 0x10000
+	const innerPage = 16
+
+	host := &RefineHost{}
+	pvm, err := NewPVM([]byte{OpTrap}, []byte{0b1}, nil, 1000)
+	assert.NoError(t, err)
+	pvm.Memory.SetAccess(buffer, PageSize, PageReadWrite)
+
+	call := func(index uint32, registers ...uint32) uint32 {
+		copy(pvm.Registers[7:], registers)
+		exit, err := host.HostCall(index, pvm)
+		assert.NoError(t, err)
+		assert.Equal(t, ExitContinue, exit)
+		return pvm.Registers[7]
+	}
+
+	// The inner program stores ω7 at the start of its memory, sets ω7 to 5
+	// and calls host function 2
+	program := encodeCodeBlob([]byte{
+		OpStoreIndU32, 0x07, 0x00, 0x00, 0x01, 0x00, // 0: [r0 + 0x10000] = r7
+		OpLoadImm, 0x07, 0x05, // 6: r7 = 5
+		OpEcalli, 0x02, // 9
+		OpTrap, // 11
+	}, []byte{0b01000001, 0b1010}, nil)
+	pvm.Memory.Write(buffer, program)
+
+	id := call(HostMachine, buffer, uint32(len(program)), 0)
+	assert.Equal(t, uint32(0), id)
+
+	assert.Equal(t, ResultOOB, call(HostPoke, id, buffer, innerPage*PageSize, 4), "Inner memory starts inaccessible")
+	assert.Equal(t, ResultOK, call(HostZero, id, innerPage, 1))
+	assert.Equal(t, ResultOK, call(HostPoke, id, buffer, innerPage*PageSize+4, 4))
+
+	// Gas and registers for the inner machine
+	state := binary.LittleEndian.AppendUint64(nil, 100)
+	for i := 0; i < RegisterCount; i++ {
+		state = binary.LittleEndian.AppendUint32(state, uint32(i))
+	}
+	pvm.Memory.Write(buffer+0x200, state)
+
+	assert.Equal(t, InnerHost, call(HostInvoke, id, buffer+0x200))
+	assert.Equal(t, uint32(2), pvm.Registers[8])
+	assert.Equal(t, uint32(11), host.Machines[id].PC, "The machine is suspended after the host call")
+	assert.Equal(t, EngineInterpreter, host.Machines[id].Engine, "The compiled engine is opt-in")
+	state, _ = pvm.Memory.Read(buffer+0x200, 8+4*RegisterCount)
+	assert.Equal(t, uint64(97), binary.LittleEndian.Uint64(state))
+	assert.Equal(t, uint32(5), binary.LittleEndian.Uint32(state[8+4*7:]))
+
+	assert.Equal(t, ResultOK, call(HostPeek, id, buffer+0x300, innerPage*PageSize, 8))
+	data, _ := pvm.Memory.Read(buffer+0x300, 8)
+	assert.Equal(t, append([]byte{7, 0, 0, 0}, program[:4]...), data)
+
+	assert.Equal(t, ResultOK, call(HostVoid, id, innerPage, 1))
+	assert.Equal(t, ResultOOB, call(HostVoid, id, innerPage, 1))
+	assert.Equal(t, ResultOOB, call(HostZero, id, 0, 1))
+
+	// Resuming after the host call runs into the trap
+	assert.Equal(t, InnerPanic, call(HostInvoke, id, buffer+0x200))
+
+	assert.Equal(t, uint32(11), call(HostExpunge, id))
+	assert.Equal(t, ResultWho, call(HostInvoke, id, buffer+0x200))
+}
+
+func TestRefine(t *testing.T) {
+	// Exports its arguments as a segment and halts
+	code := []byte{
+		OpEcalli, byte(HostExport), // 0
+		OpJumpInd, 0x00, // 2
+	}
+	service := ServiceAccount{Code: encodeProgramBlob(nil, nil, 0, 0, code, []byte{0b0101}, nil)}
+	context := RefinementContext{LookupAnchorTimeSlot: 7}
+
+	output, exports, err := service.Refine([]byte{1, 2}, context, 1000, nil, nil, 0)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, output)
+	assert.Len(t, exports, 1)
+	args := append(SerializeVarOctetSequence([]byte{1, 2}), context.Serialize()...)
+	assert.Equal(t, args, exports[0][:len(args)])
+}
+
+func TestRefineHistoricalLookup(t *testing.T) {
+	// Looks up the preimage of its input in service 2, trapping if there is
+	// none
+	blob, err := Assemble(`
+	move_reg r8, r7
+	add_imm r8, r8, 1
+	load_imm r7, 2
+	load_imm r10, 0
+	ecalli 15
+	branch_eq_imm r7, -1, @missing
+	jump_ind r0, 0
+missing:
+	trap
+`)
+	assert.NoError(t, err)
+	service := ServiceAccount{Code: encodeProgramBlob(nil, nil, 0, 0, blob.Code, blob.Bitmask, blob.JumpTable)}
+
+	preimage := []byte{1, 2, 3}
+	hash := blake2b.Sum256(preimage)
+	accounts := map[uint32]ServiceAccount{
+		2: {
+			PreimageLookup: map[Hash][]byte{hash: preimage},
+			PreimageMeta: map[struct {
+				Hash
+				Length uint32
+			}][]uint32{{hash, 3}: {0}},
+		},
+	}
+
+	_, _, err = service.Refine(hash[:], RefinementContext{LookupAnchorTimeSlot: 1}, 1000, accounts, nil, 0)
+	assert.NoError(t, err)
+	_, _, err = service.Refine(hash[:], RefinementContext{LookupAnchorTimeSlot: 1}, 1000, nil, nil, 0)
+	assert.Equal(t, WorkErrorPanic, err)
+}
+
+func TestRefineWorkErrors(t *testing.T) {
+	program := func(code []byte, bitmask byte) []byte {
+		return encodeProgramBlob(nil, nil, 0, 0, code, []byte{bitmask}, nil)
+	}
+
+	testCases := []struct {
+		name string
+		code []byte
+		err  WorkError
+	}{
+		{"Out of gas", program([]byte{OpJump, 0x00}, 0b01), WorkErrorOutOfGas},
+		{"Trap", program([]byte{OpTrap}, 0b1), WorkErrorPanic},
+		{"Page fault", program([]byte{OpLoadU8, 0x07}, 0b01), WorkErrorPanic},
+		{"Invalid program", []byte{1, 2, 3}, WorkErrorPanic},
+		{"No code", nil, WorkErrorBadCode},
+		{"Code too big", make([]byte, MaxServiceCodeSize+1), WorkErrorCodeTooBig},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := ServiceAccount{Code: tc.code}
+
+			_, _, err := service.Refine(nil, RefinementContext{}, 100, nil, nil, 0)
+
+			var workErr WorkError
+			assert.ErrorAs(t, err, &workErr)
+			assert.Equal(t, tc.err, workErr)
+			// The error is reported as the work output of the same type
+			output := SerializeWorkOutput(uint32(workErr))
+			assert.Equal(t, byte(tc.err), output[0])
+			_, offset, err := DeserializeWorkOutput(output, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, len(output), offset)
+		})
+	}
+}
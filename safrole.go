@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	EpochLength               = 600 // E, in timeslots
+	TicketSubmissionEnd       = 500 // Y, the slot of an epoch from which tickets are no longer accepted
+	TicketEntriesPerValidator = 2   // N, the ticket attempts each validator has per epoch
+)
+
+// TicketBody is a ticket as it is accumulated: the identifier given by the
+// VRF output of its proof, and the attempt it was made with.
+type TicketBody struct {
+	Identifier Hash
+	EntryIndex uint32
+}
+
+// SafroleError is the reason a Safrole transition is rejected. Its values are
+// the error codes of the safrole test vectors.
+type SafroleError uint8
+
+const (
+	SafroleErrorBadSlot          SafroleError = 0 // the timeslot does not advance
+	SafroleErrorUnexpectedTicket SafroleError = 1 // tickets were submitted in the epoch's tail
+	SafroleErrorBadTicketOrder   SafroleError = 2 // tickets are not sorted by identifier
+	SafroleErrorBadTicketProof   SafroleError = 3
+	SafroleErrorBadTicketAttempt SafroleError = 4 // the attempt is not below TicketEntriesPerValidator
+	SafroleErrorDuplicateTicket  SafroleError = 6
+)
+
+func (e SafroleError) Error() string {
+	switch e {
+	case SafroleErrorBadSlot:
+		return "bad slot"
+	case SafroleErrorUnexpectedTicket:
+		return "unexpected ticket"
+	case SafroleErrorBadTicketOrder:
+		return "bad ticket order"
+	case SafroleErrorBadTicketProof:
+		return "bad ticket proof"
+	case SafroleErrorBadTicketAttempt:
+		return "bad ticket attempt"
+	case SafroleErrorDuplicateTicket:
+		return "duplicate ticket"
+	}
+	return fmt.Sprintf("safrole error %d", uint8(e))
+}
+
+// AccumulateTickets verifies the tickets submitted at timeSlot against the
+// ring of ringKeys and merges them into the accumulator, which is kept sorted
+// by identifier and trimmed to the best tickets for each slot of an epoch.
+// The submitted tickets must be sorted by identifier and not already
+// accumulated.
+func AccumulateTickets(accumulator []TicketBody, tickets []Ticket, ringKeys []BandersnatchKey, entropy Hash, timeSlot uint32, config *Config) ([]TicketBody, error) {
+	if len(tickets) == 0 {
+		return accumulator, nil
+	}
+	if timeSlot%config.SlotsPerEpoch >= config.TicketSubmissionEnd {
+		return nil, SafroleErrorUnexpectedTicket
+	}
+
+	bodies := make([]TicketBody, len(tickets))
+	for i, ticket := range tickets {
+		if ticket.EntryIndex >= TicketEntriesPerValidator {
+			return nil, SafroleErrorBadTicketAttempt
+		}
+
+		message := append([]byte("jam_ticket_seal"), entropy[:]...)
+		message = append(message, byte(ticket.EntryIndex))
+		valid, vrfOutput := VerifyBandersnatchRingVRFProof(ringKeys, message, ticket.Proof)
+		if !valid {
+			return nil, SafroleErrorBadTicketProof
+		}
+		bodies[i].EntryIndex = ticket.EntryIndex
+		copy(bodies[i].Identifier[:], vrfOutput)
+
+		if i > 0 {
+			switch bytes.Compare(bodies[i-1].Identifier[:], bodies[i].Identifier[:]) {
+			case 0:
+				return nil, SafroleErrorDuplicateTicket
+			case 1:
+				return nil, SafroleErrorBadTicketOrder
+			}
+		}
+	}
+
+	merged := append(append([]TicketBody{}, accumulator...), bodies...)
+	sort.Slice(merged, func(i, j int) bool {
+		return bytes.Compare(merged[i].Identifier[:], merged[j].Identifier[:]) < 0
+	})
+	for i := 1; i < len(merged); i++ {
+		if merged[i-1].Identifier == merged[i].Identifier {
+			return nil, SafroleErrorDuplicateTicket
+		}
+	}
+	if len(merged) > int(config.SlotsPerEpoch) {
+		merged = merged[:config.SlotsPerEpoch]
+	}
+	return merged, nil
+}
+
+// OutsideInSequence orders tickets outside-in, alternating between the
+// lowest and highest remaining: the first, the last, the second, the
+// second-last and so on.
+func OutsideInSequence(tickets []TicketBody) []TicketBody {
+	sequence := make([]TicketBody, 0, len(tickets))
+	for i, j := 0, len(tickets)-1; i <= j; i, j = i+1, j-1 {
+		sequence = append(sequence, tickets[i])
+		if i != j {
+			sequence = append(sequence, tickets[j])
+		}
+	}
+	return sequence
+}
+
+// FallbackSealKeys returns the sealing keys of an epoch without enough
+// tickets: for each slot, the Bandersnatch key of the validator picked by
+// hashing entropy with the slot's index.
+func FallbackSealKeys(entropy Hash, validators []ValidatorKey, config *Config) []BandersnatchKey {
+	if len(validators) == 0 {
+		return nil
+	}
+	keys := make([]BandersnatchKey, config.SlotsPerEpoch)
+	for i := range keys {
+		hash := blake2b.Sum256(binary.LittleEndian.AppendUint32(entropy[:], uint32(i)))
+		keys[i] = validators[binary.LittleEndian.Uint32(hash[:4])%uint32(len(validators))].BandersnatchKey
+	}
+	return keys
+}
+
+// BandersnatchKeys returns the Bandersnatch keys of validators.
+func BandersnatchKeys(validators []ValidatorKey) []BandersnatchKey {
+	keys := make([]BandersnatchKey, len(validators))
+	for i, validatorKey := range validators {
+		keys[i] = validatorKey.BandersnatchKey
+	}
+	return keys
+}
+
+// FilterOffenders returns validators with the keys of every offender, by
+// Ed25519 key, replaced by null keys, so they keep their index but can take
+// no part in the epoch.
+func FilterOffenders(validators []ValidatorKey, offenders map[Hash]struct{}) []ValidatorKey {
+	filtered := make([]ValidatorKey, len(validators))
+	for i, validatorKey := range validators {
+		if _, ok := offenders[validatorKey.Ed25519Key]; !ok {
+			filtered[i] = validatorKey
+		}
+	}
+	return filtered
+}
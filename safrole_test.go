@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestAccumulateTickets(t *testing.T) {
+	// The placeholder ring VRF gives the proof as its output
+	ticket := func(attempt uint32, id byte) Ticket {
+		return Ticket{EntryIndex: attempt, Proof: []byte{id}}
+	}
+	body := func(attempt uint32, id byte) TicketBody {
+		return TicketBody{Identifier: Hash{id}, EntryIndex: attempt}
+	}
+	accumulator := []TicketBody{body(0, 2), body(1, 5)}
+
+	testCases := []struct {
+		name     string
+		tickets  []Ticket
+		timeSlot uint32
+		expected []TicketBody
+		err      error
+	}{
+		{"No tickets", nil, TicketSubmissionEnd, accumulator, nil},
+		{"Merged in order", []Ticket{ticket(1, 1), ticket(0, 3), ticket(0, 9)}, 1, []TicketBody{body(1, 1), body(0, 2), body(0, 3), body(1, 5), body(0, 9)}, nil},
+		{"Last slot before tail", []Ticket{ticket(0, 3)}, EpochLength + TicketSubmissionEnd - 1, []TicketBody{body(0, 2), body(0, 3), body(1, 5)}, nil},
+		{"Submission tail", []Ticket{ticket(0, 3)}, TicketSubmissionEnd, nil, SafroleErrorUnexpectedTicket},
+		{"Bad attempt", []Ticket{ticket(TicketEntriesPerValidator, 3)}, 1, nil, SafroleErrorBadTicketAttempt},
+		{"Bad order", []Ticket{ticket(0, 4), ticket(0, 3)}, 1, nil, SafroleErrorBadTicketOrder},
+		{"Duplicate in extrinsic", []Ticket{ticket(0, 3), ticket(1, 3)}, 1, nil, SafroleErrorDuplicateTicket},
+		{"Duplicate of accumulated", []Ticket{ticket(1, 5)}, 1, nil, SafroleErrorDuplicateTicket},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := AccumulateTickets(accumulator, tc.tickets, nil, Hash{}, tc.timeSlot, &FullConfig)
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+	assert.Equal(t, []TicketBody{body(0, 2), body(1, 5)}, accumulator, "Accumulator is not modified")
+}
+
+func TestAccumulateTicketsTrimming(t *testing.T) {
+	full := make([]TicketBody, EpochLength)
+	for i := range full {
+		full[i] = TicketBody{Identifier: Hash{1, byte(i >> 8), byte(i)}}
+	}
+
+	result, err := AccumulateTickets(full, []Ticket{{Proof: []byte{2}}}, nil, Hash{}, 0, &FullConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, full, result, "A ticket worse than all accumulated ones is dropped")
+
+	result, err = AccumulateTickets(full, []Ticket{{Proof: []byte{0}}}, nil, Hash{}, 0, &FullConfig)
+	assert.NoError(t, err)
+	assert.Len(t, result, EpochLength)
+	assert.Equal(t, Hash{}, result[0].Identifier)
+	assert.Equal(t, full[:EpochLength-1], result[1:], "The worst accumulated ticket is dropped")
+}
+
+func TestProcessSafroleTransitionTickets(t *testing.T) {
+	preState := SafroleState{
+		Timeslot:           EpochLength - 1,
+		TicketsAccumulator: []TicketBody{{Identifier: Hash{1}}},
+	}
+
+	_, err := ProcessSafroleTransition(SafroleInput{Slot: EpochLength - 1}, preState, &FullConfig)
+	assert.Equal(t, SafroleErrorBadSlot, err)
+
+	input := SafroleInput{Slot: EpochLength, Extrinsics: []Ticket{{Proof: []byte{2}}}}
+	output, err := ProcessSafroleTransition(input, preState, &FullConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, []TicketBody{{Identifier: Hash{2}}}, output.State.TicketsAccumulator, "Accumulator is reset for the new epoch")
+}
+
+func TestOutsideInSequence(t *testing.T) {
+	tickets := func(ids ...byte) []TicketBody {
+		bodies := make([]TicketBody, len(ids))
+		for i, id := range ids {
+			bodies[i].Identifier = Hash{id}
+		}
+		return bodies
+	}
+
+	testCases := []struct {
+		name     string
+		tickets  []TicketBody
+		expected []TicketBody
+	}{
+		{"Empty", tickets(), tickets()},
+		{"One", tickets(1), tickets(1)},
+		{"Even", tickets(1, 2, 3, 4), tickets(1, 4, 2, 3)},
+		{"Odd", tickets(1, 2, 3, 4, 5), tickets(1, 5, 2, 4, 3)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, OutsideInSequence(tc.tickets))
+		})
+	}
+}
+
+func TestFallbackSealKeys(t *testing.T) {
+	validators := []ValidatorKey{{BandersnatchKey: [32]byte{1}}, {BandersnatchKey: [32]byte{2}}, {BandersnatchKey: [32]byte{3}}}
+	entropy := Hash{7}
+
+	keys := FallbackSealKeys(entropy, validators, &FullConfig)
+	assert.Len(t, keys, EpochLength)
+	for i, key := range keys {
+		hash := blake2b.Sum256(append(entropy[:], byte(i), byte(i>>8), 0, 0))
+		assert.Equal(t, validators[binary.LittleEndian.Uint32(hash[:4])%3].BandersnatchKey, key, "slot %d", i)
+	}
+	assert.NotEqual(t, keys, FallbackSealKeys(Hash{8}, validators, &FullConfig), "Keys depend on the entropy")
+	assert.Nil(t, FallbackSealKeys(entropy, nil, &FullConfig))
+}
+
+func TestProcessSafroleTransitionSealKeys(t *testing.T) {
+	full := make([]TicketBody, EpochLength)
+	for i := range full {
+		full[i] = TicketBody{Identifier: Hash{byte(i >> 8), byte(i)}}
+	}
+	validators := []ValidatorKey{{BandersnatchKey: [32]byte{1}}}
+
+	testCases := []struct {
+		name         string
+		previousSlot uint32
+		slot         uint32
+		accumulator  []TicketBody
+		tickets      bool
+	}{
+		{"Full accumulator", EpochLength - 1, EpochLength, full, true},
+		{"Accumulator not full", EpochLength - 1, EpochLength, full[1:], false},
+		{"Submission period not over", TicketSubmissionEnd - 1, EpochLength, full, false},
+		{"Epoch skipped", EpochLength - 1, 2 * EpochLength, full, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			preState := SafroleState{
+				Timeslot:           tc.previousSlot,
+				NextValidators:     validators,
+				TicketsAccumulator: tc.accumulator,
+			}
+			output, err := ProcessSafroleTransition(SafroleInput{Slot: tc.slot}, preState, &FullConfig)
+			assert.NoError(t, err)
+
+			sealKeys := output.State.TicketsOrKeys
+			assert.Equal(t, tc.tickets, sealKeys.IsTickets())
+			if tc.tickets {
+				assert.Equal(t, OutsideInSequence(full), sealKeys.Tickets)
+				assert.Nil(t, sealKeys.Keys)
+			} else {
+				assert.Equal(t, FallbackSealKeys(output.State.Entropy[2], validators, &FullConfig), sealKeys.Keys)
+			}
+		})
+	}
+}
+
+func TestValidateBlockSeal(t *testing.T) {
+	header := &Header{
+		TimeSlot:       EpochLength + 1,
+		EpochMarker:    &EpochMarker{},
+		WinningTickets: &WinningTickets{},
+	}
+	validators := []ValidatorKey{{BandersnatchKey: [32]byte{1}}}
+
+	testCases := []struct {
+		name     string
+		state    SafroleState
+		expected bool
+	}{
+		{"Fallback keys", SafroleState{TicketsOrKeys: TicketsOrKeys{Keys: FallbackSealKeys(Hash{}, validators, &FullConfig)}}, true},
+		{"Tickets", SafroleState{CurrValidators: validators, TicketsOrKeys: TicketsOrKeys{Tickets: make([]TicketBody, EpochLength)}}, true},
+		{"No sealing keys", SafroleState{}, false},
+		{"Unknown author", SafroleState{TicketsOrKeys: TicketsOrKeys{Tickets: make([]TicketBody, EpochLength)}}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ValidateBlockSeal(header, &tc.state, &FullConfig))
+		})
+	}
+}
+
+func TestProcessSafroleTransitionMarks(t *testing.T) {
+	full := make([]TicketBody, EpochLength)
+	for i := range full {
+		full[i] = TicketBody{Identifier: Hash{byte(i >> 8), byte(i)}}
+	}
+	preState := SafroleState{
+		Entropy:            [4][32]byte{{1}, {2}, {3}, {4}},
+		NextValidators:     []ValidatorKey{{BandersnatchKey: [32]byte{5}}},
+		DesignedValidators: []ValidatorKey{{BandersnatchKey: [32]byte{6}}, {BandersnatchKey: [32]byte{7}}},
+	}
+
+	testCases := []struct {
+		name         string
+		previousSlot uint32
+		slot         uint32
+		accumulator  []TicketBody
+		epochMark    *EpochMarker
+		ticketsMark  *WinningTickets
+	}{
+		{"Within epoch", 10, 11, full, nil, nil},
+		{"New epoch", EpochLength - 1, EpochLength, full, &EpochMarker{EpochRandomness: Hash{1}, ValidatorKeys: []BandersnatchKey{{6}, {7}}}, nil},
+		{"Submission end", TicketSubmissionEnd - 1, TicketSubmissionEnd, full, nil, &WinningTickets{Tickets: OutsideInSequence(full)}},
+		{"Submission end skipped over", TicketSubmissionEnd - 3, TicketSubmissionEnd + 2, full, nil, &WinningTickets{Tickets: OutsideInSequence(full)}},
+		{"Accumulator not full", TicketSubmissionEnd - 1, TicketSubmissionEnd, full[1:], nil, nil},
+		{"Past submission end", TicketSubmissionEnd, TicketSubmissionEnd + 1, full, nil, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			preState.Timeslot = tc.previousSlot
+			preState.TicketsAccumulator = tc.accumulator
+			output, err := ProcessSafroleTransition(SafroleInput{Slot: tc.slot}, preState, &FullConfig)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.epochMark, output.Ok.EpochMark)
+			assert.Equal(t, tc.ticketsMark, output.Ok.TicketsMark)
+		})
+	}
+}
+
+func TestFilterOffenders(t *testing.T) {
+	validators := []ValidatorKey{
+		{BandersnatchKey: BandersnatchKey{1}, Ed25519Key: Hash{1}},
+		{BandersnatchKey: BandersnatchKey{2}, Ed25519Key: Hash{2}},
+		{BandersnatchKey: BandersnatchKey{3}, Ed25519Key: Hash{3}},
+	}
+
+	testCases := []struct {
+		name      string
+		offenders map[Hash]struct{}
+		expected  []ValidatorKey
+	}{
+		{"No offenders", nil, validators},
+		{"Offender nulled in place", map[Hash]struct{}{{2}: {}}, []ValidatorKey{validators[0], {}, validators[2]}},
+		{"Unknown offender", map[Hash]struct{}{{4}: {}}, validators},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, FilterOffenders(validators, tc.offenders))
+		})
+	}
+	assert.Equal(t, BandersnatchKey{2}, validators[1].BandersnatchKey, "Validators are not modified")
+}
+
+func TestProcessSafroleTransitionOffenders(t *testing.T) {
+	designed := []ValidatorKey{
+		{BandersnatchKey: BandersnatchKey{1}, Ed25519Key: Hash{1}},
+		{BandersnatchKey: BandersnatchKey{2}, Ed25519Key: Hash{2}},
+	}
+	preState := SafroleState{
+		Timeslot:           EpochLength - 1,
+		NextValidators:     designed,
+		DesignedValidators: designed,
+	}
+	input := SafroleInput{Slot: EpochLength, PostOffenders: map[Hash]struct{}{{1}: {}}}
+
+	output, err := ProcessSafroleTransition(input, preState, &FullConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, designed, output.State.CurrValidators, "Only the incoming set is filtered")
+	assert.Equal(t, []ValidatorKey{{}, designed[1]}, output.State.NextValidators)
+	assert.Equal(t, CalculateBandersnatchRingCommitment([]BandersnatchKey{{}, {2}}), output.State.TicketsVerifierKey)
+	assert.Equal(t, []BandersnatchKey{{}, {2}}, output.Ok.EpochMark.ValidatorKeys)
+}
+
+func TestUpdateStateFromHeaderOffenders(t *testing.T) {
+	validators := func(b byte) []ValidatorKey {
+		return []ValidatorKey{{BandersnatchKey: BandersnatchKey{b}, Ed25519Key: Hash{b}}, {BandersnatchKey: BandersnatchKey{b + 1}, Ed25519Key: Hash{b + 1}}}
+	}
+	var state State
+	state.Iota = validators(1)
+	state.Gamma.ValidatorKeys = validators(3)
+	state.Kappa = validators(5)
+	state.Psi.PunishSet = map[Hash]struct{}{{2}: {}}
+
+	header := Header{EpochMarker: &EpochMarker{}}
+	state, err := UpdateStateFromHeader(header, state, Hash{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, validators(5), state.Lambda)
+	assert.Equal(t, validators(3), state.Kappa)
+	assert.Equal(t, []ValidatorKey{validators(1)[0], {}}, state.Gamma.ValidatorKeys)
+	assert.Equal(t, CalculateBandersnatchRingCommitment([]BandersnatchKey{{1}, {}}), state.Gamma.EpochRoot)
+	assert.NotEqual(t, CalculateBandersnatchRingCommitment(BandersnatchKeys(state.Iota)), state.Gamma.EpochRoot,
+		"The ring commitment is of the filtered keys, not of ι")
+}
+
+func TestUpdateStateFromHeaderSealKeys(t *testing.T) {
+	accumulator := make([]TicketBody, FullConfig.SlotsPerEpoch)
+	for i := range accumulator {
+		accumulator[i].Identifier[0] = byte(i)
+		accumulator[i].Identifier[1] = byte(i >> 8)
+	}
+	previous := TicketsOrKeys{Tickets: []TicketBody{{Identifier: Hash{1}}}}
+
+	testCases := []struct {
+		name        string
+		tau         uint32
+		accumulator []TicketBody
+		header      Header
+		expected    func(state State) TicketsOrKeys
+	}{
+		{
+			name:        "Tickets",
+			tau:         FullConfig.TicketSubmissionEnd,
+			accumulator: accumulator,
+			header:      Header{TimeSlot: FullConfig.SlotsPerEpoch, EpochMarker: &EpochMarker{}},
+			expected: func(state State) TicketsOrKeys {
+				return TicketsOrKeys{Tickets: OutsideInSequence(accumulator)}
+			},
+		},
+		{
+			name:        "Fallback keys",
+			tau:         1,
+			accumulator: accumulator,
+			header:      Header{TimeSlot: FullConfig.SlotsPerEpoch, EpochMarker: &EpochMarker{}},
+			expected: func(state State) TicketsOrKeys {
+				// η2' is η1 before the block, and κ' is γk before it
+				validators := []ValidatorKey{{BandersnatchKey: BandersnatchKey{5}}, {BandersnatchKey: BandersnatchKey{6}}}
+				return TicketsOrKeys{Keys: FallbackSealKeys(Hash{2}, validators, &FullConfig)}
+			},
+		},
+		{
+			name:        "No epoch change",
+			tau:         FullConfig.TicketSubmissionEnd,
+			accumulator: accumulator,
+			header:      Header{TimeSlot: FullConfig.TicketSubmissionEnd + 1, WinningTickets: &WinningTickets{Tickets: accumulator}},
+			expected: func(state State) TicketsOrKeys {
+				return previous
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var state State
+			state.Tau = tc.tau
+			state.Eta = [4]Hash{{1}, {2}, {3}, {4}}
+			state.Gamma.ValidatorKeys = []ValidatorKey{{BandersnatchKey: BandersnatchKey{5}}, {BandersnatchKey: BandersnatchKey{6}}}
+			state.Gamma.TicketAccumulator = tc.accumulator
+			state.Gamma.SlotSealers = previous
+
+			state, err := UpdateStateFromHeader(tc.header, state, Hash{}, nil)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected(state), state.Gamma.SlotSealers)
+			if tc.header.EpochMarker != nil {
+				assert.Empty(t, state.Gamma.TicketAccumulator, "The accumulator is reset on a new epoch")
+			} else {
+				assert.Equal(t, tc.accumulator, state.Gamma.TicketAccumulator)
+			}
+		})
+	}
+}
+
+func TestUpdateStateFromHeaderEntropy(t *testing.T) {
+	var state State
+	state.Eta = [4]Hash{{1}, {2}, {3}, {4}}
+	state.Gamma.ValidatorKeys = []ValidatorKey{{BandersnatchKey: BandersnatchKey{5}}, {BandersnatchKey: BandersnatchKey{6}}}
+	header := Header{TimeSlot: FullConfig.SlotsPerEpoch - 1}
+	header.VRFSignature.Signature[0] = 7
+	accumulated := sha256.Sum256(append(state.Eta[0][:], header.VRFSignature.Signature[:]...))
+
+	state, err := UpdateStateFromHeader(header, state, Hash{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [4]Hash{accumulated, {2}, {3}, {4}}, state.Eta, "Only η0 changes within an epoch")
+
+	header = Header{TimeSlot: FullConfig.SlotsPerEpoch, EpochMarker: &EpochMarker{}}
+	next := sha256.Sum256(append(accumulated[:], header.VRFSignature.Signature[:]...))
+	state, err = UpdateStateFromHeader(header, state, Hash{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [4]Hash{next, accumulated, {2}, {3}}, state.Eta)
+	assert.Equal(t, TicketsOrKeys{Keys: FallbackSealKeys(state.Eta[2], state.Kappa, &FullConfig)}, state.Gamma.SlotSealers)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Snapshot is the complete state of a suspended PVM, from which it can be
+// resumed, for instance after a host call has been serviced elsewhere.
+type Snapshot struct {
+	Code        CodeBlob
+	Registers   [RegisterCount]uint32
+	PC          uint32
+	Gas         int64
+	GasMode     GasMode
+	GasCharged  bool // Whether the current basic block has been paid for in GasPerBasicBlock mode
+	Engine      Engine
+	HeapPointer uint32
+	Pages       []SnapshotPage // Accessible pages, in order of index
+}
+
+// SnapshotPage is a single accessible page. Data is nil if the page has
+// never been written, and reads as zeros.
+type SnapshotPage struct {
+	Index  uint32
+	Access PageAccess
+	Data   []byte
+}
+
+// Snapshot captures the state of the machine. The snapshot does not share
+// memory with the machine, which can go on running.
+func (pvm *PVM) Snapshot() *Snapshot {
+	s := &Snapshot{
+		Code: CodeBlob{
+			Code:      append([]byte{}, pvm.Code...),
+			Bitmask:   EncodeBitmask(pvm.Bitmask),
+			JumpTable: append([]uint32{}, pvm.JumpTable...),
+		},
+		Registers:   pvm.Registers,
+		PC:          pvm.PC,
+		Gas:         pvm.Gas,
+		GasMode:     pvm.GasMode,
+		GasCharged:  pvm.gasCharged,
+		Engine:      pvm.Engine,
+		HeapPointer: pvm.Memory.HeapPointer,
+	}
+	for index, page := range pvm.Memory.Pages {
+		snapshotPage := SnapshotPage{Index: index, Access: page.Access}
+		if page.Data != nil {
+			snapshotPage.Data = append([]byte{}, page.Data...)
+		}
+		s.Pages = append(s.Pages, snapshotPage)
+	}
+	sort.Slice(s.Pages, func(i, j int) bool { return s.Pages[i].Index < s.Pages[j].Index })
+	return s
+}
+
+// Resume creates a machine in the state of the snapshot, ready to continue
+// execution.
+func (s *Snapshot) Resume() (*PVM, error) {
+	// The gas is set afterwards, as a suspended machine may have none left
+	pvm, err := NewPVM(s.Code.Code, s.Code.Bitmask, s.Code.JumpTable, 1)
+	if err != nil {
+		return nil, err
+	}
+	pvm.Registers = s.Registers
+	pvm.PC = s.PC
+	pvm.Gas = s.Gas
+	pvm.GasMode = s.GasMode
+	pvm.gasCharged = s.GasCharged
+	pvm.Engine = s.Engine
+	pvm.Memory.HeapPointer = s.HeapPointer
+	for _, page := range s.Pages {
+		resumed := &Page{Access: page.Access}
+		if page.Data != nil {
+			resumed.Data = append([]byte{}, page.Data...)
+		}
+		pvm.Memory.Pages[page.Index] = resumed
+	}
+	return pvm, nil
+}
+
+func (s *Snapshot) Serialize() []byte {
+	var buf []byte
+	buf = append(buf, SerializeVarOctetSequence(s.Code.Serialize())...)
+	for _, r := range s.Registers {
+		buf = binary.BigEndian.AppendUint32(buf, r)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, s.PC)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(s.Gas))
+	buf = append(buf, byte(s.GasMode))
+	if s.GasCharged {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = append(buf, byte(s.Engine))
+	buf = binary.BigEndian.AppendUint32(buf, s.HeapPointer)
+
+	buf = append(buf, SerializeCompactInteger(uint64(len(s.Pages)))...)
+	for _, page := range s.Pages {
+		buf = binary.BigEndian.AppendUint32(buf, page.Index)
+		buf = append(buf, byte(page.Access))
+		if page.Data == nil {
+			buf = append(buf, 0)
+		} else {
+			buf = append(buf, 1)
+			buf = append(buf, page.Data...)
+		}
+	}
+	return buf
+}
+
+func DeserializeSnapshot(data []byte, offset int) (*Snapshot, int, error) {
+	code, offset, err := DeserializeVarOctetSequence(data, offset)
+	if err != nil {
+		return nil, offset, err
+	}
+	blob, err := ParseCodeBlob(code)
+	if err != nil {
+		return nil, offset, err
+	}
+	s := &Snapshot{Code: *blob}
+
+	if len(data[offset:]) < 4*RegisterCount+4+8+3+4 {
+		return nil, offset, errors.New("insufficient data for snapshot")
+	}
+	for i := range s.Registers {
+		s.Registers[i] = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+	}
+	s.PC = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	s.Gas = int64(binary.BigEndian.Uint64(data[offset:]))
+	offset += 8
+	s.GasMode = GasMode(data[offset])
+	s.GasCharged = data[offset+1] != 0
+	s.Engine = Engine(data[offset+2])
+	offset += 3
+	if s.GasMode != GasPerInstruction && s.GasMode != GasPerBasicBlock {
+		return nil, offset, errors.New("invalid snapshot gas mode")
+	}
+	if s.Engine != EngineInterpreter && s.Engine != EngineCompiled {
+		return nil, offset, errors.New("invalid snapshot engine")
+	}
+	s.HeapPointer = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	count, offset, err := DeserializeCompactInteger(data, offset)
+	if err != nil {
+		return nil, offset, err
+	}
+	for i := uint64(0); i < count; i++ {
+		if len(data[offset:]) < 6 {
+			return nil, offset, errors.New("insufficient data for snapshot page")
+		}
+		page := SnapshotPage{
+			Index:  binary.BigEndian.Uint32(data[offset:]),
+			Access: PageAccess(data[offset+4]),
+		}
+		hasData := data[offset+5] != 0
+		offset += 6
+		if page.Access == PageInaccessible || page.Access > PageReadWrite {
+			return nil, offset, errors.New("invalid snapshot page access")
+		}
+		if page.Index >= MemorySize/PageSize {
+			return nil, offset, errors.New("snapshot page beyond the address space")
+		}
+		if len(s.Pages) > 0 && page.Index <= s.Pages[len(s.Pages)-1].Index {
+			return nil, offset, errors.New("snapshot pages are not in order of index")
+		}
+		if hasData {
+			if len(data[offset:]) < PageSize {
+				return nil, offset, errors.New("insufficient data for snapshot page")
+			}
+			page.Data = append([]byte{}, data[offset:offset+PageSize]...)
+			offset += PageSize
+		}
+		s.Pages = append(s.Pages, page)
+	}
+
+	return s, offset, nil
+}
+
+// Hash returns the hash of the serialized snapshot.
+func (s *Snapshot) Hash() Hash {
+	return blake2b.Sum256(s.Serialize())
+}
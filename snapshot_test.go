@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const snapshotSource = `
+	load_imm r7, 0x10000
+	load_imm r8, 0x2A
+	store_ind_u32 r8, r7, 0
+	ecalli 1
+	load_ind_u32 r9, r7, 0
+	add r9, r9, r10
+	jump_ind r0, 0
+`
+
+func newSnapshotTestPVM(t *testing.T) *PVM {
+	blob, err := Assemble(snapshotSource)
+	assert.NoError(t, err)
+	pvm, err := NewPVM(blob.Code, blob.Bitmask, blob.JumpTable, 100)
+	assert.NoError(t, err)
+	pvm.Registers[0] = HaltAddress
+	pvm.Memory.SetAccess(0x10000, 2*PageSize, PageReadWrite)
+	pvm.Memory.HeapPointer = 0x12000
+	return pvm
+}
+
+func TestSnapshotResume(t *testing.T) {
+	pvm := newSnapshotTestPVM(t)
+	exitReason, index, _ := pvm.Execute()
+	assert.Equal(t, ExitHost, exitReason)
+	assert.Equal(t, uint32(1), index)
+
+	snapshot := pvm.Snapshot()
+	data := snapshot.Serialize()
+
+	// Resume the suspended machine elsewhere, servicing its host call there
+	done := make(chan *PVM)
+	go func() {
+		decoded, offset, err := DeserializeSnapshot(data, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), offset)
+		resumed, err := decoded.Resume()
+		assert.NoError(t, err)
+		resumed.Registers[10] = 8
+		resumed.Execute()
+		done <- resumed
+	}()
+	resumed := <-done
+
+	pvm.Registers[10] = 8
+	exitReason, _, _ = pvm.Execute()
+	assert.Equal(t, ExitHalt, exitReason)
+
+	assert.Equal(t, uint32(50), resumed.Registers[9])
+	assert.Equal(t, pvm.Registers, resumed.Registers)
+	assert.Equal(t, pvm.PC, resumed.PC)
+	assert.Equal(t, pvm.Gas, resumed.Gas)
+	assert.Equal(t, pvm.Memory, resumed.Memory)
+}
+
+func TestSnapshotSerialize(t *testing.T) {
+	pvm := newSnapshotTestPVM(t)
+	pvm.GasMode = GasPerBasicBlock
+	pvm.Engine = EngineCompiled
+	pvm.Execute()
+	snapshot := pvm.Snapshot()
+
+	decoded, _, err := DeserializeSnapshot(snapshot.Serialize(), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, snapshot, decoded)
+	assert.Equal(t, snapshot.Hash(), decoded.Hash())
+	assert.True(t, decoded.GasCharged)
+	resumed, err := decoded.Resume()
+	assert.NoError(t, err)
+	assert.Equal(t, EngineCompiled, resumed.Engine)
+	assert.Equal(t, []SnapshotPage{
+		{Index: 0x10, Access: PageReadWrite, Data: snapshot.Pages[0].Data},
+		{Index: 0x11, Access: PageReadWrite},
+	}, snapshot.Pages, "Only written pages carry data")
+
+	// The snapshot is independent of the machine, which changes its hash
+	pvm.Registers[10] = 8
+	pvm.Execute()
+	assert.Equal(t, decoded.Hash(), snapshot.Hash())
+	assert.NotEqual(t, snapshot.Hash(), pvm.Snapshot().Hash())
+}
+
+func TestDeserializeSnapshotErrors(t *testing.T) {
+	data := newSnapshotTestPVM(t).Snapshot().Serialize()
+	// The snapshot ends with the engine, heap pointer and two pages without data
+	pages := len(data) - 2*6
+	engine := pages - 1 - 4 - 1
+	withByte := func(offset int, b byte) []byte {
+		modified := append([]byte{}, data...)
+		modified[offset] = b
+		return modified
+	}
+
+	testCases := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"Empty", nil, "insufficient data for var octet sequence"},
+		{"Truncated registers", data[:40], "insufficient data for snapshot"},
+		{"Truncated page", data[:len(data)-1], "insufficient data for snapshot page"},
+		{"Inaccessible page", append(append([]byte{}, data[:len(data)-2]...), byte(PageInaccessible), 0), "invalid snapshot page access"},
+		{"Invalid gas mode", withByte(engine-2, 2), "invalid snapshot gas mode"},
+		{"Invalid engine", withByte(engine, 2), "invalid snapshot engine"},
+		{"Page beyond the address space", withByte(pages+6, 0x01), "snapshot page beyond the address space"},
+		{"Duplicate page", withByte(pages+6+3, 0x10), "snapshot pages are not in order of index"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := DeserializeSnapshot(tc.data, 0)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// State component indices, as used in their state keys.
+const (
+	StateAlpha   = 1
+	StatePhi     = 2
+	StateBeta    = 3
+	StateGamma   = 4
+	StatePsi     = 5
+	StateEta     = 6
+	StateIota    = 7
+	StateKappa   = 8
+	StateLambda  = 9
+	StateRho     = 10
+	StateTau     = 11
+	StateChi     = 12
+	StatePi      = 13
+	StateService = 255
+)
+
+// componentKey is the state key C(i) of a state component.
+func componentKey(i byte) Hash {
+	return Hash{i}
+}
+
+// serviceKey is the state key C(i, s) of component i of service s.
+func serviceKey(i byte, s uint32) Hash {
+	key := Hash{i}
+	binary.LittleEndian.PutUint32(key[1:], s)
+	return key
+}
+
+// serviceDataKey is the state key C(s, h) of an item of service s, which
+// interleaves the service index with the first bytes of h.
+func serviceDataKey(s uint32, h []byte) Hash {
+	var key Hash
+	n := binary.LittleEndian.AppendUint32(nil, s)
+	for i := 0; i < 4; i++ {
+		key[2*i] = n[i]
+		key[2*i+1] = h[i]
+	}
+	copy(key[8:], h[4:28])
+	return key
+}
+
+// StateKeyValues returns the state as the key-value pairs that are merklized
+// into its root.
+func (s *State) StateKeyValues() map[Hash][]byte {
+	kvs := map[Hash][]byte{
+		componentKey(StateAlpha):  SerializeAlpha(s.Alpha),
+		componentKey(StatePhi):    SerializePhi(s.Phi),
+		componentKey(StateBeta):   SerializeBeta(s.Beta),
+		componentKey(StateGamma):  SerializeGamma(s.Gamma),
+		componentKey(StatePsi):    SerializePsi(s.Psi),
+		componentKey(StateEta):    SerializeEta(s.Eta),
+		componentKey(StateIota):   SerializeValidatorKeys(s.Iota),
+		componentKey(StateKappa):  SerializeValidatorKeys(s.Kappa),
+		componentKey(StateLambda): SerializeValidatorKeys(s.Lambda),
+		componentKey(StateRho):    SerializeRho(s.Rho),
+		componentKey(StateTau):    SerializeTau(s.Tau),
+		componentKey(StateChi):    SerializeChi(s.Chi),
+		componentKey(StatePi):     SerializePi(s.Pi),
+	}
+
+	for index, account := range s.Delta {
+		items, octets := account.CalculateAccountFootprint()
+		info := append([]byte{}, account.CodeHash[:]...)
+		info = binary.LittleEndian.AppendUint64(info, account.Balance)
+		info = binary.LittleEndian.AppendUint64(info, account.AccumulateGasLimit)
+		info = binary.LittleEndian.AppendUint64(info, account.OnTransferGasLimit)
+		info = binary.LittleEndian.AppendUint64(info, octets)
+		info = binary.LittleEndian.AppendUint32(info, items)
+		kvs[serviceKey(StateService, index)] = info
+
+		for key, value := range account.Storage {
+			h := binary.LittleEndian.AppendUint32(nil, math.MaxUint32)
+			kvs[serviceDataKey(index, append(h, key[:28]...))] = value
+		}
+		for hash, preimage := range account.PreimageLookup {
+			h := binary.LittleEndian.AppendUint32(nil, math.MaxUint32-1)
+			kvs[serviceDataKey(index, append(h, hash[1:29]...))] = preimage
+		}
+		for key, timeSlots := range account.PreimageMeta {
+			hashOfHash := blake2b.Sum256(key.Hash[:])
+			h := binary.LittleEndian.AppendUint32(nil, key.Length)
+			value := SerializeNatural(uint64(len(timeSlots)))
+			for _, timeSlot := range timeSlots {
+				value = binary.LittleEndian.AppendUint32(value, timeSlot)
+			}
+			kvs[serviceDataKey(index, append(h, hashOfHash[2:30]...))] = value
+		}
+	}
+	return kvs
+}
+
+// MerkleRoot returns the root of the binary Patricia Merkle trie of kvs.
+func MerkleRoot(kvs map[Hash][]byte) Hash {
+	keys := make([]Hash, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	return merkleize(kvs, keys, 0)
+}
+
+// merkleize returns the root of the subtrie holding keys, which agree on
+// their first depth bits.
+func merkleize(kvs map[Hash][]byte, keys []Hash, depth int) Hash {
+	switch len(keys) {
+	case 0:
+		return Hash{}
+	case 1:
+		return blake2b.Sum256(encodeLeaf(keys[0], kvs[keys[0]]))
+	}
+
+	var left, right []Hash
+	for _, key := range keys {
+		if keyBit(key, depth) {
+			right = append(right, key)
+		} else {
+			left = append(left, key)
+		}
+	}
+	return blake2b.Sum256(encodeBranch(merkleize(kvs, left, depth+1), merkleize(kvs, right, depth+1)))
+}
+
+// keyBit returns bit i of key, counting from the most significant bit of
+// the first byte.
+func keyBit(key Hash, i int) bool {
+	return key[i/8]&(0x80>>(i%8)) != 0
+}
+
+// encodeBranch encodes a branch node, whose first bit is clear, with the
+// roots of its subtries.
+func encodeBranch(left, right Hash) []byte {
+	node := make([]byte, 0, 64)
+	node = append(node, left[0]&0x7F)
+	node = append(node, left[1:]...)
+	return append(node, right[:]...)
+}
+
+// encodeLeaf encodes a leaf node, whose first bits are 1 then 0 for an
+// embedded value or 1 then 1 for a hashed one, with the first 31 bytes of its
+// key. Values of up to 32 bytes are embedded, with their length in the low
+// bits of the first byte, and larger ones are replaced by their hash.
+func encodeLeaf(key Hash, value []byte) []byte {
+	node := make([]byte, 64)
+	if len(value) <= 32 {
+		node[0] = 0x80 | byte(len(value))
+		copy(node[32:], value)
+	} else {
+		node[0] = 0xC0
+		hash := blake2b.Sum256(value)
+		copy(node[32:], hash[:])
+	}
+	copy(node[1:], key[:31])
+	return node
+}
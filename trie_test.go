@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestStateKeys(t *testing.T) {
+	assert.Equal(t, Hash{11}, componentKey(StateTau))
+	assert.Equal(t, Hash{255, 0x04, 0x03, 0x02, 0x01}, serviceKey(StateService, 0x01020304))
+
+	h := make([]byte, 32)
+	for i := range h {
+		h[i] = byte(0xA0 + i)
+	}
+	key := serviceDataKey(0x01020304, h)
+	assert.Equal(t, []byte{0x04, 0xA0, 0x03, 0xA1, 0x02, 0xA2, 0x01, 0xA3}, key[:8], "Service index interleaved with h")
+	assert.Equal(t, h[4:28], key[8:])
+}
+
+func TestMerkleRoot(t *testing.T) {
+	smallKey, largeKey := Hash{0x01}, Hash{0x80}
+	small := []byte{1, 2, 3}
+	large := make([]byte, 33)
+
+	embedded := append([]byte{0x80 | 3}, smallKey[:31]...)
+	embedded = append(embedded, small...)
+	embedded = append(embedded, make([]byte, 29)...)
+	largeHash := blake2b.Sum256(large)
+	regular := append(append([]byte{0xC0}, largeKey[:31]...), largeHash[:]...)
+
+	// Keys are split by their most significant bit first
+	left := blake2b.Sum256(embedded)
+	right := blake2b.Sum256(regular)
+	branch := append(append([]byte{left[0] & 0x7F}, left[1:]...), right[:]...)
+
+	testCases := []struct {
+		name     string
+		kvs      map[Hash][]byte
+		expected Hash
+	}{
+		{"Empty", map[Hash][]byte{}, Hash{}},
+		{"Embedded leaf", map[Hash][]byte{smallKey: small}, blake2b.Sum256(embedded)},
+		{"Regular leaf", map[Hash][]byte{largeKey: large}, blake2b.Sum256(regular)},
+		{"Branch", map[Hash][]byte{smallKey: small, largeKey: large}, blake2b.Sum256(branch)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, MerkleRoot(tc.kvs))
+		})
+	}
+}
+
+func TestMerkleRootKnownAnswers(t *testing.T) {
+	// Roots from an independent implementation of the trie of the Gray
+	// Paper's appendix D, with bits read from the most significant first
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		assert.NoError(t, err)
+		return b
+	}
+	keyA := Hash(decode("16c72e0c2e0b78157e3a116d86d90461a199e439325317aea160b30347adb8ec"))
+	keyB := Hash(decode("645eece27fdce6fd3852790131a50dc5b2dd655a855421b88700e6eb43279ad9"))
+	keyC := Hash(decode("3dbc5f775f6156957139100c343bb5ae6589af7398db694ab6c60630a9ed0fcd"))
+	valueA := decode("4227b4a465084852cd87d8f23bec0db6fa7766b9685ab5e095ef9cda9e15e49dff")
+	valueB := decode("72fdb0c99cf47feb85b2dad01ee163139ee6d34a8d893029a200aff76f4be5930b9000a1bbb2dc2b6c79f8f3c19906c94a3472349817af21181c3eef6b")
+	valueC := decode("4c")
+
+	testCases := []struct {
+		name     string
+		kvs      map[Hash][]byte
+		expected string
+	}{
+		{"One regular leaf", map[Hash][]byte{keyA: valueA}, "44326464e5665bfbecd72f3d5efa69e1edc5748892cf1b3f10a6256500e29ac4"},
+		{"Branches", map[Hash][]byte{keyA: valueA, keyB: valueB, keyC: valueC}, "9c7208acbcc6426c94c443ebb80a39fe0ff0b93e8698727b1dbca56ff7cda095"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, Hash(decode(tc.expected)), MerkleRoot(tc.kvs))
+		})
+	}
+}
+
+func TestTrieTestVectors(t *testing.T) {
+	data, err := os.ReadFile("jamtestvectors/trie/trie.json")
+	if os.IsNotExist(err) {
+		missingTestVectors(t, "Trie")
+	}
+	assert.NoError(t, err)
+
+	var testCases []struct {
+		Input  map[string]string `json:"input"`
+		Output string            `json:"output"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &testCases))
+
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+		assert.NoError(t, err)
+		return b
+	}
+	for i, tc := range testCases {
+		kvs := make(map[Hash][]byte)
+		for key, value := range tc.Input {
+			kvs[Hash(decode(key))] = decode(value)
+		}
+		assert.Equal(t, Hash(decode(tc.Output)), MerkleRoot(kvs), "test case %d", i)
+	}
+}
+
+func TestCalculateStateRoot(t *testing.T) {
+	newState := func() *State {
+		return &State{
+			Tau: 10,
+			Delta: map[uint32]ServiceAccount{
+				1: {
+					Balance:        100,
+					Storage:        map[Hash][]byte{{1}: {1, 2}, {2}: {3}},
+					PreimageLookup: map[Hash][]byte{{3}: {4, 5, 6}},
+					PreimageMeta: map[struct {
+						Hash
+						Length uint32
+					}][]uint32{{Hash{3}, 3}: {7}},
+				},
+			},
+		}
+	}
+	state := newState()
+
+	kvs := state.StateKeyValues()
+	assert.Len(t, kvs, 13+5, "Every component, and the account info, storage, preimage and lookup items")
+	storageKey := append([]byte{0xFF, 0xFF, 0xFF, 0xFF, 1}, make([]byte, 27)...)
+	assert.Equal(t, []byte{1, 2}, kvs[serviceDataKey(1, storageKey)])
+	preimageKey := append([]byte{0xFE, 0xFF, 0xFF, 0xFF}, make([]byte, 28)...)
+	assert.Equal(t, []byte{4, 5, 6}, kvs[serviceDataKey(1, preimageKey)])
+
+	root := CalculateStateRoot(state)
+	assert.Equal(t, root, CalculateStateRoot(newState()), "Independent of map ordering")
+
+	state.Delta[1].Storage[Hash{2}] = []byte{4}
+	assert.NotEqual(t, root, CalculateStateRoot(state))
+}